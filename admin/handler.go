@@ -0,0 +1,406 @@
+// Package admin is an HTTP API for support staff to inspect and manage SQRL
+// identities. It's meant to be mounted apart from the public SQRL
+// endpoints, typically on an internal listener:
+//
+//	h := admin.NewHandler(authStore, hoard, admin.BearerToken(token))
+//	mux.Handle("/admin/", http.StripPrefix("/admin", h))
+//
+// Routes, relative to where the handler is mounted:
+//
+//	GET    /identities?after=<idk>&limit=<n>  page through identities
+//	GET    /identities/{idk}                   get an identity
+//	GET    /identities/{idk}/chain             follow the Rekeyed links
+//	PATCH  /identities/{idk}                   set disabled, hardlock or sqrlOnly
+//	DELETE /identities/{idk}/nuts              purge outstanding nuts
+//
+// Changes to hardlock and sqrlOnly are put to the PolicyEnforcer first and
+// answer 409 Conflict if it vetoes them. Listing needs an
+// ssp.IdentityLister and purging an ssp.NutPurger; without them those
+// routes answer 501 Not Implemented. A MapAuthStore or MapHoard passed
+// through ssp.WrapAuthStore or ssp.WrapHoard has to be set as the Lister,
+// Rekeys or Purger explicitly.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+// DefaultPageSize is the number of identities listed when no limit is given
+const DefaultPageSize = 50
+
+// maxChain bounds how many Rekeyed links are followed
+const maxChain = 32
+
+// Handler serves the admin API
+type Handler struct {
+	AuthStore ssp.ContextAuthStore
+	Hoard     ssp.ContextHoard
+	// optional; set by NewHandler if AuthStore implements it
+	Lister ssp.IdentityLister
+	// optional; set by NewHandler if Hoard implements it
+	Purger ssp.NutPurger
+	// optional; set by NewHandler if AuthStore implements it
+	Rekeys ssp.RekeyStore
+	// every request is denied if nil
+	Authorizer Authorizer
+	// optional; identity_disabled, identity_enabled and policy_changed
+	// are published here
+	Events *ssp.EventBus
+	// optional; asked before hardlock or sqrlOnly is changed, usually the
+	// SqrlSspAPI.PolicyEnforcer
+	PolicyEnforcer ssp.PolicyEnforcer
+	// upper bound for the limit parameter when listing
+	MaxPageSize int
+	// optional; overrides the ssp package logger (see ssp.SetLogger),
+	// usually set to the SqrlSspAPI.Logger
+	Logger *slog.Logger
+
+	mux *http.ServeMux
+}
+
+// NewHandler creates a Handler. Listing and purging are enabled if
+// authStore and hoard support them.
+func NewHandler(authStore ssp.ContextAuthStore, hoard ssp.ContextHoard, authorizer Authorizer) *Handler {
+	h := &Handler{
+		AuthStore:   authStore,
+		Hoard:       hoard,
+		Authorizer:  authorizer,
+		MaxPageSize: 500,
+		mux:         http.NewServeMux(),
+	}
+	h.Lister, _ = authStore.(ssp.IdentityLister)
+	h.Purger, _ = hoard.(ssp.NutPurger)
+	h.Rekeys, _ = authStore.(ssp.RekeyStore)
+
+	h.mux.HandleFunc("GET /identities", h.list)
+	h.mux.HandleFunc("GET /identities/{idk}", h.get)
+	h.mux.HandleFunc("GET /identities/{idk}/chain", h.chain)
+	h.mux.HandleFunc("PATCH /identities/{idk}", h.update)
+	h.mux.HandleFunc("DELETE /identities/{idk}/nuts", h.purge)
+	return h
+}
+
+// Identity is the admin view of an ssp.SqrlIdentity. The secret index
+// answers are left out.
+type Identity struct {
+	Idk      string `json:"idk"`
+	Suk      string `json:"suk"`
+	Vuk      string `json:"vuk"`
+	Pidk     string `json:"pidk,omitempty"`
+	SQRLOnly bool   `json:"sqrlOnly"`
+	Hardlock bool   `json:"hardlock"`
+	Disabled bool   `json:"disabled"`
+	Rekeyed  string `json:"rekeyed,omitempty"`
+}
+
+func newIdentity(identity *ssp.SqrlIdentity) *Identity {
+	return &Identity{
+		Idk:      identity.Idk,
+		Suk:      identity.Suk,
+		Vuk:      identity.Vuk,
+		Pidk:     identity.Pidk,
+		SQRLOnly: identity.SQRLOnly,
+		Hardlock: identity.Hardlock,
+		Disabled: identity.Disabled,
+		Rekeyed:  identity.Rekeyed,
+	}
+}
+
+// Page is the response to listing identities. Next is passed as after to
+// get the following page and is empty on the last page.
+type Page struct {
+	Identities []*Identity `json:"identities"`
+	Next       string      `json:"next,omitempty"`
+}
+
+// Chain is the response to following an identity's Rekeyed links. Chain
+// starts with the requested identity; Current is the last identity found.
+// Broken is set if a link points at a missing identity and Cycle if the
+// links loop. History is the audit trail of rekeys involving the chain,
+// if the store keeps one.
+type Chain struct {
+	Chain   []*Identity  `json:"chain"`
+	Current string       `json:"current"`
+	Broken  bool         `json:"broken,omitempty"`
+	Cycle   bool         `json:"cycle,omitempty"`
+	History []*ssp.Rekey `json:"history,omitempty"`
+}
+
+// Update is the body of a PATCH; fields left out are unchanged
+type Update struct {
+	Disabled *bool `json:"disabled"`
+	Hardlock *bool `json:"hardlock"`
+	SQRLOnly *bool `json:"sqrlOnly"`
+}
+
+// Purged is the response to purging nuts
+type Purged struct {
+	Purged int `json:"purged"`
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorize checks the Authorizer and writes 401 or 403 if it refuses
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, action Action) bool {
+	if h.Authorizer == nil {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return false
+	}
+	err := h.Authorizer.Authorize(r, action)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	writeError(w, http.StatusForbidden, "forbidden")
+	return false
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, ActionList) {
+		return
+	}
+	if h.Lister == nil {
+		writeError(w, http.StatusNotImplemented, "listing is not supported by this store")
+		return
+	}
+	limit := DefaultPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	if h.MaxPageSize > 0 && limit > h.MaxPageSize {
+		limit = h.MaxPageSize
+	}
+	// ask for one more to know if there's a next page
+	identities, err := h.Lister.ListIdentities(r.Context(), r.URL.Query().Get("after"), limit+1)
+	if err != nil {
+		h.storageError(w, "admin_list", err)
+		return
+	}
+	page := &Page{Identities: make([]*Identity, 0, len(identities))}
+	if len(identities) > limit {
+		identities = identities[:limit]
+		page.Next = identities[limit-1].Idk
+	}
+	for _, identity := range identities {
+		page.Identities = append(page.Identities, newIdentity(identity))
+	}
+	h.writeJSON(w, page)
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, ActionRead) {
+		return
+	}
+	identity, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+	h.writeJSON(w, newIdentity(identity))
+}
+
+func (h *Handler) chain(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, ActionRead) {
+		return
+	}
+	identity, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+	chain, err := followRekeyed(r.Context(), h.AuthStore, identity)
+	if err == nil && h.Rekeys != nil {
+		chain.History, err = h.history(r.Context(), chain)
+	}
+	if err != nil {
+		h.storageError(w, "admin_chain", err)
+		return
+	}
+	h.writeJSON(w, chain)
+}
+
+// followRekeyed walks the Rekeyed links from identity
+func followRekeyed(ctx context.Context, store ssp.ContextAuthStore, identity *ssp.SqrlIdentity) (*Chain, error) {
+	chain := &Chain{}
+	seen := make(map[string]bool)
+	for {
+		chain.Chain = append(chain.Chain, newIdentity(identity))
+		chain.Current = identity.Idk
+		seen[identity.Idk] = true
+		if identity.Rekeyed == "" {
+			return chain, nil
+		}
+		if seen[identity.Rekeyed] || len(chain.Chain) >= maxChain {
+			chain.Cycle = true
+			return chain, nil
+		}
+		next, err := store.FindIdentity(ctx, identity.Rekeyed)
+		if err == ssp.ErrNotFound {
+			chain.Broken = true
+			return chain, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		identity = next
+	}
+}
+
+// history collects the rekeys of every identity in chain
+func (h *Handler) history(ctx context.Context, chain *Chain) ([]*ssp.Rekey, error) {
+	var history []*ssp.Rekey
+	seen := make(map[ssp.Rekey]bool)
+	for _, identity := range chain.Chain {
+		rekeys, err := h.Rekeys.FindRekeys(ctx, identity.Idk)
+		if err != nil {
+			return nil, err
+		}
+		for _, rekey := range rekeys {
+			if !seen[*rekey] {
+				seen[*rekey] = true
+				history = append(history, rekey)
+			}
+		}
+	}
+	return history, nil
+}
+
+func (h *Handler) update(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, ActionUpdate) {
+		return
+	}
+	update := &Update{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(update); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	found, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+	// don't modify what the store handed out until it's saved
+	identity := *found
+	wasDisabled := identity.Disabled
+	if update.Disabled != nil {
+		identity.Disabled = *update.Disabled
+	}
+	change := &ssp.PolicyChange{
+		Idk:      identity.Idk,
+		Previous: ssp.Policy{SQRLOnly: identity.SQRLOnly, Hardlock: identity.Hardlock},
+		Admin:    true,
+	}
+	change.Requested = change.Previous
+	if update.Hardlock != nil {
+		change.Requested.Hardlock = *update.Hardlock
+	}
+	if update.SQRLOnly != nil {
+		change.Requested.SQRLOnly = *update.SQRLOnly
+	}
+	policyChanged := change.Requested != change.Previous
+	if policyChanged {
+		if err := ssp.ChangePolicy(r.Context(), h.PolicyEnforcer, &identity, change); err != nil {
+			h.log().Info("admin policy change vetoed", "idk", ssp.RedactedKey(identity.Idk), "error", err)
+			writeError(w, http.StatusConflict, "policy change vetoed")
+			return
+		}
+	}
+	if err := h.AuthStore.SaveIdentity(r.Context(), &identity); err != nil {
+		h.storageError(w, "admin_update", err)
+		return
+	}
+	h.log().Info("admin update", "idk", ssp.RedactedKey(identity.Idk),
+		"disabled", identity.Disabled, "hardlock", identity.Hardlock, "sqrlOnly", identity.SQRLOnly)
+	if h.Events != nil && wasDisabled != identity.Disabled {
+		eventType := ssp.EventIdentityEnabled
+		if identity.Disabled {
+			eventType = ssp.EventIdentityDisabled
+		}
+		h.Events.Publish(r.Context(), &ssp.Event{Type: eventType, Cmd: "admin", Idk: identity.Idk})
+	}
+	if h.Events != nil && policyChanged {
+		h.Events.Publish(r.Context(), &ssp.Event{Type: ssp.EventPolicyChanged, Cmd: "admin", Idk: identity.Idk, Policy: &change.Requested})
+	}
+	h.writeJSON(w, newIdentity(&identity))
+}
+
+func (h *Handler) purge(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, ActionPurge) {
+		return
+	}
+	if h.Purger == nil {
+		writeError(w, http.StatusNotImplemented, "purging is not supported by this hoard")
+		return
+	}
+	idk := r.PathValue("idk")
+	purged, err := h.Purger.PurgeNuts(r.Context(), idk)
+	if err != nil {
+		h.storageError(w, "admin_purge", err)
+		return
+	}
+	h.log().Info("admin purge", "idk", ssp.RedactedKey(idk), "purged", purged)
+	h.writeJSON(w, &Purged{Purged: purged})
+}
+
+// find loads the identity named in the path, writing 404 if it's missing
+func (h *Handler) find(w http.ResponseWriter, r *http.Request) (*ssp.SqrlIdentity, bool) {
+	identity, err := h.AuthStore.FindIdentity(r.Context(), r.PathValue("idk"))
+	if err == ssp.ErrNotFound {
+		writeError(w, http.StatusNotFound, "identity not found")
+		return nil, false
+	}
+	if err != nil {
+		h.storageError(w, "admin_find", err)
+		return nil, false
+	}
+	return identity, true
+}
+
+// log returns the Handler.Logger or the ssp package logger
+func (h *Handler) log() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return ssp.Logger()
+}
+
+// logError logs like ssp.SafeLogError to the Handler's logger
+func (h *Handler) logError(context string, err error) {
+	h.log().Error("Error", "context", ssp.SafeString(context), "error", ssp.SafeString(err.Error()))
+}
+
+func (h *Handler) storageError(w http.ResponseWriter, context string, err error) {
+	h.logError(context, err)
+	writeError(w, http.StatusInternalServerError, "storage error")
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		h.logError("admin_encode", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,320 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+const testToken = "s3cret"
+
+type testAdmin struct {
+	t       *testing.T
+	handler *Handler
+	store   *ssp.MapAuthStore
+	hoard   *ssp.MapHoard
+}
+
+func newTestAdmin(t *testing.T) *testAdmin {
+	store := ssp.NewMapAuthStore()
+	hoard := ssp.NewMapHoard()
+	handler := NewHandler(ssp.WrapAuthStore(store), ssp.WrapHoard(hoard), BearerToken(testToken))
+	handler.Lister = store
+	handler.Purger = hoard
+	handler.Rekeys = store
+	return &testAdmin{t, handler, store, hoard}
+}
+
+func (ta *testAdmin) do(method, path, body string, into interface{}) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	ta.handler.ServeHTTP(w, r)
+	if into != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), into); err != nil {
+			ta.t.Fatalf("Failed decoding %s %s response %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func (ta *testAdmin) save(identities ...*ssp.SqrlIdentity) {
+	for _, identity := range identities {
+		if err := ta.store.SaveIdentity(identity); err != nil {
+			ta.t.Fatal(err)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	ta := newTestAdmin(t)
+	ta.save(&ssp.SqrlIdentity{Idk: "a"})
+
+	cases := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer nope", http.StatusUnauthorized},
+		{"basic", "Basic " + testToken, http.StatusUnauthorized},
+		{"valid", "Bearer " + testToken, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/identities/a", nil)
+			if c.header != "" {
+				r.Header.Set("Authorization", c.header)
+			}
+			w := httptest.NewRecorder()
+			ta.handler.ServeHTTP(w, r)
+			if w.Code != c.status {
+				t.Errorf("Expected %d, got %d", c.status, w.Code)
+			}
+		})
+	}
+
+	ta.handler.Authorizer = AuthorizerFunc(func(r *http.Request, action Action) error {
+		if action != ActionRead {
+			return ssp.ErrNotFound
+		}
+		return nil
+	})
+	if code := ta.do("PATCH", "/identities/a", `{"disabled":true}`, nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a refused action, got %d", code)
+	}
+	if code := ta.do("GET", "/identities/a", "", nil); code != http.StatusOK {
+		t.Errorf("Expected 200 for an allowed action, got %d", code)
+	}
+
+	ta.handler.Authorizer = nil
+	if code := ta.do("GET", "/identities/a", "", nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without an Authorizer, got %d", code)
+	}
+}
+
+func TestGetIdentity(t *testing.T) {
+	ta := newTestAdmin(t)
+	ta.save(&ssp.SqrlIdentity{Idk: "a", Suk: "suk", Vuk: "vuk", Hardlock: true, Ins: "secret"})
+
+	identity := &Identity{}
+	if code := ta.do("GET", "/identities/a", "", identity); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if identity.Idk != "a" || identity.Suk != "suk" || !identity.Hardlock {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+	if code := ta.do("GET", "/identities/missing", "", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", code)
+	}
+}
+
+func TestChain(t *testing.T) {
+	ta := newTestAdmin(t)
+	ta.save(
+		&ssp.SqrlIdentity{Idk: "a", Rekeyed: "b"},
+		&ssp.SqrlIdentity{Idk: "b", Pidk: "a", Rekeyed: "c"},
+		&ssp.SqrlIdentity{Idk: "c", Pidk: "b"},
+		&ssp.SqrlIdentity{Idk: "x", Rekeyed: "gone"},
+		&ssp.SqrlIdentity{Idk: "y", Rekeyed: "z"},
+		&ssp.SqrlIdentity{Idk: "z", Rekeyed: "y"},
+	)
+
+	ctx := context.Background()
+	_ = ta.store.SaveRekey(ctx, &ssp.Rekey{PreviousIdk: "a", Idk: "b", Time: time.Now()})
+	_ = ta.store.SaveRekey(ctx, &ssp.Rekey{PreviousIdk: "b", Idk: "c", Time: time.Now()})
+
+	chain := &Chain{}
+	ta.do("GET", "/identities/a/chain", "", chain)
+	if chain.Current != "c" || len(chain.Chain) != 3 || chain.Broken || chain.Cycle {
+		t.Errorf("Unexpected chain %+v", chain)
+	}
+	if len(chain.History) != 2 || chain.History[1].Idk != "c" {
+		t.Errorf("Expected both rekeys in history, got %+v", chain.History)
+	}
+
+	chain = &Chain{}
+	ta.do("GET", "/identities/x/chain", "", chain)
+	if chain.Current != "x" || !chain.Broken {
+		t.Errorf("Expected broken chain, got %+v", chain)
+	}
+
+	chain = &Chain{}
+	ta.do("GET", "/identities/y/chain", "", chain)
+	if !chain.Cycle || len(chain.Chain) != 2 {
+		t.Errorf("Expected cycle, got %+v", chain)
+	}
+}
+
+func TestList(t *testing.T) {
+	ta := newTestAdmin(t)
+	for _, idk := range []string{"d", "b", "e", "a", "c"} {
+		ta.save(&ssp.SqrlIdentity{Idk: idk})
+	}
+
+	var idks []string
+	after := ""
+	for pages := 0; pages < 5; pages++ {
+		page := &Page{}
+		if code := ta.do("GET", "/identities?limit=2&after="+after, "", page); code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		for _, identity := range page.Identities {
+			idks = append(idks, identity.Idk)
+		}
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+	}
+	if strings.Join(idks, ",") != "a,b,c,d,e" {
+		t.Errorf("Expected all identities in order, got %v", idks)
+	}
+
+	if code := ta.do("GET", "/identities?limit=0", "", nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad limit, got %d", code)
+	}
+	ta.handler.Lister = nil
+	if code := ta.do("GET", "/identities", "", nil); code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a lister, got %d", code)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ta := newTestAdmin(t)
+	ta.save(&ssp.SqrlIdentity{Idk: "a", SQRLOnly: true})
+	sink := ssp.NewChannelSink(4)
+	ta.handler.Events = ssp.NewEventBus(sink)
+
+	identity := &Identity{}
+	if code := ta.do("PATCH", "/identities/a", `{"disabled":true,"hardlock":true}`, identity); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	stored, _ := ta.store.FindIdentity("a")
+	if !stored.Disabled || !stored.Hardlock || !stored.SQRLOnly {
+		t.Errorf("Expected disabled and hardlocked with sqrlonly unchanged, got %+v", stored)
+	}
+	if !identity.Disabled {
+		t.Errorf("Expected updated identity in response, got %+v", identity)
+	}
+	for _, eventType := range []ssp.EventType{ssp.EventIdentityDisabled, ssp.EventPolicyChanged} {
+		select {
+		case event := <-sink.C:
+			if event.Type != eventType || event.Idk != "a" {
+				t.Errorf("Expected %v, got %+v", eventType, event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %v event", eventType)
+		}
+	}
+
+	ta.do("PATCH", "/identities/a", `{"sqrlOnly":false}`, nil)
+	if stored, _ := ta.store.FindIdentity("a"); stored.SQRLOnly || !stored.Disabled {
+		t.Errorf("Expected only sqrlOnly changed, got %+v", stored)
+	}
+	select {
+	case event := <-sink.C:
+		if event.Type != ssp.EventPolicyChanged || *event.Policy != (ssp.Policy{Hardlock: true}) {
+			t.Errorf("Expected only a policy_changed event, got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected policy_changed event")
+	}
+
+	ta.do("PATCH", "/identities/a", `{"hardlock":true}`, nil)
+	if len(sink.C) != 0 {
+		t.Error("Expected no event when nothing changed")
+	}
+
+	if code := ta.do("PATCH", "/identities/a", `{"rekeyed":"b"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown fields, got %d", code)
+	}
+	if code := ta.do("PATCH", "/identities/missing", `{}`, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", code)
+	}
+}
+
+type vetoEnforcer struct {
+	changes []*ssp.PolicyChange
+}
+
+func (ve *vetoEnforcer) PolicyChanged(ctx context.Context, change *ssp.PolicyChange) error {
+	ve.changes = append(ve.changes, change)
+	return errors.New("not on this site")
+}
+
+func TestUpdatePolicyVeto(t *testing.T) {
+	ta := newTestAdmin(t)
+	ta.save(&ssp.SqrlIdentity{Idk: "a", SQRLOnly: true})
+	enforcer := &vetoEnforcer{}
+	ta.handler.PolicyEnforcer = enforcer
+
+	if code := ta.do("PATCH", "/identities/a", `{"disabled":true,"sqrlOnly":false}`, nil); code != http.StatusConflict {
+		t.Errorf("Expected 409, got %d", code)
+	}
+	if len(enforcer.changes) != 1 || !enforcer.changes[0].Admin ||
+		enforcer.changes[0].Previous != (ssp.Policy{SQRLOnly: true}) || enforcer.changes[0].Requested != (ssp.Policy{}) {
+		t.Errorf("Unexpected changes %+v", enforcer.changes)
+	}
+	if stored, _ := ta.store.FindIdentity("a"); !stored.SQRLOnly || stored.Disabled {
+		t.Errorf("Expected nothing saved, got %+v", stored)
+	}
+
+	// only policy changes are put to the enforcer
+	if code := ta.do("PATCH", "/identities/a", `{"disabled":true,"sqrlOnly":true}`, nil); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+	if len(enforcer.changes) != 1 {
+		t.Errorf("Expected no call without a policy change, got %+v", enforcer.changes)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ta := newTestAdmin(t)
+	ta.save(&ssp.SqrlIdentity{Idk: "abcdefghijklmnop"})
+	var buf bytes.Buffer
+	ta.handler.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	ta.do("PATCH", "/identities/abcdefghijklmnop", `{"disabled":true}`, nil)
+	if out := buf.String(); !strings.Contains(out, `"msg":"admin update"`) || strings.Contains(out, "ijklmnop") {
+		t.Errorf("Expected a redacted record on the handler's logger, got %s", out)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ta := newTestAdmin(t)
+	ctx := context.Background()
+	request := &ssp.CliRequest{Client: &ssp.ClientBody{Idk: "a"}}
+	hoard := ssp.WrapHoard(ta.hoard)
+	_ = hoard.Save(ctx, "next", &ssp.HoardCache{LastRequest: request}, time.Minute)
+	_ = hoard.Save(ctx, "pag", &ssp.HoardCache{Identity: &ssp.SqrlIdentity{Idk: "a"}}, time.Minute)
+	_ = hoard.Save(ctx, "other", &ssp.HoardCache{Identity: &ssp.SqrlIdentity{Idk: "b"}}, time.Minute)
+	_ = hoard.Save(ctx, "issued", &ssp.HoardCache{State: "issued"}, time.Minute)
+
+	purged := &Purged{}
+	if code := ta.do("DELETE", "/identities/a/nuts", "", purged); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if purged.Purged != 2 {
+		t.Errorf("Expected 2 nuts purged, got %d", purged.Purged)
+	}
+	for nut, present := range map[ssp.Nut]bool{"next": false, "pag": false, "other": true, "issued": true} {
+		if _, err := hoard.Get(ctx, nut); (err == nil) != present {
+			t.Errorf("Expected nut %s present=%v, got err %v", nut, present, err)
+		}
+	}
+
+	ta.handler.Purger = nil
+	if code := ta.do("DELETE", "/identities/a/nuts", "", nil); code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a purger, got %d", code)
+	}
+}
@@ -12,9 +12,12 @@
 package ssp
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"time"
 )
@@ -29,7 +32,8 @@ var Sqrl64 = base64.RawURLEncoding
 // SqrlScheme is sqrl
 const SqrlScheme = "sqrl"
 
-// A Tree produces Nuts :)
+// A Tree produces Nuts :) They must be Sqrl64 encoded as the endpoints
+// refuse anything else.
 type Tree interface {
 	Nut() (Nut, error)
 }
@@ -48,13 +52,30 @@ type Hoard interface {
 
 // HoardCache is the state associated with a Nut
 type HoardCache struct {
-	State        string        `json:"state"`
+	State        NutState      `json:"state"`
 	RemoteIP     string        `json:"remoteIP"`
 	OriginalNut  Nut           `json:"originalNut"`
 	PagNut       Nut           `json:"pagNut"`
+	Sin          string        `json:"sin"`
 	LastRequest  *CliRequest   `json:"lastRequest"`
 	Identity     *SqrlIdentity `json:"identity"`
 	LastResponse []byte        `json:"lastResponse"`
+	// how the nut got to State, oldest first
+	Transitions []NutTransition `json:"transitions,omitempty"`
+	// how far the login has got, for a NutStatus record
+	Progress NutState `json:"progress,omitempty"`
+}
+
+// ForIdentity is true if the nut was issued to idk, either as the next nut
+// of one of its requests or as a pag nut waiting to log it in
+func (hc *HoardCache) ForIdentity(idk string) bool {
+	if hc == nil || idk == "" {
+		return false
+	}
+	if hc.Identity != nil && hc.Identity.Idk == idk {
+		return true
+	}
+	return hc.LastRequest != nil && hc.LastRequest.Client != nil && hc.LastRequest.Client.Idk == idk
 }
 
 // SqrlIdentity holds all the info about a valid SQRL identity
@@ -67,6 +88,11 @@ type SqrlIdentity struct {
 	Hardlock bool   `json:"hardlock"`
 	Disabled bool   `json:"disabled"`
 	Rekeyed  string `json:"rekeyed"` // If this Idk has been rekeyed, this links to the new ID
+	// Sin is the last secret index challenge answered by this identity and
+	// Ins is the client's answer to it. Both are empty until a
+	// SecretIndexProvider has issued a sin.
+	Sin string `json:"sin"`
+	Ins string `json:"ins"`
 	// Btn is filled in if the request includes a button press response from an
 	// ask. -1 if there's no value.
 	Btn int `json:"-" sql:"-"`
@@ -110,14 +136,47 @@ type AuthStore interface {
 // https://www.grc.com/sqrl/sspapi.htm
 type SqrlSspAPI struct {
 	tree          Tree
-	hoard         Hoard
+	hoard         ContextHoard
 	NutExpiration time.Duration
-	authStore     AuthStore
+	authStore     ContextAuthStore
 	// set to the hostname for serving SQRL urls; this can include a port if necessary
 	HostOverride string
 	// if the SQRL endpoints are not at the root of the host, then this overrides the path where they are hosted
 	RootPath      string
 	Authenticator Authenticator
+	// ContextAuthenticator takes precedence over Authenticator if set
+	ContextAuthenticator ContextAuthenticator
+	// optional; when set, query responses carry a sin challenge and the
+	// client's ins/pins answers are verified and stored on the identity
+	SecretIndexProvider SecretIndexProvider
+	// how long /pag.sqrl waits for the login to finish before answering
+	// 404; 0 answers immediately. Otherwise requests accepting
+	// text/event-stream get a Server-Sent Events stream instead, held
+	// for PagWait at a time.
+	PagWait time.Duration
+	// optional; saves the progress of each login for the Status WebSocket
+	// so it can report the query step and pending asks
+	StatusUpdates bool
+	// optional; cross-origin hosts allowed to open the Status WebSocket,
+	// as websocket.AcceptOptions.OriginPatterns
+	StatusOrigins []string
+	// optional per endpoint request rate limits
+	RateLimits RateLimits
+	// proxies allowed to set Forwarded, X-Forwarded-For, X-Forwarded-Host
+	// and X-Forwarded-Server; see ParseTrustedProxies
+	TrustedProxies []netip.Prefix
+	// the header TrustedProxies write, X-Forwarded-For by default
+	TrustedProxyHeader ProxyHeader
+	// optional; authentication events are published here
+	Events *EventBus
+	// optional; requests and storage calls are recorded here
+	Metrics *Metrics
+	// optional; /cli.sqrl steps are traced as spans
+	Tracer Tracer
+	// optional; told about sqrlonly and hardlock changes and can veto them
+	PolicyEnforcer PolicyEnforcer
+	// optional; overrides the package logger (see SetLogger) for this API
+	Logger *slog.Logger
 }
 
 // NutExpirationSeconds has a self-explanatory name
@@ -129,27 +188,55 @@ func (api *SqrlSspAPI) NutExpirationSeconds() int {
 // If set to nil, a the API defaults to NewRandomTree(8).
 // Also needs a Hoard to store a retrieve Nuts
 func NewSqrlSspAPI(tree Tree, hoard Hoard, authenticator Authenticator, authStore AuthStore) *SqrlSspAPI {
+	api := NewSqrlSspAPIContext(tree, WrapHoard(hoard), nil, WrapAuthStore(authStore))
+	api.Authenticator = authenticator
+	return api
+}
+
+// NewSqrlSspAPIContext is the same as NewSqrlSspAPI but takes the
+// context-first versions of the storage and Authenticator interfaces
+func NewSqrlSspAPIContext(tree Tree, hoard ContextHoard, authenticator ContextAuthenticator, authStore ContextAuthStore) *SqrlSspAPI {
 	if tree == nil {
 		tree, _ = NewRandomTree(8)
 	}
 	return &SqrlSspAPI{
-		tree:          tree,
-		hoard:         hoard,
-		NutExpiration: 10 * time.Minute,
-		Authenticator: authenticator,
-		authStore:     authStore,
+		tree:                 tree,
+		hoard:                hoard,
+		NutExpiration:        10 * time.Minute,
+		ContextAuthenticator: authenticator,
+		authStore:            authStore,
+	}
+}
+
+// authenticator returns ContextAuthenticator or the adapted Authenticator
+func (api *SqrlSspAPI) authenticator() ContextAuthenticator {
+	if api.ContextAuthenticator != nil {
+		return api.ContextAuthenticator
 	}
+	return WrapAuthenticator(api.Authenticator)
 }
 
 // Host gets the host in order of preference:
-// SqrlSspAPI.HostOverride, header X-Forwarded-Host, Request.Host
+// SqrlSspAPI.HostOverride, the forwarded host, Request.Host. The forwarded
+// host is the Forwarded header host or header X-Forwarded-Host, then
+// X-Forwarded-Server, depending on SqrlSspAPI.TrustedProxyHeader, and is
+// only used when the request comes from one of SqrlSspAPI.TrustedProxies.
 func (api *SqrlSspAPI) Host(r *http.Request) string {
 	host := api.HostOverride
-	if host == "" {
-		host = r.Header.Get("X-Forwarded-Host")
-	}
-	if host == "" {
-		host = r.Header.Get("X-Forwarded-Server")
+	if host == "" && api.peerTrusted(r) {
+		if api.TrustedProxyHeader == Forwarded {
+			// the host seen by the outermost trusted proxy
+			hops := api.forwardedHops(r)
+			_, written := api.resolveClient(r, hops)
+			for i := max(written, 0); i < len(hops) && host == ""; i++ {
+				host = hops[i].Host
+			}
+		} else {
+			host = lastEntry(r, "X-Forwarded-Host")
+			if host == "" {
+				host = lastEntry(r, "X-Forwarded-Server")
+			}
+		}
 	}
 	if host == "" {
 		host = r.Host
@@ -157,26 +244,29 @@ func (api *SqrlSspAPI) Host(r *http.Request) string {
 	return host
 }
 
-func (api *SqrlSspAPI) swapIdentities(previousIdentity, newIdentity *SqrlIdentity) error {
-	err := api.Authenticator.SwapIdentities(previousIdentity, newIdentity)
+func (api *SqrlSspAPI) swapIdentities(ctx context.Context, store ContextAuthStore, previousIdentity, newIdentity *SqrlIdentity) error {
+	err := api.authenticator().SwapIdentities(ctx, previousIdentity, newIdentity)
 	if err != nil {
 		return err
 	}
 	previousIdentity.Rekeyed = newIdentity.Idk
-	return api.authStore.SaveIdentity(previousIdentity)
+	return store.SaveIdentity(ctx, previousIdentity)
 }
 
-func (api *SqrlSspAPI) removeIdentity(identity *SqrlIdentity) error {
-	err := api.Authenticator.RemoveIdentity(identity)
+func (api *SqrlSspAPI) removeIdentity(ctx context.Context, store ContextAuthStore, identity *SqrlIdentity) error {
+	err := api.authenticator().RemoveIdentity(ctx, identity)
 	if err != nil {
 		return err
 	}
-	return api.authStore.DeleteIdentity(identity.Idk)
+	return store.DeleteIdentity(ctx, identity.Idk)
 }
 
-func (api *SqrlSspAPI) authenticateIdentity(identity *SqrlIdentity, btn int) (string, error) {
-	redirect := api.Authenticator.AuthenticateIdentity(identity)
-	return redirect, api.authStore.SaveIdentity(identity)
+func (api *SqrlSspAPI) authenticateIdentity(ctx context.Context, store ContextAuthStore, identity *SqrlIdentity, btn int) (string, error) {
+	redirect, err := api.authenticator().AuthenticateIdentity(ctx, identity)
+	if err != nil {
+		return "", err
+	}
+	return redirect, store.SaveIdentity(ctx, identity)
 }
 
 // HTTPSRoot returns the best guess at the https root URL for this server
@@ -188,17 +278,22 @@ func (api *SqrlSspAPI) HTTPSRoot(r *http.Request) *url.URL {
 	}
 }
 
-// RemoteIP gets the remote IP as a string from a request
-// It prefers the X-Forwarded-For header since it's likely
-// this server will be behind a load balancer
+// RemoteIP gets the client IP address of a request without a port. If
+// the request comes from one of SqrlSspAPI.TrustedProxies the
+// SqrlSspAPI.TrustedProxyHeader is read from right to left, skipping
+// trusted proxies, to find the client. Headers from any other peer are
+// ignored since the client could have set them.
 func (api *SqrlSspAPI) RemoteIP(r *http.Request) string {
-	ipAddress := r.Header.Get("X-Forwarded-For")
-	if ipAddress == "" {
-		ipAddress = r.RemoteAddr
-	}
+	ipAddress, _ := api.resolveClient(r, api.forwardedHops(r))
 	return ipAddress
 }
 
+// peerTrusted reports whether the direct peer is a trusted proxy
+func (api *SqrlSspAPI) peerTrusted(r *http.Request) bool {
+	peer, ok := parseHopAddr(r.RemoteAddr)
+	return ok && api.trusted(peer)
+}
+
 func (api *SqrlSspAPI) qry(nut Nut) string {
 	return fmt.Sprintf("%v/cli.sqrl?nut=%v", api.RootPath, nut)
 }
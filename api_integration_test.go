@@ -31,8 +31,8 @@ func setupTestServer(t *testing.T) (*httptest.Server, *SqrlSspAPI) {
 	// Create API instance
 	api := &SqrlSspAPI{
 		tree:          tree,
-		hoard:         hoard,
-		authStore:     authStore,
+		hoard:         WrapHoard(hoard),
+		authStore:     WrapAuthStore(authStore),
 		Authenticator: authenticator,
 		NutExpiration: 5 * time.Minute,
 	}
@@ -70,7 +70,7 @@ func TestSqrlSspAPI_Host_Override(t *testing.T) {
 }
 
 func TestSqrlSspAPI_Host_ForwardedHost(t *testing.T) {
-	api := &SqrlSspAPI{}
+	api := &SqrlSspAPI{TrustedProxies: testTrustedProxies(t, "192.0.2.0/24")}
 
 	req := httptest.NewRequest("GET", "/", nil)
 	req.Host = "original.example.com"
@@ -83,7 +83,7 @@ func TestSqrlSspAPI_Host_ForwardedHost(t *testing.T) {
 }
 
 func TestSqrlSspAPI_Host_ForwardedServer(t *testing.T) {
-	api := &SqrlSspAPI{}
+	api := &SqrlSspAPI{TrustedProxies: testTrustedProxies(t, "192.0.2.0/24")}
 
 	req := httptest.NewRequest("GET", "/", nil)
 	req.Host = "original.example.com"
@@ -108,7 +108,7 @@ func TestSqrlSspAPI_Host_RequestHost(t *testing.T) {
 }
 
 func TestSqrlSspAPI_RemoteIP_Forwarded(t *testing.T) {
-	api := &SqrlSspAPI{}
+	api := &SqrlSspAPI{TrustedProxies: testTrustedProxies(t, "192.168.1.1")}
 
 	req := httptest.NewRequest("GET", "/", nil)
 	req.RemoteAddr = "192.168.1.1:12345"
@@ -127,8 +127,8 @@ func TestSqrlSspAPI_RemoteIP_Direct(t *testing.T) {
 	req.RemoteAddr = "192.168.1.1:12345"
 
 	ip := api.RemoteIP(req)
-	if ip != "192.168.1.1:12345" {
-		t.Errorf("Expected 192.168.1.1:12345, got %s", ip)
+	if ip != "192.168.1.1" {
+		t.Errorf("Expected 192.168.1.1, got %s", ip)
 	}
 }
 
@@ -1,9 +1,10 @@
 package ssp
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 )
 
 var supportedCommands = map[string]bool{
@@ -17,23 +18,53 @@ var supportedCommands = map[string]bool{
 // Cli implements the /cli.sqrl endpoint
 func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 	// SECURITY: Sanitize URL before logging to prevent log injection
-	SafeLogInfo("Req: %v", sanitizeForLog(r.URL.String()))
+	api.log().Info("Req", "url", r.URL.String())
+	w, observe := api.observeEndpoint(w, "cli")
+	defer observe()
+	start := time.Now()
+	var req *CliRequest
+	var response *CliResponse
+	ctx, span := api.startSpan(r.Context(), SpanCli)
+	// runs last so the final TIF is recorded
+	defer func() {
+		api.observeCli(start, req, response)
+		setRequestAttributes(span, req)
+		if response != nil {
+			span.SetAttribute(AttrTIF, int64(response.TIF))
+		}
+		span.End()
+	}()
+
 	nut := Nut(r.URL.Query().Get("nut"))
-	if nut == "" {
-		_, _ = w.Write(NewCliResponse("", "").WithClientFailure().Encode())
+	if !validNut(nut) {
+		response = NewCliResponse("", "").WithClientFailure()
+		_, _ = w.Write(response.Encode())
 		return
 	}
 
 	// response mutates from here depending on available values
-	response := NewCliResponse(Nut(nut), api.qry(nut))
+	response = NewCliResponse(Nut(nut), api.qry(nut))
+	// over the limit the nut isn't used so the client can retry with it
+	if !api.allow(ctx, api.RateLimits.Cli, "cli:"+api.RemoteIP(r)) {
+		_, _ = w.Write(response.WithTransientError().WithCommandFailed().Encode())
+		return
+	}
+	_, parseSpan := api.startSpan(ctx, SpanParse)
 	req, err := ParseCliRequest(r)
+	endSpan(parseSpan, err)
 	if err != nil {
+		req = nil
 		// SECURITY: Sanitize error to prevent log injection from user input
-		SafeLogError("parse_request", err)
+		api.log().Error("parse_request", err)
+		api.validationFailed(ctx, &CliRequest{IPAddress: api.RemoteIP(r)}, nil, ReasonMalformedRequest)
 		_, _ = w.Write(response.WithClientFailure().WithCommandFailed().Encode())
 		return
 	}
 	// Signature is OK from here on!
+	if !api.allow(ctx, api.RateLimits.Identity, "idk:"+req.Client.Idk) {
+		_, _ = w.Write(response.WithTransientError().WithCommandFailed().Encode())
+		return
+	}
 
 	// NOTE: Do NOT call req.Clear() here - the request object is stored by reference
 	// in HoardCache.LastRequest for validation of subsequent requests. Clearing it
@@ -41,41 +72,51 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 	// entries expire or are deleted (see MapHoard.cleanup and HoardCache.Clear).
 
 	// defer writing the response and saving the new nut
-	defer api.writeResponse(req, response, w)
+	defer api.writeResponse(ctx, req, response, w)
 
 	// SECURITY: Use safe logging instead of dumping full request
-	SafeLogRequest(req)
+	api.log().Request(req)
 
-	hoardCache, err := api.getAndDelete(Nut(nut))
+	stepCtx, step := api.startStep(ctx, SpanGetAndDelete, req)
+	hoardCache, err := api.getAndDelete(stepCtx, nut)
+	endStep(step, response, err)
 	if err != nil {
 		if err == ErrNotFound {
 			// SECURITY: Sanitize nut value to prevent log injection
-			SafeLogInfo("Nut %s not found", sanitizeForLog(string(nut)))
+			api.log().Info("Nut not found", "nut", string(nut))
+			req.IPAddress = api.RemoteIP(r)
+			api.validationFailed(ctx, req, nil, ReasonUnknownNut)
 			response.WithClientFailure().WithCommandFailed()
 			return
 		}
-		SafeLogError("nut_lookup", err)
+		api.log().Error("nut_lookup", err)
 		response.WithTransientError().WithCommandFailed()
 		return
 	}
 	response.HoardCache = hoardCache
 
 	// validation checks
+	_, step = api.startStep(ctx, SpanRequestValidations, req)
 	err = api.requestValidations(hoardCache, req, r, response)
+	endStep(step, response, err)
 	if err != nil {
+		api.validationFailed(ctx, req, hoardCache, validationReason(err))
 		return
 	}
 
 	if req.Client.Cmd == "query" {
+		api.publish(ctx, identityEvent(EventQueryReceived, req, nil))
 		tmpIdent := req.Identity()
 		tmpIdent.Btn = -1
-		response.Ask = api.Authenticator.AskResponse(tmpIdent)
+		response.Ask = api.authenticator().AskResponse(ctx, tmpIdent)
 	}
 
 	// generate new nut
+	_, step = api.startStep(ctx, SpanTreeNut, req)
 	nut, err = api.tree.Nut()
+	endStep(step, response, err)
 	if err != nil {
-		SafeLogError("nut_generation", err)
+		api.log().Error("nut_generation", err)
 		response.WithCommandFailed()
 		return
 	}
@@ -84,83 +125,221 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 	response.Nut = nut
 	response.Qry = api.qry(nut)
 
+	// all identity and pag changes from here on are applied together
+	uow, err := api.beginUnitOfWork(ctx)
+	if err != nil {
+		api.log().Error("begin_unit_of_work", err)
+		response.WithTransientError().WithCommandFailed()
+		return
+	}
+	defer api.finishUnitOfWork(ctx, uow, response)
+
 	// check if the same user has already been authenticated previously
 
-	identity, err := api.authStore.FindIdentity(req.Client.Idk)
+	stepCtx, step = api.startStep(ctx, SpanFindIdentity, req)
+	identity, err := uow.FindIdentity(stepCtx, req.Client.Idk)
+	endStep(step, response, ignoreNotFound(err))
 	if err != nil && err != ErrNotFound {
-		SafeLogError("identity_lookup", err)
-		response.WithCommandFailed()
+		api.log().Error("identity_lookup", err)
+		response.WithTransientError().WithCommandFailed()
 		return
 	}
 
 	// Check is we know about a previous identity
-	previousIdentity, err := api.checkPreviousIdentity(req, response)
+	stepCtx, step = api.startStep(ctx, SpanCheckPreviousIdentity, req)
+	previousIdentity, err := api.checkPreviousIdentity(stepCtx, uow, req, response)
+	endStep(step, response, err)
 	if err != nil {
+		if reason := validationReason(err); reason != "" {
+			api.validationFailed(ctx, req, hoardCache, reason)
+		}
 		return
 	}
 
+	// issue or verify a secret index challenge
+	if req.Client.Cmd == "query" {
+		api.setSin(req, response, identity)
+	} else {
+		err = api.verifySecretIndex(hoardCache, req, response, identity, previousIdentity)
+		if err != nil {
+			api.validationFailed(ctx, req, hoardCache, ReasonSecretIndex)
+			return
+		}
+	}
+
 	if identity != nil {
-		err := api.knownIdentity(req, response, identity)
+		stepCtx, step := api.startStep(ctx, SpanKnownIdentity, req)
+		err := api.knownIdentity(stepCtx, uow, req, response, identity)
+		endStep(step, response, err)
 		if err != nil {
+			if reason := validationReason(err); reason != "" {
+				api.validationFailed(ctx, req, hoardCache, reason)
+			}
 			return
 		}
 	} else if req.Client.Cmd == "ident" {
 		// create new identity from the request
 		identity = req.Identity()
+		api.applyPolicy(ctx, uow, req, identity, true, previousIdentity)
 		// handle previous identity swap if the current identity is new
-		err := api.checkPreviousSwap(previousIdentity, identity, response)
+		err := api.checkPreviousSwap(ctx, uow, req, previousIdentity, identity, response)
 		if err != nil {
 			return
 		}
+		if previousIdentity != nil {
+			event := identityEvent(EventIdentityRekeyed, req, identity)
+			event.PreviousIdk = previousIdentity.Idk
+			uow.publish(event)
+		} else {
+			uow.publish(identityEvent(EventIdentityCreated, req, identity))
+		}
 
 		// Do we id match on first auth? grc says nope; PaulF and I think yes
 		response.WithIDMatch()
 	}
-	api.setSuk(req, response, identity)
+	api.recordSecretIndex(hoardCache, req, identity)
+	api.setSuk(req, response, identity, previousIdentity)
 
 	// Finish authentication and saving
-	api.finishCliResponse(req, response, identity, hoardCache)
+	stepCtx, step = api.startStep(ctx, SpanFinishCliResponse, req)
+	api.finishCliResponse(stepCtx, uow, req, response, identity, hoardCache)
+	endStep(step, response, nil)
 }
 
-func (api *SqrlSspAPI) writeResponse(req *CliRequest, response *CliResponse, w http.ResponseWriter) {
+// finishUnitOfWork commits the request's changes unless the command
+// failed. A failed commit is reported to the client as a transient error.
+func (api *SqrlSspAPI) finishUnitOfWork(ctx context.Context, uow *unitOfWork, response *CliResponse) {
+	if response.TIF&TIFCommandFailed != 0 {
+		uow.Rollback()
+		return
+	}
+	if err := uow.Commit(ctx); err != nil {
+		api.log().Error("commit_unit_of_work", err)
+		response.URL = ""
+		response.WithTransientError().WithCommandFailed()
+		return
+	}
+	for _, event := range uow.events {
+		api.publish(ctx, event)
+	}
+}
+
+func (api *SqrlSspAPI) writeResponse(ctx context.Context, req *CliRequest, response *CliResponse, w http.ResponseWriter) {
+	ctx, span := api.startStep(ctx, SpanWriteResponse, req)
+	defer span.End()
 	respBytes := response.Encode()
 	// SECURITY: Do not log full response content as it may contain sensitive data
-	SafeLogResponse(response)
+	api.log().Response(response)
 
-	// always save back the new nut
+	// always save back the new nut, unless the old one couldn't be used
+	// with /cli.sqrl in the first place
 	if response.HoardCache != nil {
-		err := api.hoard.Save(response.Nut, &HoardCache{
-			State:        "associated",
+		transitions, err := response.HoardCache.transition(NutAssociated)
+		if err != nil {
+			_, _ = w.Write(respBytes)
+			return
+		}
+		next := &HoardCache{
+			State:        NutAssociated,
 			RemoteIP:     response.HoardCache.RemoteIP,
 			OriginalNut:  response.HoardCache.OriginalNut,
 			PagNut:       response.HoardCache.PagNut,
+			Sin:          response.Sin,
 			LastRequest:  req,
 			LastResponse: respBytes,
-		}, api.NutExpiration)
+			Transitions:  transitions,
+		}
+		err = api.nutHoard().Save(ctx, response.Nut, next, api.NutExpiration)
 		if err != nil {
-			SafeLogError("hoard_save", err)
+			api.log().Error("hoard_save", err)
 			response.WithCommandFailed()
 			respBytes = response.Encode()
 		} else {
 			// SECURITY: Sanitize nut before logging
-			SafeLogInfo("Saved nut %s in hoard", sanitizeForLog(string(response.Nut)))
+			api.log().Info("Saved nut in hoard", "nut", string(response.Nut))
+			api.nutTransitioned(response.HoardCache.State, NutAssociated, nil)
+			api.saveStatus(ctx, req, response, respBytes)
 		}
 	}
 	_, _ = w.Write(respBytes)
-	log.Println()
 }
 
-func (api *SqrlSspAPI) setSuk(req *CliRequest, response *CliResponse, identity *SqrlIdentity) {
+// setSuk returns the suk when the client asks for it. For a new identity
+// matching a previous one, that's the previous identity's suk so the
+// client can sign with the rescue code it was created with.
+func (api *SqrlSspAPI) setSuk(req *CliRequest, response *CliResponse, identity, previousIdentity *SqrlIdentity) {
 	if req.Client.Opt["suk"] {
 		if identity != nil {
 			response.Suk = identity.Suk
+		} else if previousIdentity != nil && req.Client.Cmd == "query" {
+			response.Suk = previousIdentity.Suk
 		} else if req.Client.Cmd == "ident" {
 			response.Suk = req.Client.Suk
 		}
 	}
 }
 
-func (api *SqrlSspAPI) finishCliResponse(req *CliRequest, response *CliResponse, identity *SqrlIdentity, hoardCache *HoardCache) {
+func (api *SqrlSspAPI) setSin(req *CliRequest, response *CliResponse, identity *SqrlIdentity) {
+	if api.SecretIndexProvider == nil {
+		return
+	}
+	if identity == nil {
+		identity = req.Identity()
+		identity.Btn = -1
+	}
+	sin := api.SecretIndexProvider.SecretIndex(identity)
+	if !validSin(sin) {
+		api.log().ErrorMsg("secret_index", "ignoring sin with invalid characters")
+		return
+	}
+	response.Sin = sin
+}
+
+// verifySecretIndex checks the ins and pins sent in reply to a sin from the
+// previous response. A known identity that has already answered the same
+// sin must give the same answer.
+func (api *SqrlSspAPI) verifySecretIndex(hoardCache *HoardCache, req *CliRequest, response *CliResponse, identity, previousIdentity *SqrlIdentity) error {
+	if hoardCache.Sin == "" {
+		return nil
+	}
+	if err := validSecretIndex(req.Client.Ins); err != nil {
+		api.log().Error("secret_index_ins", err)
+		response.WithClientFailure().WithCommandFailed()
+		return err
+	}
+	if identity != nil && identity.Sin == hoardCache.Sin && identity.Ins != "" {
+		if !matchSecretIndex(identity.Ins, req.Client.Ins) {
+			api.log().Auth("secret_index_mismatch", identity.Idk, false)
+			response.WithClientFailure().WithCommandFailed()
+			return fmt.Errorf("secret index mismatch")
+		}
+	}
+	if previousIdentity != nil && previousIdentity.Sin == hoardCache.Sin && previousIdentity.Ins != "" {
+		if err := validSecretIndex(req.Client.Pins); err != nil {
+			api.log().Error("secret_index_pins", err)
+			response.WithClientFailure().WithCommandFailed()
+			return err
+		}
+		if !matchSecretIndex(previousIdentity.Ins, req.Client.Pins) {
+			api.log().Auth("previous_secret_index_mismatch", previousIdentity.Idk, false)
+			response.WithClientFailure().WithCommandFailed()
+			return fmt.Errorf("previous secret index mismatch")
+		}
+	}
+	return nil
+}
+
+// recordSecretIndex stores a verified ins on the identity so it's saved
+// when the identity is authenticated
+func (api *SqrlSspAPI) recordSecretIndex(hoardCache *HoardCache, req *CliRequest, identity *SqrlIdentity) {
+	if identity == nil || hoardCache.Sin == "" || !req.IsAuthCommand() {
+		return
+	}
+	identity.Sin = hoardCache.Sin
+	identity.Ins = req.Client.Ins
+}
+
+func (api *SqrlSspAPI) finishCliResponse(ctx context.Context, uow *unitOfWork, req *CliRequest, response *CliResponse, identity *SqrlIdentity, hoardCache *HoardCache) {
 	accountDisabled := false
 	if identity != nil {
 		accountDisabled = identity.Disabled
@@ -171,22 +350,23 @@ func (api *SqrlSspAPI) finishCliResponse(req *CliRequest, response *CliResponse,
 	if req.IsAuthCommand() {
 		if identity == nil {
 			// Cannot authenticate without an identity
-			SafeLogError("auth_nil_identity", fmt.Errorf("auth command with nil identity"))
+			api.log().Error("auth_nil_identity", fmt.Errorf("auth command with nil identity"))
 			response.WithClientFailure().WithCommandFailed()
 			return
 		}
 		if !accountDisabled {
 			// SECURITY: Use safe logging for identity information
-			SafeLogAuth("authenticate", identity.Idk, true)
-			authURL, err := api.authenticateIdentity(identity, req.Client.Btn)
+			api.log().Auth("authenticate", identity.Idk, true)
+			authURL, err := api.authenticateIdentity(ctx, uow, identity, req.Client.Btn)
 			if err != nil {
-				SafeLogError("save_identity", err)
+				api.log().Error("save_identity", err)
 				response.WithCommandFailed()
 				return
 			}
+			uow.publish(identityEvent(EventIdentAuthenticated, req, identity))
 			if req.Client.Opt["cps"] {
 				// SECURITY: Sanitize auth URL before logging to prevent log injection
-				SafeLogAuth("cps_auth_set", sanitizeForLog(authURL), true)
+				api.log().Auth("cps_auth_set", sanitizeForLog(authURL), true)
 				response.URL = authURL
 			}
 		}
@@ -200,105 +380,167 @@ func (api *SqrlSspAPI) finishCliResponse(req *CliRequest, response *CliResponse,
 	if req.IsAuthCommand() && identity != nil && !accountDisabled {
 		// for non-CPS we save the state back to the PagNut for redirect on polling
 		if !req.Client.Opt["cps"] {
-			err := api.hoard.Save(hoardCache.PagNut, &HoardCache{
-				State:       "authenticated",
+			transitions, err := hoardCache.transition(NutAuthenticated)
+			api.nutTransitioned(hoardCache.State, NutAuthenticated, err)
+			if err != nil {
+				api.log().Error("pag_transition", err)
+				response.WithCommandFailed()
+				return
+			}
+			// saved when the unit of work is committed
+			uow.SaveHoard(hoardCache.PagNut, &HoardCache{
+				State:       NutAuthenticated,
 				RemoteIP:    hoardCache.RemoteIP,
 				OriginalNut: hoardCache.OriginalNut,
 				PagNut:      hoardCache.PagNut,
 				LastRequest: req,
 				Identity:    identity,
+				Transitions: transitions,
 			}, api.NutExpiration)
-			if err != nil {
-				SafeLogError("hoard_save_pagnut", err)
-				response.WithCommandFailed()
-			}
 			// SECURITY: Sanitize pagnut before logging
-			SafeLogInfo("Saved pagnut %s in hoard", sanitizeForLog(string(hoardCache.PagNut)))
+			api.log().Info("Saving pagnut in hoard", "nut", string(hoardCache.PagNut))
 		}
 	}
 }
 
-func (api *SqrlSspAPI) checkPreviousSwap(previousIdentity, identity *SqrlIdentity, response *CliResponse) error {
+func (api *SqrlSspAPI) checkPreviousSwap(ctx context.Context, uow *unitOfWork, req *CliRequest, previousIdentity, identity *SqrlIdentity, response *CliResponse) error {
 	if previousIdentity != nil {
-		err := api.swapIdentities(previousIdentity, identity)
+		err := api.swapIdentities(ctx, uow, previousIdentity, identity)
+		if err == nil {
+			err = uow.SaveRekey(ctx, &Rekey{
+				PreviousIdk: previousIdentity.Idk,
+				Idk:         identity.Idk,
+				RemoteIP:    req.IPAddress,
+				Time:        time.Now(),
+			})
+		}
 		if err != nil {
-			SafeLogError("identity_swap", err)
+			api.log().Error("identity_swap", err)
 			response.WithCommandFailed()
 			return fmt.Errorf("identity swap error")
 		}
 		// SECURITY: Use safe logging without exposing full identity details
-		SafeLogAuth("identity_swap", identity.Idk, true)
+		api.log().Auth("identity_swap", identity.Idk, true)
 		// TODO should we clear the PreviousIDMatch here?
 		response.ClearPreviousIDMatch()
 	}
 	return nil
 }
 
-func (api *SqrlSspAPI) checkPreviousIdentity(req *CliRequest, response *CliResponse) (*SqrlIdentity, error) {
-	var previousIdentity *SqrlIdentity
-	var err error
-	if req.Client.Pidk != "" {
-		previousIdentity, err = api.authStore.FindIdentity(req.Client.Pidk)
-		if err != nil && err != ErrNotFound {
-			SafeLogError("lookup_previous_identity", err)
-			response.WithCommandFailed()
-			return nil, err
+// checkPreviousIdentity looks up the pidk of the request. A pidk that has
+// already been rekeyed to a different identity isn't matched: a query is
+// answered without TIFPreviousIDMatch and any other command fails rather
+// than creating an identity unlinked from the account.
+func (api *SqrlSspAPI) checkPreviousIdentity(ctx context.Context, uow *unitOfWork, req *CliRequest, response *CliResponse) (*SqrlIdentity, error) {
+	if req.Client.Pidk == "" {
+		return nil, nil
+	}
+	previousIdentity, err := uow.FindIdentity(ctx, req.Client.Pidk)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err == nil {
+		err = checkRekey(ctx, uow, previousIdentity, req.Client.Idk)
+	}
+	if err == ErrAlreadyRekeyed || err == ErrRekeyCycle {
+		api.log().Auth("superseded_previous_identity", previousIdentity.Idk, false)
+		if req.Client.Cmd == "query" {
+			return nil, nil
 		}
+		response.WithCommandFailed()
+		return nil, newValidationError(ReasonPreviousSuperseded, "previous identity can't be rekeyed: %v", err)
 	}
-	if previousIdentity != nil {
-		response.WithPreviousIDMatch()
-		// as per spec, proactively return the suk on pidk match
-		req.Client.Opt["suk"] = true
+	if err != nil {
+		api.log().Error("lookup_previous_identity", err)
+		response.WithTransientError().WithCommandFailed()
+		return nil, err
 	}
+	response.WithPreviousIDMatch()
+	// as per spec, proactively return the suk on pidk match
+	req.Client.Opt["suk"] = true
 	return previousIdentity, nil
 }
 
 func (api *SqrlSspAPI) requestValidations(hoardCache *HoardCache, req *CliRequest, r *http.Request, response *CliResponse) error {
 	req.IPAddress = api.RemoteIP(r)
+	// a pag nut or anything else not handed to a SQRL client
+	if err := checkCliNut(hoardCache); err != nil {
+		api.nutTransitioned(hoardCache.State, NutAssociated, err)
+		api.log().Info("Rejecting nut", "error", err)
+		response.WithClientFailure().WithCommandFailed()
+		return newValidationError(ReasonNutState, "%v", err)
+	}
 	// validate last response against this request
 	if hoardCache.LastResponse != nil && !req.ValidateLastResponse(hoardCache.LastResponse) {
 		response.WithCommandFailed()
 		// SECURITY: Do not log response content as it contains sensitive data
-		log.Printf("Last response validation failed")
-		return fmt.Errorf("validation error")
+		api.log().Info("Last response validation failed")
+		return newValidationError(ReasonLastResponse, "validation error")
 	}
 
 	// validate the IP if required
 	if hoardCache.RemoteIP != req.IPAddress {
 		if !req.Client.Opt["noiptest"] {
 			// SECURITY: Mask IP addresses to prevent log injection and maintain privacy
-			SafeLogInfo("Rejecting on IP mis-match orig: %s current: %s", maskIP(hoardCache.RemoteIP), maskIP(api.RemoteIP(r)))
+			api.log().Info("Rejecting on IP mis-match", "orig", MaskedIP(hoardCache.RemoteIP), "current", MaskedIP(api.RemoteIP(r)))
 			response.WithCommandFailed()
-			return fmt.Errorf("validation error")
+			return newValidationError(ReasonIPMismatch, "validation error")
 		}
 	} else {
-		log.Print("Matched IP addresses")
+		api.log().Info("Matched IP addresses")
 		response = response.WithIPMatch()
 	}
 
 	// validating the current request and associated Idk's match
 	if hoardCache.LastRequest != nil && hoardCache.LastRequest.Client.Idk != req.Client.Idk {
 		// SECURITY: Truncate identity keys to prevent log injection
-		SafeLogInfo("Identity mismatch orig: %s... current: %s...", truncateKey(hoardCache.LastRequest.Client.Idk, 8), truncateKey(req.Client.Idk, 8))
+		api.log().Info("Identity mismatch", "orig", RedactedKey(hoardCache.LastRequest.Client.Idk), "current", RedactedKey(req.Client.Idk))
 		response.WithCommandFailed().WithClientFailure().WithBadIDAssociation()
-		return fmt.Errorf("validation error")
+		return newValidationError(ReasonIdentityMismatch, "validation error")
 	}
 
+	version, ok := SupportedVersions.Negotiate(req.Client.Version)
+	if !ok {
+		api.log().Info("No common version with client", "versions", req.Client.Version.String())
+		response.WithFunctionNotSupported().WithCommandFailed()
+		return newValidationError(ReasonUnsupported, "unsupported versions: %v", req.Client.Version)
+	}
+	req.Version = version
+
 	if !supportedCommands[req.Client.Cmd] {
-		response.WithFunctionNotSupported()
-		return fmt.Errorf("Uknown command: %v", req.Client.Cmd)
+		response.WithFunctionNotSupported().WithCommandFailed()
+		return newValidationError(ReasonUnsupported, "Uknown command: %v", req.Client.Cmd)
 	}
 
 	return nil
 }
 
-func (api *SqrlSspAPI) knownIdentity(req *CliRequest, response *CliResponse, identity *SqrlIdentity) error {
+func (api *SqrlSspAPI) knownIdentity(ctx context.Context, uow *unitOfWork, req *CliRequest, response *CliResponse, identity *SqrlIdentity) error {
 	if identity.Rekeyed != "" {
 		response.WithIdentitySuperseded()
 		// SECURITY: Use truncated key for logging
-		SafeLogAuth("rekeyed_attempt", identity.Idk, false)
+		api.log().Auth("rekeyed_attempt", identity.Idk, false)
+		current, err := ResolveCurrentIdentity(ctx, uow, identity.Idk)
+		switch {
+		case err == nil:
+			api.log().Info("Identity was replaced", "idk", RedactedKey(identity.Idk), "current", RedactedKey(current.Idk))
+			// the account now belongs to the current identity so report
+			// its state rather than that of the superseded one
+			if current.Disabled {
+				response.WithSQRLDisabled()
+			}
+		case err == ErrNotFound || err == ErrRekeyCycle:
+			// the chain doesn't end in a usable identity so there's
+			// nothing the client can move to
+			api.log().Error("resolve_current_identity", err)
+			response.WithCommandFailed()
+		default:
+			api.log().Error("resolve_current_identity", err)
+			response.WithTransientError().WithCommandFailed()
+		}
 		if req.Client.Cmd != "query" {
 			response.WithCommandFailed()
+			return newValidationError(ReasonIdentitySuperseded, "attempted use of rekeyed identity")
 		}
 		return fmt.Errorf("attempted use of rekeyed identity")
 	} else {
@@ -308,37 +550,40 @@ func (api *SqrlSspAPI) knownIdentity(req *CliRequest, response *CliResponse, ide
 	identity.Btn = req.Client.Btn
 	changed := false
 	if req.IsAuthCommand() {
-		changed = req.UpdateIdentity(identity)
+		changed = api.applyPolicy(ctx, uow, req, identity, false, nil)
 	}
 	if req.Client.Cmd == "enable" || req.Client.Cmd == "remove" {
 		err := req.VerifyUrs(identity.Vuk)
 		if err != nil {
-			SafeLogError("urs_validation", err)
+			api.log().Error("urs_validation", err)
 			// TODO: remove since sig check failed here?
 			if identity.Disabled {
 				response.WithSQRLDisabled()
 			}
 			response.WithClientFailure().WithCommandFailed()
-			return fmt.Errorf("identity error")
+			return newValidationError(ReasonInvalidUnlock, "identity error")
 		}
 		if req.Client.Cmd == "enable" {
-			SafeLogAuth("enable_account", identity.Idk, true)
+			api.log().Auth("enable_account", identity.Idk, true)
 			identity.Disabled = false
 			changed = true
+			uow.publish(identityEvent(EventIdentityEnabled, req, identity))
 		} else if req.Client.Cmd == "remove" {
-			err := api.removeIdentity(identity)
+			err := api.removeIdentity(ctx, uow, identity)
 			if err != nil {
-				SafeLogError("remove_identity", err)
+				api.log().Error("remove_identity", err)
 				response.WithClientFailure().WithCommandFailed()
 				return fmt.Errorf("identity error")
 			}
 			response.ClearIDMatch()
-			SafeLogAuth("remove_identity", identity.Idk, true)
+			api.log().Auth("remove_identity", identity.Idk, true)
+			uow.publish(identityEvent(EventIdentityRemoved, req, identity))
 		}
 	}
 	if req.Client.Cmd == "disable" {
 		identity.Disabled = true
 		changed = true
+		uow.publish(identityEvent(EventIdentityDisabled, req, identity))
 	}
 
 	if identity.Disabled {
@@ -346,10 +591,10 @@ func (api *SqrlSspAPI) knownIdentity(req *CliRequest, response *CliResponse, ide
 		response.WithSQRLDisabled()
 	}
 	if changed {
-		err := api.authStore.SaveIdentity(identity)
+		err := uow.SaveIdentity(ctx, identity)
 		if err != nil {
-			SafeLogError("save_identity", err)
-			response.WithClientFailure().WithCommandFailed()
+			api.log().Error("save_identity", err)
+			response.WithTransientError().WithCommandFailed()
 			return fmt.Errorf("identity error")
 		}
 	}
@@ -0,0 +1,210 @@
+package ssp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSqrlClient drives the /cli.sqrl endpoint with properly signed
+// requests so handler behaviour can be checked end to end
+type testSqrlClient struct {
+	t        *testing.T
+	ctx      context.Context
+	api      *SqrlSspAPI
+	key      ed25519.PrivateKey
+	previous ed25519.PrivateKey
+	nut      Nut
+	pag      Nut
+	server   string
+	// overrides the httptest default RemoteAddr when set
+	remoteAddr string
+}
+
+func newTestAPI(t *testing.T) *SqrlSspAPI {
+	tree, err := NewRandomTree(8)
+	if err != nil {
+		t.Fatalf("Failed to create RandomTree: %v", err)
+	}
+	return NewSqrlSspAPI(tree, NewMapHoard(), &MockAuthenticator{}, NewMapAuthStore())
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed generating key: %v", err)
+	}
+	return key
+}
+
+func newTestSqrlClient(t *testing.T, api *SqrlSspAPI) *testSqrlClient {
+	c := &testSqrlClient{t: t, ctx: context.Background(), api: api, key: newTestKey(t)}
+	c.newNut()
+	return c
+}
+
+// newNut starts a new login from the same client
+func (c *testSqrlClient) newNut() {
+	r := httptest.NewRequest("GET", "/nut.sqrl", nil)
+	if c.remoteAddr != "" {
+		r.RemoteAddr = c.remoteAddr
+	}
+	hoardCache, err := c.api.createAndSaveNut(r)
+	if err != nil {
+		c.t.Fatalf("Failed creating nut: %v", err)
+	}
+	c.nut = hoardCache.OriginalNut
+	c.pag = hoardCache.PagNut
+	c.server = Sqrl64.EncodeToString([]byte(fmt.Sprintf("sqrl://example.com/cli.sqrl?nut=%v", c.nut)))
+}
+
+func (c *testSqrlClient) idk() string {
+	return Sqrl64.EncodeToString(c.key.Public().(ed25519.PublicKey))
+}
+
+// send posts a signed command; opts can modify the client body before signing
+func (c *testSqrlClient) send(cmd string, opts ...func(*ClientBody)) *CliResponse {
+	client := &ClientBody{
+		Version: []int{1},
+		Cmd:     cmd,
+		Opt:     map[string]bool{},
+		Idk:     c.idk(),
+		Btn:     -1,
+	}
+	if c.previous != nil {
+		client.Pidk = Sqrl64.EncodeToString(c.previous.Public().(ed25519.PublicKey))
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	req := &CliRequest{
+		Client:        client,
+		ClientEncoded: string(client.Encode()),
+		Server:        c.server,
+	}
+	req.Ids = Sqrl64.EncodeToString(ed25519.Sign(c.key, req.SigningString()))
+	if c.previous != nil {
+		req.Pids = Sqrl64.EncodeToString(ed25519.Sign(c.previous, req.SigningString()))
+	}
+
+	r := httptest.NewRequestWithContext(c.ctx, "POST", "/cli.sqrl?nut="+string(c.nut), strings.NewReader(req.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.remoteAddr != "" {
+		r.RemoteAddr = c.remoteAddr
+	}
+	w := httptest.NewRecorder()
+	c.api.Cli(w, r)
+
+	body, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		c.t.Fatalf("Failed reading response: %v", err)
+	}
+	resp, err := ParseCliResponse(body)
+	if err != nil {
+		c.t.Fatalf("Failed parsing response: %v", err)
+	}
+	c.nut = resp.Nut
+	c.server = string(body)
+	return resp
+}
+
+func withOpt(opts ...string) func(*ClientBody) {
+	return func(cb *ClientBody) {
+		for _, opt := range opts {
+			cb.Opt[opt] = true
+		}
+	}
+}
+
+func TestCliQueryThenIdentNewIdentity(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+
+	resp := client.send("query")
+	if resp.TIF != TIFIPMatched {
+		t.Fatalf("Expected only IP match on query, got 0x%x", resp.TIF)
+	}
+
+	resp = client.send("ident", func(cb *ClientBody) {
+		cb.Suk = "suk"
+		cb.Vuk = "vuk"
+	})
+	if resp.TIF != TIFIPMatched|TIFIDMatch {
+		t.Fatalf("Expected IP and ID match on ident, got 0x%x", resp.TIF)
+	}
+
+	identity, err := api.authStore.FindIdentity(context.Background(), client.idk())
+	if err != nil {
+		t.Fatalf("Identity not saved: %v", err)
+	}
+	if identity.Suk != "suk" || identity.Vuk != "vuk" {
+		t.Errorf("Wrong identity saved: %+v", identity)
+	}
+
+	pag, err := api.hoard.Get(context.Background(), client.pag)
+	if err != nil {
+		t.Fatalf("Pag nut not saved: %v", err)
+	}
+	if pag.State != "authenticated" {
+		t.Errorf("Expected authenticated pag state, got %v", pag.State)
+	}
+}
+
+func TestCliReplayedNut(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	original := client.nut
+
+	client.send("query")
+	client.nut = original
+	resp := client.send("query")
+	if resp.TIF&(TIFClientFailure|TIFCommandFailed) != TIFClientFailure|TIFCommandFailed {
+		t.Errorf("Expected replayed nut to fail, got 0x%x", resp.TIF)
+	}
+}
+
+func TestCliUnknownCommand(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+
+	resp := client.send("frobnicate")
+	if resp.TIF != TIFIPMatched|TIFFunctionNotSupported|TIFCommandFailed {
+		t.Errorf("Expected function not supported and command failed, got 0x%x", resp.TIF)
+	}
+}
+
+func TestCliPreviousIdentitySuk(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident", func(cb *ClientBody) {
+		cb.Suk = "previoussuk"
+		cb.Vuk = "previousvuk"
+	})
+
+	client.previous = client.key
+	client.key = newTestKey(t)
+	client.newNut()
+	resp := client.send("query")
+	if resp.TIF != TIFIPMatched|TIFPreviousIDMatch || resp.Suk != "previoussuk" {
+		t.Errorf("Expected the previous identity's suk, got 0x%x %q", resp.TIF, resp.Suk)
+	}
+}
+
+func TestCliExpiredNut(t *testing.T) {
+	api := newTestAPI(t)
+	api.NutExpiration = time.Millisecond
+	client := newTestSqrlClient(t, api)
+	time.Sleep(5 * time.Millisecond)
+
+	resp := client.send("query")
+	if resp.TIF&TIFCommandFailed == 0 {
+		t.Errorf("Expected expired nut to fail, got 0x%x", resp.TIF)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -15,10 +14,27 @@ import (
 	"crypto/ed25519"
 )
 
-// ParseSqrlQuery copied from go's url.ParseQuery with some modifications.
-// The format is CRLF separated "key=value" pairs
-func ParseSqrlQuery(query string) (params map[string]string, err error) {
-	params = make(map[string]string, 0)
+// ParseError is returned by the wire-format parsers for malformed input.
+// Field is the parameter that's invalid, such as "ver" or "client".
+type ParseError struct {
+	Field string
+	Err   error
+}
+
+func (pe *ParseError) Error() string {
+	return fmt.Sprintf("invalid %v: %v", pe.Field, pe.Err)
+}
+
+func (pe *ParseError) Unwrap() error {
+	return pe.Err
+}
+
+// ParseSqrlQuery parses the CRLF separated "key=value" pairs of a client
+// or server body. Values aren't URL encoded on the wire so they're returned
+// as they are, which earlier versions didn't do; empty and repeated keys
+// are refused.
+func ParseSqrlQuery(query string) (map[string]string, error) {
+	params := make(map[string]string, 0)
 	for query != "" {
 		key := query
 		// windoze :(
@@ -34,36 +50,42 @@ func ParseSqrlQuery(query string) (params map[string]string, err error) {
 		if i := strings.Index(key, "="); i >= 0 {
 			key, value = key[:i], key[i+1:]
 		}
-		key, err1 := url.QueryUnescape(key)
-		if err1 != nil {
-			if err == nil {
-				err = err1
-			}
-			continue
+		if key == "" {
+			return nil, &ParseError{Field: "query", Err: fmt.Errorf("empty key")}
 		}
-		value, err1 = url.QueryUnescape(value)
-		if err1 != nil {
-			if err == nil {
-				err = err1
-			}
-			continue
+		if _, ok := params[key]; ok {
+			return nil, &ParseError{Field: key, Err: fmt.Errorf("repeated")}
 		}
 		params[key] = value
 	}
-	return params, err
+	return params, nil
+}
+
+// isSqrl64 checks s only has characters of the Sqrl64 alphabet, which is
+// also enough for commands and options
+func isSqrl64(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
 }
 
 // ClientBody holds the internal structure of the request "client" parameter;
 // see https://www.grc.com/sqrl/protocol.htm in the section "The content of the “client” parameter."
 // This is owned by a ClientRequest and probably shouldn't be used on it's own.
 type ClientBody struct {
-	Version []int           `json:"version"`
+	Version Versions        `json:"version"`
 	Cmd     string          `json:"cmd"`
 	Opt     map[string]bool `json:"opt"`
 	Suk     string          `json:"suk"`  // Sqrl64.Encoded
 	Vuk     string          `json:"vuk"`  // Sqrl64.Encoded
 	Pidk    string          `json:"pidk"` // Sqrl64.Encoded
 	Idk     string          `json:"idk"`  // Sqrl64.Encoded
+	Ins     string          `json:"ins"`  // Sqrl64.Encoded
+	Pins    string          `json:"pins"` // Sqrl64.Encoded
 	// valid values are 0,1,2; -1 means no value
 	Btn int `json:"btn"`
 }
@@ -75,15 +97,7 @@ func (cb *ClientBody) Encode() []byte {
 	}
 	var b bytes.Buffer
 
-	// TODO be less lazy and support ranges
-	b.WriteString("ver=")
-	for i, v := range cb.Version {
-		if i > 0 {
-			b.WriteString(",")
-		}
-		b.WriteString(strconv.Itoa(v))
-	}
-	b.WriteString("\r\n")
+	b.WriteString(fmt.Sprintf("ver=%v\r\n", cb.Version))
 
 	b.WriteString(fmt.Sprintf("cmd=%v\r\n", cb.Cmd))
 
@@ -109,6 +123,18 @@ func (cb *ClientBody) Encode() []byte {
 		b.WriteString(fmt.Sprintf("pidk=%v\r\n", cb.Pidk))
 	}
 
+	if cb.Ins != "" {
+		b.WriteString(fmt.Sprintf("ins=%v\r\n", cb.Ins))
+	}
+
+	if cb.Pins != "" {
+		b.WriteString(fmt.Sprintf("pins=%v\r\n", cb.Pins))
+	}
+
+	if cb.Btn >= 0 {
+		b.WriteString(fmt.Sprintf("btn=%d\r\n", cb.Btn))
+	}
+
 	encoded := Sqrl64.EncodeToString(b.Bytes())
 	// SECURITY: Do not log encoded payload as it contains sensitive identity material (idk, suk, vuk, pidk)
 	return []byte(encoded)
@@ -142,29 +168,42 @@ func (cb *ClientBody) PidkPublicKey() (ed25519.PublicKey, error) {
 // ClientBodyFromParams creates ClientBody from the output of ParseSqrlQuery
 func ClientBodyFromParams(params map[string]string) (*ClientBody, error) {
 	cb := &ClientBody{}
-	// TODO handle multiple versions and ranges
-	version, err := strconv.Atoi(params["ver"])
+	version, err := ParseVersions(params["ver"])
 	if err != nil {
-		return nil, fmt.Errorf("failed parsing version \"%s\": %v", params["ver"], err)
+		return nil, &ParseError{Field: "ver", Err: err}
 	}
-	cb.Version = []int{version}
+	cb.Version = version
 
 	cb.Cmd = params["cmd"]
 
-	opts := strings.Split(params["opt"], "~")
-	cb.Opt = make(map[string]bool, len(opts))
-	for _, opt := range opts {
-		cb.Opt[opt] = true
+	cb.Opt = make(map[string]bool)
+	if params["opt"] != "" {
+		for _, opt := range strings.Split(params["opt"], "~") {
+			if opt == "" || !isSqrl64(opt) {
+				return nil, &ParseError{Field: "opt", Err: fmt.Errorf("bad option %q", opt)}
+			}
+			cb.Opt[opt] = true
+		}
 	}
 
+	for _, field := range []string{"cmd", "suk", "vuk", "pidk", "idk", "ins", "pins"} {
+		if !isSqrl64(params[field]) {
+			return nil, &ParseError{Field: field, Err: fmt.Errorf("unexpected characters")}
+		}
+	}
 	cb.Suk = params["suk"]
 	cb.Vuk = params["vuk"]
 	cb.Pidk = params["pidk"]
 	cb.Idk = params["idk"]
-
-	cb.Btn, err = strconv.Atoi(params["btn"])
-	if err != nil {
-		cb.Btn = -1
+	cb.Ins = params["ins"]
+	cb.Pins = params["pins"]
+
+	cb.Btn = -1
+	if btn, ok := params["btn"]; ok {
+		cb.Btn, err = strconv.Atoi(btn)
+		if err != nil || cb.Btn < 0 || cb.Btn > 2 {
+			return nil, &ParseError{Field: "btn", Err: fmt.Errorf("%q isn't 0, 1 or 2", btn)}
+		}
 	}
 
 	return cb, nil
@@ -179,6 +218,10 @@ type CliRequest struct {
 	Pids          string      `json:"pids"`
 	Urs           string      `json:"urs"`
 
+	// Version is the highest protocol version supported by both the
+	// client and this server; it's set once the request is validated
+	Version int `json:"negotiatedVersion"`
+
 	IPAddress string // saved here for reference
 }
 
@@ -312,8 +355,11 @@ func (cr *CliRequest) ValidateLastResponse(lastRepsonse []byte) bool {
 //
 // Errors are returned for failures reading the request body, parsing the form, decoding or
 // parsing the client payload, constructing the ClientBody, or for signature verification
-// failures. Sensitive intermediate buffers (request body, decoded client data, and other
-// decoded cryptographic material) are securely cleared from memory before the function returns.
+// failures. Malformed input gives a *ParseError and a nil CliRequest; a failed signature
+// check returns the parsed CliRequest along with the error.
+//
+// Sensitive intermediate buffers (request body, decoded client data, and other decoded
+// cryptographic material) are securely cleared from memory before the function returns.
 //
 // NOTE: While byte buffers are cleared, Go string copies created during parsing (e.g., via
 // string(body) or url.ParseQuery) cannot be cleared as strings are immutable. These copies
@@ -329,13 +375,10 @@ func ParseCliRequest(r *http.Request) (*CliRequest, error) {
 	}
 	defer ClearBytes(body) // Securely clear request body after parsing
 
-	// SECURITY: Do not log raw request body as it contains sensitive cryptographic data
-	log.Printf("Received CLI request (body size: %d bytes)", len(body))
-
 	// NOTE: string(body) creates a copy that cannot be cleared
 	params, err := url.ParseQuery(string(body))
 	if err != nil {
-		return nil, fmt.Errorf("invalid cli.sqrl request: %v", err)
+		return nil, &ParseError{Field: "body", Err: err}
 	}
 
 	cli := &CliRequest{
@@ -348,18 +391,18 @@ func ParseCliRequest(r *http.Request) (*CliRequest, error) {
 
 	decodedClient, err := Sqrl64.DecodeString(cli.ClientEncoded)
 	if err != nil {
-		return nil, fmt.Errorf("invalid client parameter: %v", err)
+		return nil, &ParseError{Field: "client", Err: err}
 	}
 	defer ClearBytes(decodedClient) // Securely clear decoded client data
 
 	clientParams, err := ParseSqrlQuery(string(decodedClient))
 	if err != nil {
-		return nil, fmt.Errorf("invalid cli.sqrl client body: %v", err)
+		return nil, &ParseError{Field: "client", Err: err}
 	}
 
 	cli.Client, err = ClientBodyFromParams(clientParams)
 	if err != nil {
-		return nil, fmt.Errorf("invalid client param: %v", err)
+		return nil, &ParseError{Field: "client", Err: err}
 	}
 
 	// If we get here, we can return the cli along with the error
@@ -1,6 +1,13 @@
 package ssp
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -149,6 +156,27 @@ func TestClientBody_Encode(t *testing.T) {
 	}
 }
 
+func TestClientBody_EncodeBtn(t *testing.T) {
+	for _, btn := range []int{-1, 1, 2} {
+		cb := &ClientBody{Version: []int{1}, Cmd: "ident", Idk: "testidk", Btn: btn}
+		decoded, err := Sqrl64.DecodeString(string(cb.Encode()))
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		params, err := ParseSqrlQuery(string(decoded))
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		reparsed, err := ClientBodyFromParams(params)
+		if err != nil {
+			t.Fatalf("ClientBodyFromParams failed: %v", err)
+		}
+		if reparsed.Btn != btn {
+			t.Errorf("Expected btn %d, got %d", btn, reparsed.Btn)
+		}
+	}
+}
+
 func TestClientBody_EncodeNil(t *testing.T) {
 	var cb *ClientBody
 	encoded := cb.Encode()
@@ -397,3 +425,215 @@ func BenchmarkClientBodyEncode(b *testing.B) {
 		cb.Encode()
 	}
 }
+
+func TestClientBodyFromParams_SecretIndex(t *testing.T) {
+	params := map[string]string{
+		"ver":  "1",
+		"cmd":  "ident",
+		"ins":  "testins",
+		"pins": "testpins",
+	}
+
+	cb, err := ClientBodyFromParams(params)
+	if err != nil {
+		t.Fatalf("ClientBodyFromParams failed: %v", err)
+	}
+	if cb.Ins != "testins" {
+		t.Errorf("Expected ins testins, got %s", cb.Ins)
+	}
+	if cb.Pins != "testpins" {
+		t.Errorf("Expected pins testpins, got %s", cb.Pins)
+	}
+
+	decoded, err := Sqrl64.DecodeString(string(cb.Encode()))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	reparsed, err := ParseSqrlQuery(string(decoded))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if reparsed["ins"] != "testins" || reparsed["pins"] != "testpins" {
+		t.Errorf("ins/pins not encoded: %v", reparsed)
+	}
+}
+
+func TestClientBodyFromParams_VersionRange(t *testing.T) {
+	params := map[string]string{
+		"ver": "1-2,4",
+		"cmd": "query",
+	}
+
+	cb, err := ClientBodyFromParams(params)
+	if err != nil {
+		t.Fatalf("ClientBodyFromParams failed: %v", err)
+	}
+	if cb.Version.String() != "1-2,4" {
+		t.Errorf("Expected versions 1-2,4, got %v", cb.Version)
+	}
+}
+
+func TestParseSqrlQuery_Refused(t *testing.T) {
+	for _, query := range []string{"=value\r\n", "idk=a\r\nidk=b\r\n"} {
+		var parseErr *ParseError
+		if _, err := ParseSqrlQuery(query); !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError for %q, got %v", query, err)
+		}
+	}
+	// values aren't URL encoded on the wire
+	params, err := ParseSqrlQuery("url=https://example.com/?q=a+b%20c\r\n")
+	if err != nil || params["url"] != "https://example.com/?q=a+b%20c" {
+		t.Errorf("Expected the url as sent, got %q %v", params["url"], err)
+	}
+}
+
+func TestClientBodyFromParams_Refused(t *testing.T) {
+	for _, params := range []map[string]string{
+		{"ver": "1", "cmd": "query", "btn": "abc"},
+		{"ver": "1", "cmd": "query", "btn": "3"},
+		{"ver": "1", "cmd": "query", "opt": "cps~~suk"},
+		{"ver": "1", "cmd": "query", "opt": "c s"},
+		{"ver": "1", "cmd": "query", "idk": "abc%3D"},
+		{"ver": "1", "cmd": "que\nry"},
+	} {
+		var parseErr *ParseError
+		if _, err := ClientBodyFromParams(params); !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError for %v, got %v", params, err)
+		}
+	}
+}
+
+func TestClientBodyFromParams_NoOpt(t *testing.T) {
+	cb, err := ClientBodyFromParams(map[string]string{"ver": "1", "cmd": "query", "opt": ""})
+	if err != nil {
+		t.Fatalf("ClientBodyFromParams failed: %v", err)
+	}
+	if len(cb.Opt) != 0 {
+		t.Errorf("Expected no options, got %v", cb.Opt)
+	}
+}
+
+// parseClientBody reverses ClientBody.Encode
+func parseClientBody(encoded []byte) (*ClientBody, error) {
+	decoded, err := Sqrl64.DecodeString(string(encoded))
+	if err != nil {
+		return nil, err
+	}
+	params, err := ParseSqrlQuery(string(decoded))
+	if err != nil {
+		return nil, err
+	}
+	return ClientBodyFromParams(params)
+}
+
+// encodeSqrlQuery reverses ParseSqrlQuery
+func encodeSqrlQuery(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key + "=" + params[key] + "\r\n")
+	}
+	return b.String()
+}
+
+func FuzzParseSqrlQuery(f *testing.F) {
+	f.Add("ver=1\r\ncmd=query\r\nopt=sqrlonly~hardlock\r\nidk=testkey123\r\n")
+	f.Add("key\r\n\r\n=x")
+	f.Add("a=b\r\na=c")
+	f.Add("url=https://example.com/?q=%zz\r")
+	f.Fuzz(func(t *testing.T, query string) {
+		params, err := ParseSqrlQuery(query)
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a ParseError, got %v", err)
+			}
+			return
+		}
+		reparsed, err := ParseSqrlQuery(encodeSqrlQuery(params))
+		if err != nil {
+			t.Fatalf("Failed to parse %q again: %v", encodeSqrlQuery(params), err)
+		}
+		if !reflect.DeepEqual(params, reparsed) {
+			t.Errorf("Expected %q, got %q", params, reparsed)
+		}
+	})
+}
+
+func FuzzClientBodyFromParams(f *testing.F) {
+	f.Add("1", "ident", "sqrlonly~hardlock", "testidk", "testsuk", "testvuk", "testpidk", "testins", "testpins", "2")
+	f.Add("1-2,4", "query", "", "testidk", "", "", "", "", "", "")
+	f.Add("1", "query", "~", "", "", "", "", "", "", "-1")
+	f.Add("0", "", "a b", "%41", "+", "", "", "", "", "x")
+	f.Fuzz(func(t *testing.T, ver, cmd, opt, idk, suk, vuk, pidk, ins, pins, btn string) {
+		params := map[string]string{
+			"ver": ver, "cmd": cmd, "opt": opt, "idk": idk, "suk": suk,
+			"vuk": vuk, "pidk": pidk, "ins": ins, "pins": pins,
+		}
+		if btn != "" {
+			params["btn"] = btn
+		}
+		cb, err := ClientBodyFromParams(params)
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a ParseError, got %v", err)
+			}
+			return
+		}
+		reparsed, err := parseClientBody(cb.Encode())
+		if err != nil {
+			t.Fatalf("Failed to parse the encoded body: %v", err)
+		}
+		if !reflect.DeepEqual(cb, reparsed) {
+			t.Errorf("Expected %+v, got %+v", cb, reparsed)
+		}
+	})
+}
+
+func FuzzParseCliRequest(f *testing.F) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	req := &CliRequest{
+		Client: &ClientBody{
+			Version: Versions{1},
+			Cmd:     "query",
+			Opt:     map[string]bool{"cps": true},
+			Idk:     Sqrl64.EncodeToString(key.Public().(ed25519.PublicKey)),
+			Btn:     -1,
+		},
+		Server: Sqrl64.EncodeToString([]byte("sqrl://example.com/cli.sqrl?nut=abc")),
+	}
+	req.Ids = Sqrl64.EncodeToString(ed25519.Sign(key, req.SigningString()))
+	f.Add(req.Encode())
+	f.Add("client=&server=&ids=")
+	f.Add("client=dmVyPTENCmNtZD1xdWVyeQ0K&ids=x;y")
+	f.Add("client=%zz")
+	f.Fuzz(func(t *testing.T, body string) {
+		r := httptest.NewRequest("POST", "/cli.sqrl", strings.NewReader(body))
+		cli, err := ParseCliRequest(r)
+		if cli == nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a ParseError, got %v", err)
+			}
+			return
+		}
+		// the signature doesn't survive re-encoding the client body but
+		// the parsed request does
+		cli.ClientEncoded = ""
+		again, _ := ParseCliRequest(httptest.NewRequest("POST", "/cli.sqrl", strings.NewReader(cli.Encode())))
+		if again == nil {
+			t.Fatalf("Failed to parse %q again", cli.Encode())
+		}
+		if !reflect.DeepEqual(cli.Client, again.Client) {
+			t.Errorf("Expected client %+v, got %+v", cli.Client, again.Client)
+		}
+		if cli.Server != again.Server || cli.Ids != again.Ids || cli.Pids != again.Pids || cli.Urs != again.Urs {
+			t.Errorf("Expected %+v, got %+v", cli, again)
+		}
+	})
+}
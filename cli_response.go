@@ -3,14 +3,10 @@ package ssp
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 )
 
-// Ensure log is used (for future debugging if needed)
-var _ = log.Printf
-
 //
 
 // TIF bitflags
@@ -54,7 +50,7 @@ var TIFDesc = map[uint32]string{
 // CliResponse encodes a response to the SQRL client
 // As specified https://www.grc.com/sqrl/semantics.htm
 type CliResponse struct {
-	Version []int
+	Version Versions
 	Nut     Nut
 	TIF     uint32
 	Qry     string
@@ -79,24 +75,29 @@ type Ask struct {
 	URL2    string `json:"url2,omitempty"`
 }
 
-// ParseAsk parses the special Ask format
-func ParseAsk(askString string) *Ask {
+// ParseAsk parses the special Ask format: up to three Sqrl64 encoded
+// parts separated by "~", a message and two buttons, each button text
+// optionally followed by ";" and a URL
+func ParseAsk(askString string) (*Ask, error) {
 	encparts := strings.Split(askString, "~")
-	parts := make([]string, len(encparts))
+	if len(encparts) > 3 {
+		return nil, &ParseError{Field: "ask", Err: fmt.Errorf("%d parts", len(encparts))}
+	}
+	parts := make([]string, 3)
 	for i, e := range encparts {
-		b, _ := Sqrl64.DecodeString(e)
+		b, err := Sqrl64.DecodeString(e)
+		if err != nil {
+			return nil, &ParseError{Field: "ask", Err: err}
+		}
 		parts[i] = string(b)
 	}
-	ask := &Ask{
-		Message: parts[0],
-	}
-	if len(parts) > 1 {
-		ask.Button1, ask.URL1 = splitButton(parts[1])
-	}
-	if len(parts) > 2 {
-		ask.Button2, ask.URL2 = splitButton(parts[2])
+	ask := &Ask{Message: parts[0]}
+	ask.Button1, ask.URL1 = splitButton(parts[1])
+	ask.Button2, ask.URL2 = splitButton(parts[2])
+	if (ask.Button1 == "" && ask.URL1 != "") || (ask.Button2 == "" && ask.URL2 != "") {
+		return nil, &ParseError{Field: "ask", Err: fmt.Errorf("URL without a button")}
 	}
-	return ask
+	return ask, nil
 }
 
 func splitButton(buttonString string) (string, string) {
@@ -119,6 +120,10 @@ func (a *Ask) Encode() string {
 	}
 	button = encodeButton(a.Button2, a.URL2)
 	if button != "" {
+		// an empty first button keeps the second in its place
+		if len(delimited) == 1 {
+			delimited = append(delimited, "")
+		}
 		delimited = append(delimited, button)
 	}
 	return strings.Join(delimited, "~")
@@ -142,7 +147,7 @@ func removeSemi(v string) string {
 // NewCliResponse creates a minimal valid CliResponse object
 func NewCliResponse(nut Nut, qry string) *CliResponse {
 	return &CliResponse{
-		Version: []int{1},
+		Version: SupportedVersions,
 		Nut:     nut,
 		Qry:     qry,
 	}
@@ -235,15 +240,7 @@ func (cr *CliResponse) WithIdentitySuperseded() *CliResponse {
 func (cr *CliResponse) Encode() []byte {
 	var b bytes.Buffer
 
-	// TODO be less lazy and support ranges
-	b.WriteString("ver=")
-	for i, v := range cr.Version {
-		if i > 0 {
-			b.WriteString(",")
-		}
-		b.WriteString(strconv.Itoa(v))
-	}
-	b.WriteString("\r\n")
+	b.WriteString(fmt.Sprintf("ver=%v\r\n", cr.Version))
 
 	b.WriteString(fmt.Sprintf("nut=%v\r\n", cr.Nut))
 
@@ -276,32 +273,50 @@ func (cr *CliResponse) Encode() []byte {
 	return []byte(encoded)
 }
 
-// ParseCliResponse parses a server response
+// ParseCliResponse parses a server response. Malformed input gives a
+// *ParseError.
 func ParseCliResponse(body []byte) (*CliResponse, error) {
 	decoded := make([]byte, Sqrl64.DecodedLen(len(body)))
-	_, err := Sqrl64.Decode(decoded, body)
+	n, err := Sqrl64.Decode(decoded, body)
+	if err != nil {
+		return nil, &ParseError{Field: "body", Err: err}
+	}
+	params, err := ParseSqrlQuery(string(decoded[:n]))
 	if err != nil {
-		return nil, fmt.Errorf("error decoding response: %v", err)
+		return nil, err
 	}
-	params, err := ParseSqrlQuery(string(decoded))
+
+	version, err := ParseVersions(params["ver"])
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse response: %v", err)
+		return nil, &ParseError{Field: "ver", Err: err}
 	}
 
 	tifbig, err := strconv.ParseUint(params["tif"], 16, 32)
 	if err != nil {
-		return nil, fmt.Errorf("can't parse tif: %v", err)
+		return nil, &ParseError{Field: "tif", Err: err}
 	}
 
-	return &CliResponse{
-		Version: []int{1},
+	for _, field := range []string{"nut", "qry"} {
+		if _, ok := params[field]; !ok {
+			return nil, &ParseError{Field: field, Err: fmt.Errorf("missing")}
+		}
+	}
+
+	response := &CliResponse{
+		Version: version,
 		Nut:     Nut(params["nut"]),
 		TIF:     uint32(tifbig),
 		Qry:     params["qry"],
 		URL:     params["url"],
 		Sin:     params["sin"],
 		Suk:     params["suk"],
-		Ask:     ParseAsk(params["ask"]),
 		Can:     params["can"],
-	}, nil
+	}
+	if askString, ok := params["ask"]; ok {
+		response.Ask, err = ParseAsk(askString)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
 }
@@ -1,6 +1,11 @@
 package ssp
 
-import "testing"
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestAskButtonParse(t *testing.T) {
 	b, u := splitButton("button;https://example.com")
@@ -41,3 +46,144 @@ func TestAskNoButtonWithURL(t *testing.T) {
 		t.Errorf("Failed url: %v", u)
 	}
 }
+
+func TestParseAsk(t *testing.T) {
+	ask := &Ask{Message: "Continue?", Button2: "No", URL2: "https://example.com/no"}
+	parsed, err := ParseAsk(ask.Encode())
+	if err != nil {
+		t.Fatalf("ParseAsk failed: %v", err)
+	}
+	if *parsed != *ask {
+		t.Errorf("Expected %+v, got %+v", ask, parsed)
+	}
+
+	url := Sqrl64.EncodeToString([]byte(";https://example.com"))
+	for _, bad := range []string{"not base64!", "a~b~c~d", "a~" + url} {
+		var parseErr *ParseError
+		if _, err := ParseAsk(bad); !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestParseCliResponse_Refused(t *testing.T) {
+	for _, body := range []string{
+		"not base64!",
+		"ver=1\r\nnut=a\r\ntif=zz\r\nqry=/cli.sqrl\r\n",
+		"ver=1\r\ntif=0\r\nqry=/cli.sqrl\r\n",
+		"ver=1\r\nnut=a\r\ntif=0\r\nqry=/cli.sqrl\r\nask=a~b~c~d\r\n",
+		"ver=1\r\nnut=a\r\nnut=b\r\ntif=0\r\nqry=/cli.sqrl\r\n",
+	} {
+		encoded := []byte(Sqrl64.EncodeToString([]byte(body)))
+		if body == "not base64!" {
+			encoded = []byte(body)
+		}
+		var parseErr *ParseError
+		if _, err := ParseCliResponse(encoded); !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError for %q, got %v", body, err)
+		}
+	}
+}
+
+func FuzzParseAsk(f *testing.F) {
+	f.Add((&Ask{Message: "Continue?", Button1: "Yes", URL1: "https://example.com/yes", Button2: "No"}).Encode())
+	f.Add("")
+	f.Add("~~")
+	f.Add("a~b~c~d")
+	f.Add("not base64!")
+	f.Fuzz(func(t *testing.T, askString string) {
+		ask, err := ParseAsk(askString)
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a ParseError, got %v", err)
+			}
+			return
+		}
+		reparsed, err := ParseAsk(ask.Encode())
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", ask.Encode(), err)
+		}
+		if *reparsed != *ask {
+			t.Errorf("Expected %+v, got %+v", ask, reparsed)
+		}
+	})
+}
+
+func FuzzAskEncode(f *testing.F) {
+	f.Add("Continue?", "Yes", "https://example.com/yes", "No", "")
+	f.Add("", "", "", "No", "https://example.com/no")
+	f.Add("~;~", "a~b", "https://example.com/?a=b;c", "", "")
+	f.Fuzz(func(t *testing.T, message, button1, url1, button2, url2 string) {
+		// Encode drops semicolons in buttons and URLs without a button
+		if strings.Contains(button1+button2, ";") || (button1 == "" && url1 != "") || (button2 == "" && url2 != "") {
+			t.Skip()
+		}
+		ask := &Ask{Message: message, Button1: button1, URL1: url1, Button2: button2, URL2: url2}
+		parsed, err := ParseAsk(ask.Encode())
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", ask.Encode(), err)
+		}
+		if *parsed != *ask {
+			t.Errorf("Expected %+v, got %+v", ask, parsed)
+		}
+	})
+}
+
+func FuzzParseCliResponse(f *testing.F) {
+	response := NewCliResponse("abc", "/cli.sqrl?nut=abc").WithIDMatch()
+	response.URL = "https://example.com/?q=a+b%20c"
+	response.Suk = "testsuk"
+	response.Ask = &Ask{Message: "Continue?", Button1: "Yes"}
+	f.Add(response.Encode())
+	f.Add(NewCliResponse("", "").Encode())
+	f.Add([]byte(Sqrl64.EncodeToString([]byte("ver=1\r\nnut=a\r\ntif=\r\nqry=\r\n"))))
+	f.Add([]byte("not base64!"))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		response, err := ParseCliResponse(body)
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a ParseError, got %v", err)
+			}
+			return
+		}
+		reparsed, err := ParseCliResponse(response.Encode())
+		if err != nil {
+			t.Fatalf("Failed to parse the encoded response: %v", err)
+		}
+		if !reflect.DeepEqual(response, reparsed) {
+			t.Errorf("Expected %+v, got %+v", response, reparsed)
+		}
+	})
+}
+
+func FuzzCliResponseEncode(f *testing.F) {
+	f.Add("1", "abc", uint32(TIFIDMatch|TIFIPMatched), "/cli.sqrl?nut=abc", "https://example.com/", "0", "testsuk", "", "")
+	f.Add("1-2,4", "", uint32(0), "", "", "", "", "https://example.com/cancel", "Y29udGludWU~WWVz")
+	f.Fuzz(func(t *testing.T, ver, nut string, tif uint32, qry, url, sin, suk, can, ask string) {
+		version, err := ParseVersions(ver)
+		if err != nil {
+			t.Skip()
+		}
+		// values can't hold the line separator
+		for _, value := range []string{nut, qry, url, sin, suk, can} {
+			if strings.Contains(value, "\r\n") {
+				t.Skip()
+			}
+		}
+		response := &CliResponse{Version: version, Nut: Nut(nut), TIF: tif, Qry: qry, URL: url, Sin: sin, Suk: suk, Can: can}
+		if ask != "" {
+			if response.Ask, err = ParseAsk(ask); err != nil {
+				t.Skip()
+			}
+		}
+		parsed, err := ParseCliResponse(response.Encode())
+		if err != nil {
+			t.Fatalf("Failed to parse %+v: %v", response, err)
+		}
+		if !reflect.DeepEqual(response, parsed) {
+			t.Errorf("Expected %+v, got %+v", response, parsed)
+		}
+	})
+}
@@ -0,0 +1,317 @@
+// Package client is a SQRL client speaking the protocol to an SSP server.
+// It's meant for tests and scripted logins, not for real identities: the
+// keys of an Identity are used as they are rather than derived from a
+// master key.
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+// maxResponseSize bounds what's read from the server
+const maxResponseSize = 64 * 1024
+
+// Client sends commands for an Identity
+type Client struct {
+	Identity *Identity
+	// optional; defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// options sent with every command, such as "cps", "suk", "sqrlonly",
+	// "hardlock" or "noiptest"
+	Opt []string
+	// optional; picks the btn sent to answer an ask, 1 or 2 for its
+	// buttons or -1 for none. Without it asks aren't answered.
+	Answer func(ask *ssp.Ask) int
+	// used in place of sqrl:// to reach the server; "https" if empty
+	Scheme string
+}
+
+// CommandError is returned when the server answers a command with
+// TIFCommandFailed
+type CommandError struct {
+	Cmd string
+	TIF uint32
+}
+
+func (ce *CommandError) Error() string {
+	return fmt.Sprintf("%v failed: tif 0x%x (%v)", ce.Cmd, ce.TIF, DescribeTIF(ce.TIF))
+}
+
+// DescribeTIF lists the descriptions of the bits set in tif
+func DescribeTIF(tif uint32) string {
+	var bits []uint32
+	for bit := range ssp.TIFDesc {
+		if tif&bit != 0 {
+			bits = append(bits, bit)
+		}
+	}
+	sort.Slice(bits, func(i, j int) bool { return bits[i] < bits[j] })
+	descs := make([]string, len(bits))
+	for i, bit := range bits {
+		descs[i] = ssp.TIFDesc[bit]
+	}
+	return strings.Join(descs, ", ")
+}
+
+// Session is one login: the qry chain started by a nut
+type Session struct {
+	client *Client
+	// where Qry is resolved
+	base *url.URL
+	// Qry is where the next command is sent, from the last response
+	Qry string
+	// Server is sent as the server parameter: the SQRL URL at first, then
+	// the last response
+	Server string
+	// site and Pag are set by Begin so Redirect can ask /pag.sqrl
+	site *url.URL
+	Nut  ssp.Nut
+	Pag  ssp.Nut
+	// Last is the last response from the server
+	Last *ssp.CliResponse
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Open starts a Session from a sqrl:// URL, as scanned from a QR code
+func (c *Client) Open(sqrlURL string) (*Session, error) {
+	parsed, err := url.Parse(sqrlURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SQRL URL: %v", err)
+	}
+	if parsed.Scheme != ssp.SqrlScheme || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid SQRL URL: %v", sqrlURL)
+	}
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	qry := parsed.EscapedPath()
+	if parsed.RawQuery != "" {
+		qry += "?" + parsed.RawQuery
+	}
+	return &Session{
+		client: c,
+		base:   &url.URL{Scheme: scheme, Host: parsed.Host},
+		Qry:    qry,
+		Server: ssp.Sqrl64.EncodeToString([]byte(sqrlURL)),
+		Nut:    ssp.Nut(parsed.Query().Get("nut")),
+	}, nil
+}
+
+// Begin does what a login page does: gets a nut from the /nut.sqrl of
+// site, such as "https://example.com/sqrl", and starts a Session with its
+// SQRL URL
+func (c *Client) Begin(ctx context.Context, site string) (*Session, error) {
+	siteURL, err := url.Parse(strings.TrimSuffix(site, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid site: %v", err)
+	}
+	body, err := c.get(ctx, siteURL.String()+"/nut.sqrl")
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil || values.Get("nut") == "" {
+		return nil, fmt.Errorf("invalid /nut.sqrl response")
+	}
+	sqrlURL := &url.URL{
+		Scheme:   ssp.SqrlScheme,
+		Host:     siteURL.Host,
+		Path:     siteURL.Path + "/cli.sqrl",
+		RawQuery: url.Values{"nut": {values.Get("nut")}}.Encode(),
+	}
+	session, err := c.Open(sqrlURL.String())
+	if err != nil {
+		return nil, err
+	}
+	session.base.Scheme = siteURL.Scheme
+	session.site = siteURL
+	session.Pag = ssp.Nut(values.Get("pag"))
+	return session, nil
+}
+
+func (c *Client) get(ctx context.Context, target string) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: target, StatusCode: resp.StatusCode}
+	}
+	return body, nil
+}
+
+// StatusError is returned when the server answers with an HTTP error
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (se *StatusError) Error() string {
+	return fmt.Sprintf("%v answered %d %v", se.URL, se.StatusCode, http.StatusText(se.StatusCode))
+}
+
+// Send signs and posts cmd to the current qry and moves the Session on to
+// the Qry of the response. btn answers an ask; -1 for none. A response
+// with TIFCommandFailed is returned along with a *CommandError.
+func (s *Session) Send(ctx context.Context, cmd string, btn int) (*ssp.CliResponse, error) {
+	identity := s.client.Identity
+	body := &ssp.ClientBody{
+		Version: ssp.SupportedVersions,
+		Cmd:     cmd,
+		Opt:     make(map[string]bool),
+		Idk:     identity.Idk(),
+		Pidk:    identity.Pidk(),
+		Btn:     btn,
+	}
+	for _, opt := range s.client.Opt {
+		body.Opt[opt] = true
+	}
+	// a new identity, or one replacing a previous identity, gives the
+	// server its unlock keys
+	if cmd == "ident" && (s.Last == nil || s.Last.TIF&ssp.TIFIDMatch == 0) {
+		body.Suk = identity.Suk
+		body.Vuk = identity.Vuk()
+	}
+
+	req := &ssp.CliRequest{
+		Client:        body,
+		ClientEncoded: string(body.Encode()),
+		Server:        s.Server,
+	}
+	req.Ids = sign(identity.Key, req)
+	if identity.Previous != nil {
+		req.Pids = sign(identity.Previous, req)
+	}
+	if (cmd == "enable" || cmd == "remove") && identity.Unlock != nil {
+		req.Urs = sign(identity.Unlock, req)
+	}
+
+	qry, err := url.Parse(s.Qry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid qry %q: %v", s.Qry, err)
+	}
+	target := s.base.ResolveReference(qry).String()
+	r, err := http.NewRequestWithContext(ctx, "POST", target, strings.NewReader(req.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.httpClient().Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: target, StatusCode: resp.StatusCode}
+	}
+	response, err := ssp.ParseCliResponse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Last = response
+	s.Server = string(raw)
+	if response.Qry != "" {
+		s.Qry = response.Qry
+	}
+	if response.TIF&ssp.TIFCommandFailed != 0 {
+		return response, &CommandError{Cmd: cmd, TIF: response.TIF}
+	}
+	return response, nil
+}
+
+func sign(key ed25519.PrivateKey, req *ssp.CliRequest) string {
+	return ssp.Sqrl64.EncodeToString(ed25519.Sign(key, req.SigningString()))
+}
+
+// Query sends query
+func (s *Session) Query(ctx context.Context) (*ssp.CliResponse, error) {
+	return s.Send(ctx, "query", -1)
+}
+
+// Login sends query and then ident, answering an ask with Client.Answer.
+// With the "cps" option the response URL is where the browser goes next;
+// otherwise see Redirect.
+func (s *Session) Login(ctx context.Context) (*ssp.CliResponse, error) {
+	response, err := s.Query(ctx)
+	if err != nil {
+		return response, err
+	}
+	if response.TIF&ssp.TIFSQRLDisabled != 0 {
+		return response, fmt.Errorf("identity is disabled on this site; enable it first")
+	}
+	btn := -1
+	if response.Ask != nil && s.client.Answer != nil {
+		btn = s.client.Answer(response.Ask)
+	}
+	return s.Send(ctx, "ident", btn)
+}
+
+// Disable sends disable, locking the identity out of the site until enable
+func (s *Session) Disable(ctx context.Context) (*ssp.CliResponse, error) {
+	return s.send(ctx, "disable")
+}
+
+// Enable sends enable signed with the Unlock key
+func (s *Session) Enable(ctx context.Context) (*ssp.CliResponse, error) {
+	return s.send(ctx, "enable")
+}
+
+// Remove sends remove signed with the Unlock key, removing the identity
+// from the site
+func (s *Session) Remove(ctx context.Context) (*ssp.CliResponse, error) {
+	return s.send(ctx, "remove")
+}
+
+// send sends query first if this Session hasn't sent anything yet
+func (s *Session) send(ctx context.Context, cmd string) (*ssp.CliResponse, error) {
+	if s.Last == nil {
+		if response, err := s.Query(ctx); err != nil {
+			return response, err
+		}
+	}
+	return s.Send(ctx, cmd, -1)
+}
+
+// Redirect asks /pag.sqrl where the browser goes once the login is done.
+// It needs a Session started with Begin.
+func (s *Session) Redirect(ctx context.Context) (string, error) {
+	if s.site == nil {
+		return "", fmt.Errorf("the session wasn't started with Begin")
+	}
+	params := url.Values{"nut": {string(s.Nut)}, "pag": {string(s.Pag)}}
+	body, err := s.client.get(ctx, s.site.String()+"/pag.sqrl?"+params.Encode())
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+// testAuthenticator keeps users by idk
+type testAuthenticator struct {
+	mutex   sync.Mutex
+	users   map[string]bool
+	ask     *ssp.Ask
+	btn     int
+	removed int
+}
+
+func (ta *testAuthenticator) AuthenticateIdentity(identity *ssp.SqrlIdentity) string {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	ta.users[identity.Idk] = true
+	ta.btn = identity.Btn
+	return "https://example.com/welcome?user=" + identity.Idk
+}
+
+func (ta *testAuthenticator) SwapIdentities(previous, identity *ssp.SqrlIdentity) error {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	delete(ta.users, previous.Idk)
+	ta.users[identity.Idk] = true
+	return nil
+}
+
+func (ta *testAuthenticator) RemoveIdentity(identity *ssp.SqrlIdentity) error {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	delete(ta.users, identity.Idk)
+	ta.removed++
+	return nil
+}
+
+func (ta *testAuthenticator) AskResponse(identity *ssp.SqrlIdentity) *ssp.Ask {
+	return ta.ask
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *testAuthenticator) {
+	tree, err := ssp.NewRandomTree(18)
+	if err != nil {
+		t.Fatalf("Failed to create tree: %v", err)
+	}
+	auth := &testAuthenticator{users: make(map[string]bool)}
+	api := ssp.NewSqrlSspAPI(tree, ssp.NewMapHoard(), auth, ssp.NewMapAuthStore())
+	api.RootPath = "/sqrl"
+	server := httptest.NewServer(api.Handler())
+	t.Cleanup(server.Close)
+	return server, auth
+}
+
+func newTestClient(t *testing.T) *Client {
+	identity, err := NewIdentity()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	return &Client{Identity: identity}
+}
+
+func TestLogin(t *testing.T) {
+	server, auth := newTestServer(t)
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	session, err := client.Begin(ctx, server.URL+"/sqrl")
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	response, err := session.Login(ctx)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if response.TIF&ssp.TIFIDMatch == 0 {
+		t.Errorf("Expected ID match, got %v", DescribeTIF(response.TIF))
+	}
+	if !auth.users[client.Identity.Idk()] {
+		t.Errorf("Expected the identity to be authenticated")
+	}
+	redirect, err := session.Redirect(ctx)
+	if err != nil {
+		t.Fatalf("Redirect failed: %v", err)
+	}
+	if redirect != "https://example.com/welcome?user="+client.Identity.Idk() {
+		t.Errorf("Unexpected redirect %q", redirect)
+	}
+
+	// a known identity logs in again without sending its unlock keys
+	session, err = client.Begin(ctx, server.URL+"/sqrl")
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	response, err = session.Query(ctx)
+	if err != nil || response.TIF&ssp.TIFIDMatch == 0 {
+		t.Fatalf("Expected ID match, got %v %v", response, err)
+	}
+	if _, err := session.Send(ctx, "ident", -1); err != nil {
+		t.Fatalf("ident failed: %v", err)
+	}
+}
+
+func TestLoginCPS(t *testing.T) {
+	server, _ := newTestServer(t)
+	client := newTestClient(t)
+	client.Opt = []string{"cps", "suk"}
+	ctx := context.Background()
+
+	session, err := client.Begin(ctx, server.URL+"/sqrl")
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	response, err := session.Login(ctx)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if !strings.HasPrefix(response.URL, "https://example.com/welcome") {
+		t.Errorf("Expected the cps URL, got %q", response.URL)
+	}
+	if response.Suk != client.Identity.Suk {
+		t.Errorf("Expected the suk back, got %q", response.Suk)
+	}
+}
+
+func TestLoginAsk(t *testing.T) {
+	server, auth := newTestServer(t)
+	auth.ask = &ssp.Ask{Message: "Transfer $100?", Button1: "Yes", Button2: "No"}
+	client := newTestClient(t)
+	var asked *ssp.Ask
+	client.Answer = func(ask *ssp.Ask) int {
+		asked = ask
+		return 2
+	}
+	ctx := context.Background()
+
+	session, err := client.Begin(ctx, server.URL+"/sqrl")
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if _, err := session.Login(ctx); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if asked == nil || asked.Message != "Transfer $100?" || asked.Button2 != "No" {
+		t.Errorf("Unexpected ask %+v", asked)
+	}
+	if auth.btn != 2 {
+		t.Errorf("Expected btn 2 at the Authenticator, got %d", auth.btn)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	server, auth := newTestServer(t)
+	client := newTestClient(t)
+	ctx := context.Background()
+	login := func() *ssp.CliResponse {
+		session, err := client.Begin(ctx, server.URL+"/sqrl")
+		if err != nil {
+			t.Fatalf("Begin failed: %v", err)
+		}
+		response, err := session.Login(ctx)
+		if err != nil {
+			t.Fatalf("Login failed: %v", err)
+		}
+		return response
+	}
+	login()
+	previous := client.Identity.Idk()
+
+	if err := client.Identity.Rekey(); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	response := login()
+	if response.TIF&ssp.TIFIDMatch == 0 {
+		t.Errorf("Expected the new key to match after rekey, got %v", DescribeTIF(response.TIF))
+	}
+	if auth.users[previous] || !auth.users[client.Identity.Idk()] {
+		t.Errorf("Expected the identities swapped, got %v", auth.users)
+	}
+}
+
+func TestDisableEnableRemove(t *testing.T) {
+	server, auth := newTestServer(t)
+	client := newTestClient(t)
+	ctx := context.Background()
+	begin := func() *Session {
+		session, err := client.Begin(ctx, server.URL+"/sqrl")
+		if err != nil {
+			t.Fatalf("Begin failed: %v", err)
+		}
+		return session
+	}
+	if _, err := begin().Login(ctx); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	if _, err := begin().Disable(ctx); err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+	response, err := begin().Login(ctx)
+	if err == nil || response.TIF&ssp.TIFSQRLDisabled == 0 {
+		t.Fatalf("Expected login refused while disabled, got %v %v", response, err)
+	}
+
+	// enable without the unlock key fails
+	unlock := client.Identity.Unlock
+	client.Identity.Unlock = nil
+	_, err = begin().Enable(ctx)
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || commandErr.Cmd != "enable" {
+		t.Fatalf("Expected enable to fail without urs, got %v", err)
+	}
+	client.Identity.Unlock = unlock
+
+	if _, err := begin().Enable(ctx); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	if _, err := begin().Login(ctx); err != nil {
+		t.Fatalf("Login after enable failed: %v", err)
+	}
+	if _, err := begin().Remove(ctx); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if auth.removed != 1 {
+		t.Errorf("Expected the identity removed, got %d", auth.removed)
+	}
+	response, err = begin().Query(ctx)
+	if err != nil || response.TIF&ssp.TIFIDMatch != 0 {
+		t.Errorf("Expected an unknown identity after remove, got %v %v", response, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	server, _ := newTestServer(t)
+	client := newTestClient(t)
+	client.Scheme = "http"
+	ctx := context.Background()
+
+	begun, err := client.Begin(ctx, server.URL+"/sqrl")
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	session, err := client.Open("sqrl://" + host + "/sqrl/cli.sqrl?nut=" + string(begun.Nut))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := session.Login(ctx); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if _, err := session.Redirect(ctx); err == nil {
+		t.Errorf("Expected Redirect to need Begin")
+	}
+
+	for _, bad := range []string{"https://example.com/cli.sqrl", "sqrl:///cli.sqrl", "%"} {
+		if _, err := client.Open(bad); err == nil {
+			t.Errorf("Expected %q refused", bad)
+		}
+	}
+}
+
+func TestIdentityJSON(t *testing.T) {
+	client := newTestClient(t)
+	if err := client.Identity.Rekey(); err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	stored, err := json.Marshal(client.Identity)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var loaded Identity
+	if err := json.Unmarshal(stored, &loaded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if loaded.Idk() != client.Identity.Idk() || loaded.Pidk() != client.Identity.Pidk() ||
+		loaded.Vuk() != client.Identity.Vuk() || loaded.Suk != client.Identity.Suk {
+		t.Errorf("Identity changed in JSON: %s", stored)
+	}
+	if err := json.Unmarshal([]byte(`{"key":"short"}`), &loaded); err == nil {
+		t.Errorf("Expected a short seed refused")
+	}
+}
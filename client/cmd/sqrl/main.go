@@ -0,0 +1,210 @@
+// Command sqrl is a SQRL client for scripting logins against an SSP
+// server, such as a staging site, without a phone:
+//
+//	sqrl -id qa.json login https://staging.example.com/sqrl
+//
+// The identity file is created the first time it's used.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/dxcSithLord/server-go-ssp/client"
+	"github.com/dxcSithLord/server-go-ssp/ssptest"
+)
+
+var identityFile string
+var opts string
+var btn int
+var scheme string
+var timeout time.Duration
+
+const usage = `usage: sqrl [flags] command target
+
+command is one of:
+  login    query then ident; prints where the browser goes next
+  query    query only
+  ident    ident only
+  disable  disable the identity on the site
+  enable   enable it again, signed with the unlock key
+  remove   remove the identity from the site, signed with the unlock key
+  rekey    replace the identity key, keeping the old one as the previous
+           key; the next login moves the account to the new key. Takes no
+           target.
+  conform  run the ssptest conformance scenarios against the site with
+           throwaway identities; the identity file isn't used
+
+target is the site's SQRL root, such as https://example.com/sqrl, or a
+sqrl:// URL from a login page.
+
+flags:
+`
+
+func main() {
+	flag.StringVar(&identityFile, "id", "sqrl-identity.json", "identity file, created if it doesn't exist")
+	flag.StringVar(&opts, "opt", "", "comma separated options to send, such as cps,suk,sqrlonly,hardlock,noiptest")
+	flag.IntVar(&btn, "btn", -1, "button to answer an ask with (1 or 2); -1 leaves it unanswered")
+	flag.StringVar(&scheme, "scheme", "https", "scheme used to reach the server of a sqrl:// URL")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "time allowed for the whole command")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || (args[0] != "rekey" && len(args) != 2) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if args[0] == "conform" {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if !conform(ctx, args[1]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	identity, err := loadIdentity(identityFile)
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+	if args[0] == "rekey" {
+		if err := identity.Rekey(); err != nil {
+			log.Fatalf("Rekey failed: %v", err)
+		}
+		if err := saveIdentity(identityFile, identity); err != nil {
+			log.Fatalf("Failed to save identity: %v", err)
+		}
+		fmt.Printf("idk %v\npidk %v\n", identity.Idk(), identity.Pidk())
+		return
+	}
+
+	c := &client.Client{Identity: identity, Scheme: scheme}
+	if opts != "" {
+		c.Opt = strings.Split(opts, ",")
+	}
+	c.Answer = func(ask *ssp.Ask) int {
+		fmt.Printf("ask %q [1: %q, 2: %q]\n", ask.Message, ask.Button1, ask.Button2)
+		return btn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := run(ctx, c, args[0], args[1]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, c *client.Client, command, target string) error {
+	var session *client.Session
+	var err error
+	if strings.HasPrefix(target, ssp.SqrlScheme+"://") {
+		session, err = c.Open(target)
+	} else {
+		session, err = c.Begin(ctx, target)
+	}
+	if err != nil {
+		return err
+	}
+
+	var response *ssp.CliResponse
+	switch command {
+	case "login":
+		response, err = session.Login(ctx)
+	case "query":
+		response, err = session.Query(ctx)
+	case "ident":
+		response, err = session.Send(ctx, "ident", btn)
+	case "disable":
+		response, err = session.Disable(ctx)
+	case "enable":
+		response, err = session.Enable(ctx)
+	case "remove":
+		response, err = session.Remove(ctx)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	if response != nil {
+		fmt.Printf("tif 0x%x (%v)\n", response.TIF, client.DescribeTIF(response.TIF))
+		if response.URL != "" {
+			fmt.Printf("url %v\n", response.URL)
+		}
+		if response.Suk != "" {
+			fmt.Printf("suk %v\n", response.Suk)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// without cps the page polling /pag.sqrl gets the redirect
+	if command == "login" && response.URL == "" {
+		redirect, err := session.Redirect(ctx)
+		if err != nil {
+			var statusErr *client.StatusError
+			if errors.As(err, &statusErr) {
+				return fmt.Errorf("no redirect: %v", err)
+			}
+			return err
+		}
+		fmt.Printf("redirect %v\n", redirect)
+	}
+	return nil
+}
+
+// conform prints the result of each scenario and whether they all passed
+func conform(ctx context.Context, site string) bool {
+	passed := true
+	for _, result := range ssptest.Run(ctx, &ssptest.Target{BaseURL: site, HTTPClient: http.DefaultClient}) {
+		fmt.Println(result)
+		if !result.Skipped && !result.Passed() {
+			passed = false
+		}
+	}
+	return passed
+}
+
+func loadIdentity(file string) (*client.Identity, error) {
+	stored, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		identity, err := client.NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if err := saveIdentity(file, identity); err != nil {
+			return nil, err
+		}
+		log.Printf("Created identity %v in %v", identity.Idk(), file)
+		return identity, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	identity := &client.Identity{}
+	if err := json.Unmarshal(stored, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func saveIdentity(file string, identity *client.Identity) error {
+	stored, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the file holds private keys
+	return os.WriteFile(file, stored, 0600)
+}
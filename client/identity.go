@@ -0,0 +1,137 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+// Identity holds the keys of a SQRL identity for one site. A real client
+// derives them from the user's master key; here they're just keys.
+type Identity struct {
+	// Key is the identity key; its public key is the idk
+	Key ed25519.PrivateKey
+	// optional; sent as pidk/pids so the server replaces it with Key
+	Previous ed25519.PrivateKey
+	// Unlock is the unlock request signing key. Its public key is sent as
+	// the vuk of a new identity and it signs the urs of enable and remove.
+	Unlock ed25519.PrivateKey
+	// Suk is sent with a new identity for the server to keep
+	Suk string
+}
+
+// NewIdentity creates an Identity with random keys
+func NewIdentity() (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, unlock, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	suk := make([]byte, 32)
+	if _, err := rand.Read(suk); err != nil {
+		return nil, err
+	}
+	return &Identity{Key: key, Unlock: unlock, Suk: ssp.Sqrl64.EncodeToString(suk)}, nil
+}
+
+// Idk is the public identity key sent to the server
+func (id *Identity) Idk() string {
+	return publicKey(id.Key)
+}
+
+// Pidk is the public key of Previous, or "" if there's none
+func (id *Identity) Pidk() string {
+	return publicKey(id.Previous)
+}
+
+// Vuk is the public key of Unlock, or "" if there's none
+func (id *Identity) Vuk() string {
+	return publicKey(id.Unlock)
+}
+
+// Rekey replaces Key with a new key, keeping the current one as Previous
+// so the next ident moves the account to the new key
+func (id *Identity) Rekey() error {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	id.Previous = id.Key
+	id.Key = key
+	return nil
+}
+
+func publicKey(key ed25519.PrivateKey) string {
+	if key == nil {
+		return ""
+	}
+	return ssp.Sqrl64.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// identityJSON stores the key seeds
+type identityJSON struct {
+	Key      string `json:"key"`
+	Previous string `json:"previous,omitempty"`
+	Unlock   string `json:"unlock,omitempty"`
+	Suk      string `json:"suk,omitempty"`
+}
+
+// MarshalJSON stores the private keys as Sqrl64 seeds
+func (id *Identity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&identityJSON{
+		Key:      seed(id.Key),
+		Previous: seed(id.Previous),
+		Unlock:   seed(id.Unlock),
+		Suk:      id.Suk,
+	})
+}
+
+// UnmarshalJSON reads the output of MarshalJSON
+func (id *Identity) UnmarshalJSON(b []byte) error {
+	var stored identityJSON
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return err
+	}
+	var err error
+	if id.Key, err = fromSeed(stored.Key); err != nil {
+		return fmt.Errorf("invalid key: %v", err)
+	}
+	if id.Key == nil {
+		return fmt.Errorf("missing key")
+	}
+	if id.Previous, err = fromSeed(stored.Previous); err != nil {
+		return fmt.Errorf("invalid previous key: %v", err)
+	}
+	if id.Unlock, err = fromSeed(stored.Unlock); err != nil {
+		return fmt.Errorf("invalid unlock key: %v", err)
+	}
+	id.Suk = stored.Suk
+	return nil
+}
+
+func seed(key ed25519.PrivateKey) string {
+	if key == nil {
+		return ""
+	}
+	return ssp.Sqrl64.EncodeToString(key.Seed())
+}
+
+func fromSeed(encoded string) (ed25519.PrivateKey, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	seed, err := ssp.Sqrl64.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("seed is %d bytes", len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,152 @@
+package ssp
+
+import (
+	"context"
+	"time"
+)
+
+// ContextHoard is the context-first version of Hoard. The context of the
+// originating HTTP request is passed through so cancellation and deadlines
+// reach the storage layer.
+type ContextHoard interface {
+	Get(ctx context.Context, nut Nut) (*HoardCache, error)
+	GetAndDelete(ctx context.Context, nut Nut) (*HoardCache, error)
+	Save(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error
+}
+
+// ContextAuthStore is the context-first version of AuthStore
+type ContextAuthStore interface {
+	FindIdentity(ctx context.Context, idk string) (*SqrlIdentity, error)
+	SaveIdentity(ctx context.Context, identity *SqrlIdentity) error
+	DeleteIdentity(ctx context.Context, idk string) error
+}
+
+// IdentityLister is optionally implemented by a ContextAuthStore that can
+// page through its identities. It returns up to limit identities with an
+// Idk greater than after, ordered by Idk.
+type IdentityLister interface {
+	ListIdentities(ctx context.Context, after string, limit int) ([]*SqrlIdentity, error)
+}
+
+// NutPurger is optionally implemented by a ContextHoard that can delete
+// every outstanding nut of an identity (see HoardCache.ForIdentity). It
+// returns the number of nuts deleted.
+type NutPurger interface {
+	PurgeNuts(ctx context.Context, idk string) (int, error)
+}
+
+// ContextAuthenticator is the context-first version of Authenticator.
+// Unlike Authenticator, AuthenticateIdentity can report a failure; the
+// SQRL client then gets a failed command and no redirect is issued.
+type ContextAuthenticator interface {
+	AuthenticateIdentity(ctx context.Context, identity *SqrlIdentity) (string, error)
+	SwapIdentities(ctx context.Context, previousIdentity, newIdentity *SqrlIdentity) error
+	RemoveIdentity(ctx context.Context, identity *SqrlIdentity) error
+	AskResponse(ctx context.Context, identity *SqrlIdentity) *Ask
+}
+
+// WrapHoard adapts a Hoard to a ContextHoard. The context is checked
+// before each call but can't interrupt a call in progress.
+func WrapHoard(hoard Hoard) ContextHoard {
+	if hoard == nil {
+		return nil
+	}
+	return &hoardAdapter{hoard}
+}
+
+type hoardAdapter struct {
+	hoard Hoard
+}
+
+func (h *hoardAdapter) Get(ctx context.Context, nut Nut) (*HoardCache, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return h.hoard.Get(nut)
+}
+
+func (h *hoardAdapter) GetAndDelete(ctx context.Context, nut Nut) (*HoardCache, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return h.hoard.GetAndDelete(nut)
+}
+
+func (h *hoardAdapter) Save(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return h.hoard.Save(nut, value, expiration)
+}
+
+// WrapAuthStore adapts an AuthStore to a ContextAuthStore. The context is
+// checked before each call but can't interrupt a call in progress.
+func WrapAuthStore(authStore AuthStore) ContextAuthStore {
+	if authStore == nil {
+		return nil
+	}
+	return &authStoreAdapter{authStore}
+}
+
+type authStoreAdapter struct {
+	authStore AuthStore
+}
+
+func (a *authStoreAdapter) FindIdentity(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.authStore.FindIdentity(idk)
+}
+
+func (a *authStoreAdapter) SaveIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.authStore.SaveIdentity(identity)
+}
+
+func (a *authStoreAdapter) DeleteIdentity(ctx context.Context, idk string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.authStore.DeleteIdentity(idk)
+}
+
+// WrapAuthenticator adapts an Authenticator to a ContextAuthenticator.
+// AuthenticateIdentity never fails through the adapter.
+func WrapAuthenticator(authenticator Authenticator) ContextAuthenticator {
+	if authenticator == nil {
+		return nil
+	}
+	return &authenticatorAdapter{authenticator}
+}
+
+type authenticatorAdapter struct {
+	authenticator Authenticator
+}
+
+func (a *authenticatorAdapter) AuthenticateIdentity(ctx context.Context, identity *SqrlIdentity) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return a.authenticator.AuthenticateIdentity(identity), nil
+}
+
+func (a *authenticatorAdapter) SwapIdentities(ctx context.Context, previousIdentity, newIdentity *SqrlIdentity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.authenticator.SwapIdentities(previousIdentity, newIdentity)
+}
+
+func (a *authenticatorAdapter) RemoveIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.authenticator.RemoveIdentity(identity)
+}
+
+func (a *authenticatorAdapter) AskResponse(ctx context.Context, identity *SqrlIdentity) *Ask {
+	return a.authenticator.AskResponse(identity)
+}
@@ -0,0 +1,149 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type ctxKey struct{}
+
+// ctxRecordingAuthStore records whether every call received the request context
+type ctxRecordingAuthStore struct {
+	ContextAuthStore
+	calls    int
+	missing  int
+	expected interface{}
+}
+
+func (s *ctxRecordingAuthStore) check(ctx context.Context) {
+	s.calls++
+	if ctx.Value(ctxKey{}) != s.expected {
+		s.missing++
+	}
+}
+
+func (s *ctxRecordingAuthStore) FindIdentity(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	s.check(ctx)
+	return s.ContextAuthStore.FindIdentity(ctx, idk)
+}
+
+func (s *ctxRecordingAuthStore) SaveIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	s.check(ctx)
+	return s.ContextAuthStore.SaveIdentity(ctx, identity)
+}
+
+type failingAuthenticator struct {
+	ContextAuthenticator
+}
+
+func (f *failingAuthenticator) AuthenticateIdentity(ctx context.Context, identity *SqrlIdentity) (string, error) {
+	return "", fmt.Errorf("user service unavailable")
+}
+
+func TestWrapHoardCancelled(t *testing.T) {
+	hoard := WrapHoard(NewMapHoard())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := hoard.Save(ctx, "nut", &HoardCache{}, time.Minute); err != context.Canceled {
+		t.Errorf("Expected context.Canceled on save, got %v", err)
+	}
+	if _, err := hoard.Get(ctx, "nut"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled on get, got %v", err)
+	}
+	if _, err := hoard.GetAndDelete(ctx, "nut"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled on get and delete, got %v", err)
+	}
+}
+
+func TestWrapAuthStore(t *testing.T) {
+	store := WrapAuthStore(NewMapAuthStore())
+	ctx := context.Background()
+
+	if err := store.SaveIdentity(ctx, &SqrlIdentity{Idk: "idk"}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if _, err := store.FindIdentity(ctx, "idk"); err != nil {
+		t.Errorf("Failed find: %v", err)
+	}
+	if err := store.DeleteIdentity(ctx, "idk"); err != nil {
+		t.Errorf("Failed delete: %v", err)
+	}
+	if _, err := store.FindIdentity(ctx, "idk"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.FindIdentity(cancelled, "idk"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWrapNil(t *testing.T) {
+	if WrapHoard(nil) != nil || WrapAuthStore(nil) != nil || WrapAuthenticator(nil) != nil {
+		t.Error("Expected wrapping nil to return nil")
+	}
+}
+
+func TestWrapAuthenticator(t *testing.T) {
+	auth := WrapAuthenticator(&mockAuthenticator{authURL: "https://example.com/"})
+	url, err := auth.AuthenticateIdentity(context.Background(), &SqrlIdentity{})
+	if err != nil || url != "https://example.com/" {
+		t.Errorf("Unexpected result %q %v", url, err)
+	}
+}
+
+func TestCliPassesRequestContext(t *testing.T) {
+	api := newTestAPI(t)
+	store := &ctxRecordingAuthStore{ContextAuthStore: api.authStore, expected: "request"}
+	api.authStore = store
+	client := newTestSqrlClient(t, api)
+	client.ctx = context.WithValue(context.Background(), ctxKey{}, "request")
+
+	client.send("query")
+	client.send("ident")
+	if store.calls == 0 {
+		t.Fatal("AuthStore was never called")
+	}
+	if store.missing != 0 {
+		t.Errorf("%d of %d AuthStore calls didn't get the request context", store.missing, store.calls)
+	}
+}
+
+func TestCliAuthenticatorError(t *testing.T) {
+	api := newTestAPI(t)
+	api.ContextAuthenticator = &failingAuthenticator{WrapAuthenticator(&MockAuthenticator{})}
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	resp := client.send("ident")
+	if resp.TIF&TIFCommandFailed == 0 {
+		t.Errorf("Expected failed command when authenticator fails, got 0x%x", resp.TIF)
+	}
+	if _, err := api.hoard.Get(context.Background(), client.pag); err != ErrNotFound {
+		t.Errorf("Expected no pag entry after failed authentication, got %v", err)
+	}
+}
+
+func TestPagAuthenticatorError(t *testing.T) {
+	api := newTestAPI(t)
+	api.ContextAuthenticator = &failingAuthenticator{WrapAuthenticator(&MockAuthenticator{})}
+	err := api.hoard.Save(context.Background(), "pag", &HoardCache{
+		State:       NutAuthenticated,
+		OriginalNut: "nut",
+		Identity:    &SqrlIdentity{Idk: "idk"},
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut=nut&pag=pag", nil))
+	if w.Code != 500 {
+		t.Errorf("Expected 500 when authenticator fails, got %d", w.Code)
+	}
+}
@@ -0,0 +1,210 @@
+package ssp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies what an Event reports
+type EventType string
+
+// Events published on SqrlSspAPI.Events. Identity events are only
+// published once the changes they describe have been committed.
+const (
+	// a nut was issued by /nut.sqrl or /png.sqrl
+	EventNutIssued EventType = "nut_issued"
+	// a valid query command was received
+	EventQueryReceived EventType = "query_received"
+	// an identity logged in with ident
+	EventIdentAuthenticated EventType = "ident_authenticated"
+	// a new identity was associated with the site
+	EventIdentityCreated EventType = "identity_created"
+	// PreviousIdk was replaced by the new identity Idk; published instead
+	// of EventIdentityCreated for the new identity
+	EventIdentityRekeyed  EventType = "identity_rekeyed"
+	EventIdentityDisabled EventType = "identity_disabled"
+	EventIdentityEnabled  EventType = "identity_enabled"
+	EventIdentityRemoved  EventType = "identity_removed"
+	// the identity's sqrlonly or hardlock option changed; Policy is the
+	// new policy
+	EventPolicyChanged EventType = "policy_changed"
+	// a request was rejected; Reason says why
+	EventValidationFailed EventType = "validation_failed"
+)
+
+// Reasons given with EventValidationFailed
+const (
+	ReasonMalformedRequest   = "malformed_request"
+	ReasonUnknownNut         = "unknown_nut"
+	ReasonLastResponse       = "last_response_mismatch"
+	ReasonIPMismatch         = "ip_mismatch"
+	ReasonIdentityMismatch   = "identity_mismatch"
+	ReasonUnsupported        = "unsupported"
+	ReasonInvalidUnlock      = "invalid_unlock_signature"
+	ReasonSecretIndex        = "secret_index_mismatch"
+	ReasonIdentitySuperseded = "identity_superseded"
+	// the pidk was already rekeyed to a different identity
+	ReasonPreviousSuperseded = "previous_identity_superseded"
+	// the nut was in the wrong NutState for the request
+	ReasonNutState = "invalid_nut_state"
+)
+
+// Event is a SQRL authentication event. Fields that don't apply to the
+// event type are empty.
+type Event struct {
+	// unique per event so webhook receivers can drop redelivered events
+	ID          string    `json:"id"`
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	Nut         Nut       `json:"nut,omitempty"`
+	RemoteIP    string    `json:"remoteIP,omitempty"`
+	Cmd         string    `json:"cmd,omitempty"`
+	Idk         string    `json:"idk,omitempty"`
+	PreviousIdk string    `json:"previousIdk,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Policy      *Policy   `json:"policy,omitempty"`
+	// the state of Nut; with EventNutIssued, Transition says when it
+	// was issued
+	NutState   NutState       `json:"nutState,omitempty"`
+	Transition *NutTransition `json:"transition,omitempty"`
+}
+
+// EventSink receives published events. Publish is called on the request
+// goroutine so it should hand the event off rather than block.
+type EventSink interface {
+	Publish(ctx context.Context, event *Event)
+}
+
+// EventBus fans events out to its sinks
+type EventBus struct {
+	mutex *sync.RWMutex
+	sinks []EventSink
+}
+
+// NewEventBus creates an EventBus publishing to sinks
+func NewEventBus(sinks ...EventSink) *EventBus {
+	return &EventBus{
+		mutex: &sync.RWMutex{},
+		sinks: sinks,
+	}
+}
+
+// Subscribe adds a sink
+func (eb *EventBus) Subscribe(sink EventSink) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	eb.sinks = append(eb.sinks, sink)
+}
+
+// Publish implements EventSink. A missing ID and Time are filled in.
+func (eb *EventBus) Publish(ctx context.Context, event *Event) {
+	if event.ID == "" {
+		id := make([]byte, 16)
+		_, _ = rand.Read(id)
+		event.ID = Sqrl64.EncodeToString(id)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	eb.mutex.RLock()
+	sinks := eb.sinks
+	eb.mutex.RUnlock()
+	for _, sink := range sinks {
+		sink.Publish(ctx, event)
+	}
+}
+
+// publish sends event to SqrlSspAPI.Events if set
+func (api *SqrlSspAPI) publish(ctx context.Context, event *Event) {
+	if api.Events == nil {
+		return
+	}
+	api.Events.Publish(ctx, event)
+}
+
+// identityEvent creates an event for a /cli.sqrl request; identity may be
+// nil to use the idk of the request
+func identityEvent(eventType EventType, req *CliRequest, identity *SqrlIdentity) *Event {
+	event := &Event{
+		Type:     eventType,
+		RemoteIP: req.IPAddress,
+		Cmd:      req.Client.Cmd,
+		Idk:      req.Client.Idk,
+	}
+	if identity != nil {
+		event.Idk = identity.Idk
+	}
+	return event
+}
+
+// validationError is a request check failure; reason is published with
+// EventValidationFailed
+type validationError struct {
+	reason string
+	err    error
+}
+
+func newValidationError(reason string, format string, args ...interface{}) error {
+	return &validationError{reason, fmt.Errorf(format, args...)}
+}
+
+func (ve *validationError) Error() string {
+	return ve.err.Error()
+}
+
+// validationReason returns the reason of a validationError or ""
+func validationReason(err error) string {
+	var ve *validationError
+	if errors.As(err, &ve) {
+		return ve.reason
+	}
+	return ""
+}
+
+// validationFailed publishes EventValidationFailed for a /cli.sqrl request
+func (api *SqrlSspAPI) validationFailed(ctx context.Context, req *CliRequest, hoardCache *HoardCache, reason string) {
+	event := &Event{Type: EventValidationFailed, Reason: reason}
+	if req != nil {
+		event.RemoteIP = req.IPAddress
+		if req.Client != nil {
+			event.Cmd = req.Client.Cmd
+			event.Idk = req.Client.Idk
+		}
+	}
+	if hoardCache != nil {
+		event.Nut = hoardCache.OriginalNut
+		event.NutState = hoardCache.State
+	}
+	api.publish(ctx, event)
+}
+
+// ChannelSink delivers events to C for in-process consumers. Events are
+// dropped rather than blocking a request when C is full.
+type ChannelSink struct {
+	C       chan *Event
+	dropped atomic.Int64
+}
+
+// NewChannelSink creates a ChannelSink buffering up to size events
+func NewChannelSink(size int) *ChannelSink {
+	return &ChannelSink{C: make(chan *Event, size)}
+}
+
+// Publish implements EventSink
+func (cs *ChannelSink) Publish(ctx context.Context, event *Event) {
+	select {
+	case cs.C <- event:
+	default:
+		cs.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events dropped because C was full
+func (cs *ChannelSink) Dropped() int64 {
+	return cs.dropped.Load()
+}
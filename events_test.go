@@ -0,0 +1,161 @@
+package ssp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http/httptest"
+	"testing"
+)
+
+func newEventsAPI(t *testing.T) (*SqrlSspAPI, *ChannelSink) {
+	api := newTestAPI(t)
+	sink := NewChannelSink(100)
+	api.Events = NewEventBus(sink)
+	return api, sink
+}
+
+// drain returns the types of all events published so far
+func drain(sink *ChannelSink) []*Event {
+	var events []*Event
+	for {
+		select {
+		case event := <-sink.C:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func expectEvents(t *testing.T, sink *ChannelSink, expected ...EventType) []*Event {
+	t.Helper()
+	events := drain(sink)
+	if len(events) != len(expected) {
+		types := make([]EventType, len(events))
+		for i, event := range events {
+			types[i] = event.Type
+		}
+		t.Fatalf("Expected events %v, got %v", expected, types)
+	}
+	for i, event := range events {
+		if event.Type != expected[i] {
+			t.Errorf("Expected event %d to be %v, got %v", i, expected[i], event.Type)
+		}
+		if event.ID == "" || event.Time.IsZero() {
+			t.Errorf("Event %v missing ID or Time", event.Type)
+		}
+	}
+	return events
+}
+
+func TestEventsLogin(t *testing.T) {
+	api, sink := newEventsAPI(t)
+	client := newTestSqrlClient(t, api)
+	expectEvents(t, sink, EventNutIssued)
+
+	client.send("query")
+	events := expectEvents(t, sink, EventQueryReceived)
+	if events[0].Idk != client.idk() {
+		t.Errorf("Expected idk on query event, got %q", events[0].Idk)
+	}
+
+	client.send("ident")
+	expectEvents(t, sink, EventIdentityCreated, EventIdentAuthenticated)
+
+	client.newNut()
+	client.send("query")
+	client.send("ident")
+	expectEvents(t, sink, EventNutIssued, EventQueryReceived, EventIdentAuthenticated)
+}
+
+func TestEventsDisableAndBadUnlock(t *testing.T) {
+	api, sink := newEventsAPI(t)
+	client := newTestSqrlClient(t, api)
+	_, unlock, _ := ed25519.GenerateKey(nil)
+	vuk := Sqrl64.EncodeToString(unlock.Public().(ed25519.PublicKey))
+	client.send("query")
+	client.send("ident", func(cb *ClientBody) { cb.Vuk = vuk; cb.Suk = "suk" })
+	drain(sink)
+
+	client.send("disable")
+	expectEvents(t, sink, EventIdentityDisabled)
+
+	// enable and remove need an unlock request signature which the test
+	// client can't make; a bad one is a validation failure
+	client.send("enable")
+	events := expectEvents(t, sink, EventValidationFailed)
+	if events[0].Reason != ReasonInvalidUnlock {
+		t.Errorf("Expected invalid unlock reason, got %q", events[0].Reason)
+	}
+}
+
+func TestEventsRekey(t *testing.T) {
+	api, sink := newEventsAPI(t)
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+	previousIdk := client.idk()
+
+	client.previous = client.key
+	client.key = newTestKey(t)
+	client.newNut()
+	client.send("query")
+	client.send("ident")
+	events := expectEvents(t, sink, EventNutIssued, EventQueryReceived, EventIdentityCreated, EventIdentAuthenticated,
+		EventNutIssued, EventQueryReceived, EventIdentityRekeyed, EventIdentAuthenticated)
+	if events[6].PreviousIdk != previousIdk || events[6].Idk != client.idk() {
+		t.Errorf("Wrong rekey event: %+v", events[6])
+	}
+}
+
+func TestEventsNotPublishedOnRollback(t *testing.T) {
+	api, sink := newEventsAPI(t)
+	client := newTestSqrlClient(t, api)
+	api.hoard = &flakyHoard{ContextHoard: api.hoard, failNut: client.pag}
+
+	client.send("query")
+	client.send("ident")
+	expectEvents(t, sink, EventNutIssued, EventQueryReceived)
+}
+
+func TestEventsValidationFailed(t *testing.T) {
+	api, sink := newEventsAPI(t)
+	client := newTestSqrlClient(t, api)
+	original := client.nut
+	client.send("query")
+	drain(sink)
+
+	client.nut = original
+	client.send("query")
+	events := expectEvents(t, sink, EventValidationFailed)
+	if events[0].Reason != ReasonUnknownNut {
+		t.Errorf("Expected unknown nut reason, got %q", events[0].Reason)
+	}
+
+	client.newNut()
+	drain(sink)
+	client.remoteAddr = "203.0.113.50:1"
+	client.send("query")
+	events = expectEvents(t, sink, EventValidationFailed)
+	if events[0].Reason != ReasonIPMismatch || events[0].RemoteIP != "203.0.113.50" {
+		t.Errorf("Wrong validation event: %+v", events[0])
+	}
+
+	w := httptest.NewRecorder()
+	api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl?nut=abc", nil))
+	events = expectEvents(t, sink, EventValidationFailed)
+	if events[0].Reason != ReasonMalformedRequest {
+		t.Errorf("Expected malformed request reason, got %q", events[0].Reason)
+	}
+}
+
+func TestChannelSinkDrops(t *testing.T) {
+	sink := NewChannelSink(1)
+	bus := NewEventBus()
+	bus.Subscribe(sink)
+	bus.Publish(context.Background(), &Event{Type: EventNutIssued})
+	bus.Publish(context.Background(), &Event{Type: EventNutIssued})
+	if sink.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", sink.Dropped())
+	}
+}
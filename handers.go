@@ -1,11 +1,12 @@
 package ssp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	qrcode "github.com/skip2/go-qrcode"
 )
@@ -19,9 +20,14 @@ type nutJSON struct {
 // Nut implements the /nut.sqrl endpoint
 // TODO sin, ask and 1-9 params
 func (api *SqrlSspAPI) Nut(w http.ResponseWriter, r *http.Request) {
+	w, observe := api.observeEndpoint(w, "nut")
+	defer observe()
+	if !api.allowRemoteIP(w, r, api.RateLimits.Nut, "nut") {
+		return
+	}
 	hoardCache, err := api.createAndSaveNut(r)
 	if err != nil {
-		log.Print(err)
+		api.log().Error("create_nut", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -35,7 +41,7 @@ func (api *SqrlSspAPI) Nut(w http.ResponseWriter, r *http.Request) {
 		}
 		enc, err := json.Marshal(respObj)
 		if err != nil {
-			SafeLogError("json_encode_nut", err)
+			api.log().Error("json_encode_nut", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -54,11 +60,12 @@ func (api *SqrlSspAPI) Nut(w http.ResponseWriter, r *http.Request) {
 
 	_, err = w.Write([]byte(values.Encode()))
 	if err != nil {
-		SafeLogError("nut_response_write", err)
+		api.log().Error("nut_response_write", err)
 	}
 }
 
 func (api *SqrlSspAPI) createAndSaveNut(r *http.Request) (*HoardCache, error) {
+	ctx := r.Context()
 	nut, err := api.tree.Nut()
 	if err != nil {
 		return nil, fmt.Errorf("Failed generating nut: %v", err)
@@ -68,24 +75,44 @@ func (api *SqrlSspAPI) createAndSaveNut(r *http.Request) (*HoardCache, error) {
 		return nil, fmt.Errorf("Failed generating nut: %v", err)
 	}
 
+	transitions, err := (*HoardCache)(nil).transition(NutIssued)
+	if err != nil {
+		return nil, err
+	}
 	hoardCache := &HoardCache{
-		State:       "issued",
+		State:       NutIssued,
 		RemoteIP:    api.RemoteIP(r),
 		OriginalNut: nut,
 		PagNut:      pagnut,
+		Transitions: transitions,
 	}
 	// store the nut in the hoard
-	err = api.hoard.Save(nut, hoardCache, api.NutExpiration)
+	err = api.nutHoard().Save(ctx, nut, hoardCache, api.NutExpiration)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to save a nut: %v", err)
 	}
 	// SECURITY: Sanitize nut and mask IP to prevent log injection
-	SafeLogInfo("Saved nut %s in hoard from %s", sanitizeForLog(string(nut)), maskIP(hoardCache.RemoteIP))
+	api.log().Info("Saved nut in hoard", "nut", string(nut), "ip", MaskedIP(hoardCache.RemoteIP))
+	api.nutTransitioned("", NutIssued, nil)
+	api.publish(ctx, &Event{
+		Type:       EventNutIssued,
+		Nut:        nut,
+		RemoteIP:   hoardCache.RemoteIP,
+		NutState:   NutIssued,
+		Transition: &transitions[0],
+	})
 	return hoardCache, nil
 }
 
-func (api *SqrlSspAPI) getAndDelete(nut Nut) (*HoardCache, error) {
-	hoardCache, err := api.hoard.GetAndDelete(Nut(nut))
+// validNut checks a nut taken from a URL only has characters of the
+// Sqrl64 alphabet the Tree issues nuts in, so it can't reach the other
+// records saved in the Hoard
+func validNut(nut Nut) bool {
+	return nut != "" && isSqrl64(string(nut))
+}
+
+func (api *SqrlSspAPI) getAndDelete(ctx context.Context, nut Nut) (*HoardCache, error) {
+	hoardCache, err := api.nutHoard().GetAndDelete(ctx, nut)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +121,17 @@ func (api *SqrlSspAPI) getAndDelete(nut Nut) (*HoardCache, error) {
 
 // PNG implements the /png.sqrl endpoint
 func (api *SqrlSspAPI) PNG(w http.ResponseWriter, r *http.Request) {
+	w, observe := api.observeEndpoint(w, "png")
+	defer observe()
+	if !api.allowRemoteIP(w, r, api.RateLimits.PNG, "png") {
+		return
+	}
 	nut := r.URL.Query().Get("nut")
+	if nut != "" && !validNut(Nut(nut)) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Invalid nut"))
+		return
+	}
 	var hoardCache *HoardCache
 	var err error
 	if nut == "" {
@@ -140,6 +177,11 @@ type pagJSON struct {
 
 // Pag implements the /pag.sqrl endpoint
 func (api *SqrlSspAPI) Pag(w http.ResponseWriter, r *http.Request) {
+	w, observe := api.observeEndpoint(w, "pag")
+	defer observe()
+	if !api.allowRemoteIP(w, r, api.RateLimits.Pag, "pag") {
+		return
+	}
 	nut := r.URL.Query().Get("nut")
 	if nut == "" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -152,40 +194,48 @@ func (api *SqrlSspAPI) Pag(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("Missing required pag parameter"))
 		return
 	}
+	if !validNut(Nut(nut)) || !validNut(Nut(pagnut)) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Invalid nut"))
+		return
+	}
+
+	if api.PagWait > 0 && acceptsEventStream(r) {
+		api.pagEvents(w, r, Nut(nut), Nut(pagnut))
+		return
+	}
 
-	hoardCache, err := api.getAndDelete(Nut(pagnut))
+	wait := api.pagWait(api.PagWait)
+	if wait > 0 {
+		// leave room to answer within the server's WriteTimeout
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 5*time.Second))
+	}
+	hoardCache, err := api.waitForPag(r.Context(), Nut(pagnut), wait)
 	if err != nil {
 		if err == ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		SafeLogError("pag_nut_lookup", err)
+		api.log().Error("pag_nut_lookup", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("Failed nut lookup"))
 		return
 	}
 
-	if hoardCache.OriginalNut != Nut(nut) {
-		log.Print("Got query for pagnut but original nut doesn't match")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	if hoardCache.Identity == nil {
-		log.Print("Nil identity on pag hoardCache")
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte("Missing identity"))
+	redirect, status := api.pagRedirect(r.Context(), hoardCache, Nut(nut))
+	if status != http.StatusOK {
+		w.WriteHeader(status)
 		return
 	}
 
 	if r.Header.Get("Accept") == "application/json" {
 		w.Header().Add("Content-Type", "application/json")
 		respObj := &pagJSON{
-			URL: api.Authenticator.AuthenticateIdentity(hoardCache.Identity),
+			URL: redirect,
 		}
 		enc, err := json.Marshal(respObj)
 		if err != nil {
-			SafeLogError("json_encode_pag", err)
+			api.log().Error("json_encode_pag", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -193,5 +243,35 @@ func (api *SqrlSspAPI) Pag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, _ = w.Write([]byte(api.Authenticator.AuthenticateIdentity(hoardCache.Identity)))
+	_, _ = w.Write([]byte(redirect))
+}
+
+// pagRedirect checks a pag nut taken from the Hoard belongs to nut and
+// returns the Authenticator's redirect, or the HTTP status to fail with
+func (api *SqrlSspAPI) pagRedirect(ctx context.Context, hoardCache *HoardCache, nut Nut) (string, int) {
+	if hoardCache.OriginalNut != nut {
+		api.log().Info("Got query for pagnut but original nut doesn't match")
+		return "", http.StatusUnauthorized
+	}
+
+	// only a pag nut saved by a successful ident can be redeemed
+	_, err := hoardCache.transition(NutRedeemed)
+	api.nutTransitioned(hoardCache.State, NutRedeemed, err)
+	if err != nil {
+		api.log().Info("Rejecting pag nut", "error", err)
+		api.validationFailed(ctx, nil, hoardCache, ReasonNutState)
+		return "", http.StatusNotFound
+	}
+
+	if hoardCache.Identity == nil {
+		api.log().ErrorMsg("pag_identity", "nil identity on pag hoardCache")
+		return "", http.StatusInternalServerError
+	}
+
+	redirect, err := api.authenticator().AuthenticateIdentity(ctx, hoardCache.Identity)
+	if err != nil {
+		api.log().Error("pag_authenticate", err)
+		return "", http.StatusInternalServerError
+	}
+	return redirect, http.StatusOK
 }
@@ -0,0 +1,97 @@
+package ssp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Middleware wraps an http.Handler, for example to add headers or refuse
+// requests before they reach the SQRL endpoints
+type Middleware func(http.Handler) http.Handler
+
+// Handler returns an http.Handler serving the SQRL endpoints under
+// RootPath, which is read when Handler is called: GET /nut.sqrl,
+// /png.sqrl, /pag.sqrl and /status.sqrl, and POST /cli.sqrl. GET also
+// answers HEAD. Other methods get 405 Method Not Allowed. middleware is
+// applied in order, the first being outermost.
+func (api *SqrlSspAPI) Handler(middleware ...Middleware) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+api.RootPath+"/nut.sqrl", api.Nut)
+	mux.HandleFunc("GET "+api.RootPath+"/png.sqrl", api.PNG)
+	mux.HandleFunc("GET "+api.RootPath+"/pag.sqrl", api.Pag)
+	mux.HandleFunc("GET "+api.RootPath+"/status.sqrl", api.Status)
+	mux.HandleFunc("POST "+api.RootPath+"/cli.sqrl", api.Cli)
+	return Chain(mux, middleware...)
+}
+
+// Chain wraps handler in middleware, the first being outermost
+func Chain(handler http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// SecurityHeaders is a Middleware stopping responses from being sniffed,
+// framed or cached. Nuts are single use so there's nothing to cache.
+func SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMaxAge is how long browsers may cache a CORS preflight, in seconds
+const corsMaxAge = 600
+
+// CORS returns a Middleware letting pages on origins, such as
+// "https://example.com", call the endpoints from JavaScript and read the
+// Sqrl-Nut, Sqrl-Pag and Sqrl-Exp headers of /png.sqrl. "*" allows any
+// origin. Preflight requests from other origins are passed on and get 405.
+func CORS(origins ...string) Middleware {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			header := w.Header()
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Set("Access-Control-Expose-Headers", "Sqrl-Nut, Sqrl-Pag, Sqrl-Exp")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				header.Set("Access-Control-Allow-Methods", "GET, POST")
+				header.Set("Access-Control-Allow-Headers", "Accept, Content-Type")
+				header.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimit returns a Middleware limiting every request by client IP
+// (see RemoteIP) with limiter, answering 429 Too Many Requests. It's on
+// top of the per endpoint RateLimits.
+func (api *SqrlSspAPI) RateLimit(limiter RateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !api.allowRemoteIP(w, r, limiter, "http") {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
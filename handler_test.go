@@ -0,0 +1,113 @@
+package ssp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerRoutes(t *testing.T) {
+	api := newTestAPI(t)
+	api.RootPath = "/sqrl"
+	handler := api.Handler()
+
+	cases := []struct {
+		method, target string
+		code           int
+		allow          string
+	}{
+		{"GET", "/sqrl/nut.sqrl", http.StatusOK, ""},
+		{"HEAD", "/sqrl/nut.sqrl", http.StatusOK, ""},
+		{"GET", "/sqrl/png.sqrl", http.StatusOK, ""},
+		{"GET", "/sqrl/pag.sqrl?nut=a&pag=b", http.StatusNotFound, ""},
+		{"POST", "/sqrl/cli.sqrl", http.StatusOK, ""},
+		{"POST", "/sqrl/nut.sqrl", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"DELETE", "/sqrl/pag.sqrl", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"GET", "/sqrl/cli.sqrl", http.StatusMethodNotAllowed, "POST"},
+		// not where the SQRL URLs point
+		{"GET", "/nut.sqrl", http.StatusNotFound, ""},
+		{"GET", "/sqrl/other", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(c.method, c.target, nil))
+		if w.Code != c.code {
+			t.Errorf("%v %v: expected %d, got %d", c.method, c.target, c.code, w.Code)
+		}
+		if c.allow != "" && w.Header().Get("Allow") != c.allow {
+			t.Errorf("%v %v: expected Allow %q, got %q", c.method, c.target, c.allow, w.Header().Get("Allow"))
+		}
+	}
+
+	// the qry handed to the client is served by the handler
+	client := newTestSqrlClient(t, api)
+	resp := client.send("query")
+	if !strings.HasPrefix(resp.Qry, "/sqrl/cli.sqrl?") {
+		t.Errorf("Unexpected qry %q", resp.Qry)
+	}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	api := newTestAPI(t)
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	w := httptest.NewRecorder()
+	api.Handler(record("first"), SecurityHeaders, record("second")).ServeHTTP(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+	if strings.Join(order, ",") != "first,second" {
+		t.Errorf("Expected middleware in order, got %v", order)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected security headers, got %v", w.Header())
+	}
+}
+
+func TestCORS(t *testing.T) {
+	api := newTestAPI(t)
+	handler := api.Handler(CORS("https://app.example/"))
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", "/pag.sqrl", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	w := preflight("https://app.example")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "GET, POST" {
+		t.Errorf("Expected preflight allowed, got %d %v", w.Code, w.Header())
+	}
+	w = preflight("https://evil.example")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected preflight refused, got %d %v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest("GET", "/png.sqrl", nil)
+	r.Header.Set("Origin", "https://app.example")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "Sqrl-Pag") {
+		t.Errorf("Expected CORS headers on the response, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	api := newTestAPI(t)
+	handler := api.Handler(api.RateLimit(NewTokenBucketLimiter(0, 1)))
+	for _, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+		if w.Code != expected {
+			t.Errorf("Expected %d, got %d", expected, w.Code)
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package ssp
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"sort"
 	"sync"
 )
 
@@ -10,19 +11,24 @@ import (
 // Great for testing but you should probably use some database
 // to store these in a production environment.
 type MapAuthStore struct {
-	store *sync.Map
+	store  *sync.Map
+	mutex  *sync.Mutex
+	rekeys []*Rekey
 }
 
 // NewMapAuthStore inits the internal map
 func NewMapAuthStore() *MapAuthStore {
-	return &MapAuthStore{&sync.Map{}}
+	return &MapAuthStore{
+		store: &sync.Map{},
+		mutex: &sync.Mutex{},
+	}
 }
 
 // FindIdentity implements AuthStore
 func (m *MapAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
 	if knownUser, ok := m.store.Load(idk); ok {
-		log.Printf("Found existing identity: %#v", knownUser)
 		if identity, ok := knownUser.(*SqrlIdentity); ok {
+			SafeLogIdentity(identity)
 			return identity, nil
 		}
 		return nil, fmt.Errorf("Wrong type for identity %t", knownUser)
@@ -32,6 +38,9 @@ func (m *MapAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
 
 // SaveIdentity implements AuthStore
 func (m *MapAuthStore) SaveIdentity(identity *SqrlIdentity) error {
+	if identity == nil || identity.Idk == "" {
+		return fmt.Errorf("identity requires an idk")
+	}
 	m.store.Store(identity.Idk, identity)
 	return nil
 }
@@ -41,3 +50,44 @@ func (m *MapAuthStore) DeleteIdentity(idk string) error {
 	m.store.Delete(idk)
 	return nil
 }
+
+// ListIdentities implements IdentityLister
+func (m *MapAuthStore) ListIdentities(ctx context.Context, after string, limit int) ([]*SqrlIdentity, error) {
+	var identities []*SqrlIdentity
+	m.store.Range(func(key, value interface{}) bool {
+		if identity, ok := value.(*SqrlIdentity); ok && identity.Idk > after {
+			identities = append(identities, identity)
+		}
+		return true
+	})
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].Idk < identities[j].Idk
+	})
+	if limit > 0 && len(identities) > limit {
+		identities = identities[:limit]
+	}
+	return identities, nil
+}
+
+// SaveRekey implements RekeyStore
+func (m *MapAuthStore) SaveRekey(ctx context.Context, rekey *Rekey) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	saved := *rekey
+	m.rekeys = append(m.rekeys, &saved)
+	return nil
+}
+
+// FindRekeys implements RekeyStore
+func (m *MapAuthStore) FindRekeys(ctx context.Context, idk string) ([]*Rekey, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var rekeys []*Rekey
+	for _, rekey := range m.rekeys {
+		if rekey.PreviousIdk == idk || rekey.Idk == idk {
+			found := *rekey
+			rekeys = append(rekeys, &found)
+		}
+	}
+	return rekeys, nil
+}
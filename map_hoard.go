@@ -1,8 +1,10 @@
 package ssp
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,15 +19,18 @@ func (ve valExpire) Expired() bool {
 
 // MapHoard implements a Hoard that is backed by an in-memory map
 type MapHoard struct {
-	cache map[Nut]*valExpire
-	mutex *sync.Mutex
+	cache       map[Nut]*valExpire
+	mutex       *sync.Mutex
+	expired     atomic.Int64
+	subscribers *NutSubscribers
 }
 
 // NewMapHoard creates a new MapHoard
 func NewMapHoard() *MapHoard {
 	mh := &MapHoard{
-		cache: make(map[Nut]*valExpire),
-		mutex: &sync.Mutex{},
+		cache:       make(map[Nut]*valExpire),
+		mutex:       &sync.Mutex{},
+		subscribers: NewNutSubscribers(),
 	}
 	go mh.cleaner()
 	return mh
@@ -43,6 +48,7 @@ func (mh *MapHoard) cleaner() {
 					v.value.Clear()
 				}
 				delete(mh.cache, k)
+				mh.expired.Add(1)
 			}
 			i++
 			// check for going over time
@@ -69,6 +75,7 @@ func (mh *MapHoard) Get(nut Nut) (*HoardCache, error) {
 			value.value.Clear()
 		}
 		delete(mh.cache, nut)
+		mh.expired.Add(1)
 	}
 	return nil, ErrNotFound
 }
@@ -86,6 +93,7 @@ func (mh *MapHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
 		if value.value != nil {
 			value.value.Clear()
 		}
+		mh.expired.Add(1)
 	}
 	return nil, ErrNotFound
 }
@@ -95,11 +103,49 @@ func (mh *MapHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) e
 	if nut == "" {
 		return fmt.Errorf("empty nuts are not allowed")
 	}
+	if value == nil {
+		return fmt.Errorf("nil values are not allowed")
+	}
 	mh.mutex.Lock()
-	defer mh.mutex.Unlock()
 	mh.cache[nut] = &valExpire{
 		value:      value,
 		expiration: time.Now().Add(expiration),
 	}
+	mh.mutex.Unlock()
+	mh.subscribers.Notify(nut)
 	return nil
 }
+
+// Subscribe implements HoardNotifier
+func (mh *MapHoard) Subscribe(ctx context.Context, nut Nut) (<-chan struct{}, func(), error) {
+	saved, cancel := mh.subscribers.Subscribe(nut)
+	return saved, cancel, nil
+}
+
+// PurgeNuts implements NutPurger
+func (mh *MapHoard) PurgeNuts(ctx context.Context, idk string) (int, error) {
+	mh.mutex.Lock()
+	defer mh.mutex.Unlock()
+	purged := 0
+	for nut, value := range mh.cache {
+		if value.value.ForIdentity(idk) {
+			value.value.Clear()
+			delete(mh.cache, nut)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Len returns the number of nuts held, including expired nuts not yet
+// cleaned up
+func (mh *MapHoard) Len() int {
+	mh.mutex.Lock()
+	defer mh.mutex.Unlock()
+	return len(mh.cache)
+}
+
+// Expirations returns the number of nuts removed after expiring
+func (mh *MapHoard) Expirations() int64 {
+	return mh.expired.Load()
+}
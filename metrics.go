@@ -0,0 +1,396 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets used for latencies, in seconds
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects counters and latency histograms for the SSP endpoints
+// and storage calls. It's an http.Handler serving them in the Prometheus
+// text exposition format, typically at /metrics.
+//
+// Set SqrlSspAPI.Metrics to record requests, commands, TIF bits and
+// Hoard/AuthStore operations. CollectMapHoard and CollectRandomTree add
+// the state of those implementations.
+type Metrics struct {
+	mutex    *sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*metricSeries
+	// for values read at scrape time
+	collect func() float64
+}
+
+type metricSeries struct {
+	labels  string
+	value   float64
+	sum     float64
+	count   uint64
+	buckets []uint64
+}
+
+// NewMetrics creates an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		mutex:    &sync.Mutex{},
+		families: make(map[string]*metricFamily),
+	}
+}
+
+func (m *Metrics) family(name, help, kind string) *metricFamily {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: kind, series: make(map[string]*metricSeries)}
+		if kind == "histogram" {
+			f.buckets = DefaultBuckets
+		}
+		m.families[name] = f
+	}
+	return f
+}
+
+func (f *metricFamily) get(labels []string) *metricSeries {
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: key}
+		if f.buckets != nil {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Inc increments a counter. labels are name, value pairs.
+func (m *Metrics) Inc(name, help string, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.family(name, help, "counter").get(labels).value++
+}
+
+// Observe records a value, usually seconds, in a histogram. labels are
+// name, value pairs.
+func (m *Metrics) Observe(name, help string, value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f := m.family(name, help, "histogram")
+	s := f.get(labels)
+	s.count++
+	s.sum += value
+	for i, bound := range f.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+}
+
+// GaugeFunc registers a gauge read from fn at scrape time
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) {
+	m.registerFunc(name, help, "gauge", fn)
+}
+
+// CounterFunc registers a counter read from fn at scrape time
+func (m *Metrics) CounterFunc(name, help string, fn func() float64) {
+	m.registerFunc(name, help, "counter", fn)
+}
+
+func (m *Metrics) registerFunc(name, help, kind string, fn func() float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f := m.family(name, help, kind)
+	f.collect = fn
+}
+
+// CollectMapHoard reports the number of entries and expirations of mh
+func (m *Metrics) CollectMapHoard(mh *MapHoard) {
+	m.GaugeFunc("sqrl_map_hoard_entries", "Nuts currently held by the MapHoard.", func() float64 {
+		return float64(mh.Len())
+	})
+	m.CounterFunc("sqrl_map_hoard_expirations_total", "Nuts removed from the MapHoard after expiring.", func() float64 {
+		return float64(mh.Expirations())
+	})
+}
+
+// CollectRandomTree reports the buffer depth and timeouts of rt
+func (m *Metrics) CollectRandomTree(rt *RandomTree) {
+	m.GaugeFunc("sqrl_random_tree_buffered", "Random nuts buffered and ready to issue.", func() float64 {
+		return float64(rt.Buffered())
+	})
+	m.CounterFunc("sqrl_random_tree_timeouts_total", "Nut requests that timed out waiting for randomness.", func() float64 {
+		return float64(rt.Timeouts())
+	})
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(m.String()))
+}
+
+// String returns all metrics in the Prometheus text exposition format
+func (m *Metrics) String() string {
+	m.mutex.Lock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, f := range m.families {
+		families = append(families, f)
+	}
+	m.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		// collect outside the lock; collectors take their own locks
+		var collected float64
+		if f.collect != nil {
+			collected = f.collect()
+		}
+		m.mutex.Lock()
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+		if f.collect != nil {
+			fmt.Fprintf(&b, "%s %s\n", f.name, formatFloat(collected))
+		}
+		series := make([]*metricSeries, 0, len(f.series))
+		for _, s := range f.series {
+			series = append(series, s)
+		}
+		sort.Slice(series, func(i, j int) bool { return series[i].labels < series[j].labels })
+		for _, s := range series {
+			if f.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, braces(s.labels), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range f.buckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="`+formatFloat(bound)+`"`)), s.buckets[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, braces(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, braces(s.labels), s.count)
+		}
+		m.mutex.Unlock()
+	}
+	return b.String()
+}
+
+// formatLabels turns name, value pairs into name="value",... with values
+// escaped
+func formatLabels(labels []string) string {
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.code == 0 {
+		sr.code = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.code == 0 {
+		sr.code = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// observeEndpoint wraps w to record the status code and returns a func
+// that records the request when the handler is done
+func (api *SqrlSspAPI) observeEndpoint(w http.ResponseWriter, endpoint string) (http.ResponseWriter, func()) {
+	if api.Metrics == nil {
+		return w, func() {}
+	}
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w}
+	return recorder, func() {
+		code := recorder.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		api.Metrics.Inc("sqrl_http_requests_total", "HTTP requests by endpoint and status code.",
+			"endpoint", endpoint, "code", strconv.Itoa(code))
+		api.Metrics.Observe("sqrl_http_request_duration_seconds", "HTTP request latency by endpoint.",
+			time.Since(start).Seconds(), "endpoint", endpoint)
+	}
+}
+
+// observeCli records the command and the TIF bits of a /cli.sqrl response
+func (api *SqrlSspAPI) observeCli(start time.Time, req *CliRequest, response *CliResponse) {
+	if api.Metrics == nil {
+		return
+	}
+	cmd := "none"
+	if req != nil && req.Client != nil {
+		cmd = "unknown"
+		if supportedCommands[req.Client.Cmd] {
+			cmd = req.Client.Cmd
+		}
+	}
+	api.Metrics.Inc("sqrl_cli_commands_total", "SQRL client commands received.", "cmd", cmd)
+	api.Metrics.Observe("sqrl_cli_command_duration_seconds", "SQRL client command latency.",
+		time.Since(start).Seconds(), "cmd", cmd)
+	if response == nil {
+		return
+	}
+	for bit, desc := range TIFDesc {
+		if response.TIF&bit != 0 {
+			api.Metrics.Inc("sqrl_cli_tif_total", "SQRL client responses by TIF bit set.",
+				"bit", fmt.Sprintf("0x%x", bit), "desc", desc)
+		}
+	}
+}
+
+// observeStorage records the latency of a storage call and whether it
+// failed. ErrNotFound isn't a failure.
+func (m *Metrics) observeStorage(store, op string, start time.Time, err error) {
+	m.Observe("sqrl_storage_operation_duration_seconds", "Hoard and AuthStore operation latency.",
+		time.Since(start).Seconds(), "store", store, "op", op)
+	if err != nil && err != ErrNotFound {
+		m.Inc("sqrl_storage_errors_total", "Hoard and AuthStore operations that failed.", "store", store, "op", op)
+	}
+}
+
+// nutHoard returns the Hoard, instrumented if Metrics is set
+func (api *SqrlSspAPI) nutHoard() ContextHoard {
+	if api.Metrics == nil {
+		return api.hoard
+	}
+	return &instrumentedHoard{api.hoard, api.Metrics}
+}
+
+// identityStore returns the AuthStore, instrumented if Metrics is set
+func (api *SqrlSspAPI) identityStore() ContextAuthStore {
+	if api.Metrics == nil {
+		return api.authStore
+	}
+	return &instrumentedAuthStore{api.authStore, api.Metrics}
+}
+
+type instrumentedHoard struct {
+	hoard ContextHoard
+	m     *Metrics
+}
+
+func (ih *instrumentedHoard) Get(ctx context.Context, nut Nut) (*HoardCache, error) {
+	start := time.Now()
+	value, err := ih.hoard.Get(ctx, nut)
+	ih.m.observeStorage("hoard", "get", start, err)
+	return value, err
+}
+
+func (ih *instrumentedHoard) GetAndDelete(ctx context.Context, nut Nut) (*HoardCache, error) {
+	start := time.Now()
+	value, err := ih.hoard.GetAndDelete(ctx, nut)
+	ih.m.observeStorage("hoard", "get_and_delete", start, err)
+	return value, err
+}
+
+func (ih *instrumentedHoard) Save(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	start := time.Now()
+	err := ih.hoard.Save(ctx, nut, value, expiration)
+	ih.m.observeStorage("hoard", "save", start, err)
+	return err
+}
+
+type instrumentedAuthStore struct {
+	store ContextAuthStore
+	m     *Metrics
+}
+
+func (is *instrumentedAuthStore) FindIdentity(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	start := time.Now()
+	identity, err := is.store.FindIdentity(ctx, idk)
+	is.m.observeStorage("auth_store", "find_identity", start, err)
+	return identity, err
+}
+
+func (is *instrumentedAuthStore) SaveIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	start := time.Now()
+	err := is.store.SaveIdentity(ctx, identity)
+	is.m.observeStorage("auth_store", "save_identity", start, err)
+	return err
+}
+
+func (is *instrumentedAuthStore) DeleteIdentity(ctx context.Context, idk string) error {
+	start := time.Now()
+	err := is.store.DeleteIdentity(ctx, idk)
+	is.m.observeStorage("auth_store", "delete_identity", start, err)
+	return err
+}
+
+type instrumentedTx struct {
+	instrumentedAuthStore
+	tx AuthStoreTx
+}
+
+func (it *instrumentedTx) Commit() error {
+	start := time.Now()
+	err := it.tx.Commit()
+	it.m.observeStorage("auth_store", "commit", start, err)
+	return err
+}
+
+func (it *instrumentedTx) Rollback() error {
+	start := time.Now()
+	err := it.tx.Rollback()
+	it.m.observeStorage("auth_store", "rollback", start, err)
+	return err
+}
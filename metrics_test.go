@@ -0,0 +1,127 @@
+package ssp
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Wrong content type %q", ct)
+	}
+	body, _ := io.ReadAll(w.Result().Body)
+	return string(body)
+}
+
+func expectMetric(t *testing.T, body, line string) {
+	t.Helper()
+	for _, l := range strings.Split(body, "\n") {
+		if l == line {
+			return
+		}
+	}
+	t.Errorf("Expected metric line %q in:\n%s", line, body)
+}
+
+func TestMetricsFormat(t *testing.T) {
+	m := NewMetrics()
+	m.Inc("test_total", "A test counter.", "label", `quote"and\\slash`)
+	m.Inc("test_total", "A test counter.", "label", `quote"and\\slash`)
+	m.Observe("test_seconds", "A test histogram.", 0.003)
+	m.Observe("test_seconds", "A test histogram.", 20)
+	m.GaugeFunc("test_gauge", "A test gauge.", func() float64 { return 7 })
+
+	body := scrape(t, m)
+	expectMetric(t, body, "# HELP test_total A test counter.")
+	expectMetric(t, body, "# TYPE test_total counter")
+	expectMetric(t, body, `test_total{label="quote\"and\\\\slash"} 2`)
+	expectMetric(t, body, "# TYPE test_seconds histogram")
+	expectMetric(t, body, `test_seconds_bucket{le="0.0025"} 0`)
+	expectMetric(t, body, `test_seconds_bucket{le="0.005"} 1`)
+	expectMetric(t, body, `test_seconds_bucket{le="10"} 1`)
+	expectMetric(t, body, `test_seconds_bucket{le="+Inf"} 2`)
+	expectMetric(t, body, "test_seconds_sum 20.003")
+	expectMetric(t, body, "test_seconds_count 2")
+	expectMetric(t, body, "# TYPE test_gauge gauge")
+	expectMetric(t, body, "test_gauge 7")
+}
+
+func TestMetricsEndpoints(t *testing.T) {
+	api := newTestAPI(t)
+	api.Metrics = NewMetrics()
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	client.send("ident")
+	w := httptest.NewRecorder()
+	api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+	w = httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl", nil))
+
+	body := scrape(t, api.Metrics)
+	expectMetric(t, body, `sqrl_http_requests_total{endpoint="cli",code="200"} 2`)
+	expectMetric(t, body, `sqrl_http_requests_total{endpoint="nut",code="200"} 1`)
+	expectMetric(t, body, `sqrl_http_requests_total{endpoint="pag",code="400"} 1`)
+	expectMetric(t, body, `sqrl_http_request_duration_seconds_count{endpoint="cli"} 2`)
+	expectMetric(t, body, `sqrl_cli_commands_total{cmd="query"} 1`)
+	expectMetric(t, body, `sqrl_cli_commands_total{cmd="ident"} 1`)
+	expectMetric(t, body, `sqrl_cli_command_duration_seconds_count{cmd="ident"} 1`)
+	expectMetric(t, body, `sqrl_cli_tif_total{bit="0x4",desc="IP Matched"} 2`)
+	expectMetric(t, body, `sqrl_cli_tif_total{bit="0x1",desc="ID Matched"} 1`)
+	expectMetric(t, body, `sqrl_storage_operation_duration_seconds_count{store="hoard",op="get_and_delete"} 2`)
+	expectMetric(t, body, `sqrl_storage_operation_duration_seconds_count{store="auth_store",op="save_identity"} 1`)
+}
+
+func TestMetricsCliFailures(t *testing.T) {
+	api := newTestAPI(t)
+	api.Metrics = NewMetrics()
+
+	w := httptest.NewRecorder()
+	api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl", nil))
+	w = httptest.NewRecorder()
+	api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl?nut=abc", nil))
+
+	body := scrape(t, api.Metrics)
+	expectMetric(t, body, `sqrl_cli_commands_total{cmd="none"} 2`)
+	expectMetric(t, body, `sqrl_cli_tif_total{bit="0x80",desc="Bad client request"} 2`)
+	expectMetric(t, body, `sqrl_cli_tif_total{bit="0x40",desc="Command failed"} 1`)
+}
+
+func TestMetricsStorageErrors(t *testing.T) {
+	api := newTestAPI(t)
+	api.Metrics = NewMetrics()
+	client := newTestSqrlClient(t, api)
+	api.hoard = &flakyHoard{ContextHoard: api.hoard, failNut: client.pag}
+
+	client.send("query")
+	client.send("ident")
+	body := scrape(t, api.Metrics)
+	expectMetric(t, body, `sqrl_storage_errors_total{store="hoard",op="save"} 1`)
+	expectMetric(t, body, `sqrl_cli_tif_total{bit="0x20",desc="Server Error"} 1`)
+}
+
+func TestMetricsCollectors(t *testing.T) {
+	m := NewMetrics()
+	mh := NewMapHoard()
+	_ = mh.Save("a", &HoardCache{}, time.Hour)
+	_ = mh.Save("b", &HoardCache{}, -time.Second)
+	_, _ = mh.Get("b")
+	m.CollectMapHoard(mh)
+
+	tree, _ := NewRandomTree(8)
+	m.CollectRandomTree(tree)
+
+	body := scrape(t, m)
+	expectMetric(t, body, "sqrl_map_hoard_entries 1")
+	expectMetric(t, body, "sqrl_map_hoard_expirations_total 1")
+	expectMetric(t, body, "sqrl_random_tree_timeouts_total 0")
+	if !strings.Contains(body, "sqrl_random_tree_buffered ") {
+		t.Error("Expected random tree buffer depth")
+	}
+}
@@ -0,0 +1,188 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// namespaceSeparator joins a namespace to a nut or idk. It's escaped in
+// the namespace, so the first one ends it and a namespaced key can't be
+// mistaken for another namespace's, whatever follows.
+const namespaceSeparator = ":"
+
+var namespaceEscaper = strings.NewReplacer("%", "%25", namespaceSeparator, "%3A")
+
+// namespacePrefix is what keys saved in namespace start with
+func namespacePrefix(namespace string) string {
+	return namespaceEscaper.Replace(namespace) + namespaceSeparator
+}
+
+// NamespaceHoard shares hoard between several SqrlSspAPIs. Nuts saved
+// through one namespace can't be found through another. A HoardNotifier
+// is passed through; NutPurger isn't, as it would purge every namespace.
+func NamespaceHoard(hoard ContextHoard, namespace string) ContextHoard {
+	return &namespacedHoard{hoard: hoard, namespace: namespace}
+}
+
+type namespacedHoard struct {
+	hoard     ContextHoard
+	namespace string
+}
+
+func (nh *namespacedHoard) key(nut Nut) Nut {
+	if nut == "" {
+		return ""
+	}
+	return Nut(namespacePrefix(nh.namespace)) + nut
+}
+
+// Get implements ContextHoard
+func (nh *namespacedHoard) Get(ctx context.Context, nut Nut) (*HoardCache, error) {
+	return nh.hoard.Get(ctx, nh.key(nut))
+}
+
+// GetAndDelete implements ContextHoard
+func (nh *namespacedHoard) GetAndDelete(ctx context.Context, nut Nut) (*HoardCache, error) {
+	return nh.hoard.GetAndDelete(ctx, nh.key(nut))
+}
+
+// Save implements ContextHoard
+func (nh *namespacedHoard) Save(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	return nh.hoard.Save(ctx, nh.key(nut), value, expiration)
+}
+
+type namespacedNotifier struct {
+	notifier HoardNotifier
+	hoard    *namespacedHoard
+}
+
+// Subscribe implements HoardNotifier
+func (nn *namespacedNotifier) Subscribe(ctx context.Context, nut Nut) (<-chan struct{}, func(), error) {
+	return nn.notifier.Subscribe(ctx, nn.hoard.key(nut))
+}
+
+// NamespaceAuthStore shares store between several SqrlSspAPIs. An identity
+// saved through one namespace can't be found through another, even though
+// a SQRL client presents the same idk to sites on the same host. TxAuthStore
+// and RekeyStore are passed through; IdentityLister isn't.
+func NamespaceAuthStore(store ContextAuthStore, namespace string) ContextAuthStore {
+	return &namespacedAuthStore{store: store, namespace: namespace}
+}
+
+type namespacedAuthStore struct {
+	store     ContextAuthStore
+	namespace string
+}
+
+func (ns *namespacedAuthStore) key(idk string) string {
+	if idk == "" {
+		return ""
+	}
+	return namespacePrefix(ns.namespace) + idk
+}
+
+func (ns *namespacedAuthStore) strip(idk string) string {
+	return strings.TrimPrefix(idk, namespacePrefix(ns.namespace))
+}
+
+// FindIdentity implements ContextAuthStore
+func (ns *namespacedAuthStore) FindIdentity(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	identity, err := ns.store.FindIdentity(ctx, ns.key(idk))
+	if err != nil {
+		return nil, err
+	}
+	identity = copyIdentity(identity)
+	identity.Idk = ns.strip(identity.Idk)
+	identity.Rekeyed = ns.strip(identity.Rekeyed)
+	return identity, nil
+}
+
+// SaveIdentity implements ContextAuthStore
+func (ns *namespacedAuthStore) SaveIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	if identity == nil {
+		return fmt.Errorf("identity requires an idk")
+	}
+	saved := copyIdentity(identity)
+	saved.Idk = ns.key(saved.Idk)
+	saved.Rekeyed = ns.key(saved.Rekeyed)
+	return ns.store.SaveIdentity(ctx, saved)
+}
+
+// DeleteIdentity implements ContextAuthStore
+func (ns *namespacedAuthStore) DeleteIdentity(ctx context.Context, idk string) error {
+	return ns.store.DeleteIdentity(ctx, ns.key(idk))
+}
+
+type namespacedTxStore struct {
+	txStore   TxAuthStore
+	namespace string
+}
+
+// BeginTx implements TxAuthStore
+func (nt *namespacedTxStore) BeginTx(ctx context.Context) (AuthStoreTx, error) {
+	tx, err := nt.txStore.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &namespacedTx{namespacedAuthStore{store: tx, namespace: nt.namespace}, tx}, nil
+}
+
+type namespacedTx struct {
+	namespacedAuthStore
+	tx AuthStoreTx
+}
+
+// Commit implements AuthStoreTx
+func (nt *namespacedTx) Commit() error {
+	return nt.tx.Commit()
+}
+
+// Rollback implements AuthStoreTx
+func (nt *namespacedTx) Rollback() error {
+	return nt.tx.Rollback()
+}
+
+type namespacedRekeys struct {
+	rekeys RekeyStore
+	store  *namespacedAuthStore
+}
+
+// SaveRekey implements RekeyStore
+func (nr *namespacedRekeys) SaveRekey(ctx context.Context, rekey *Rekey) error {
+	saved := *rekey
+	saved.PreviousIdk = nr.store.key(saved.PreviousIdk)
+	saved.Idk = nr.store.key(saved.Idk)
+	return nr.rekeys.SaveRekey(ctx, &saved)
+}
+
+// FindRekeys implements RekeyStore
+func (nr *namespacedRekeys) FindRekeys(ctx context.Context, idk string) ([]*Rekey, error) {
+	found, err := nr.rekeys.FindRekeys(ctx, nr.store.key(idk))
+	if err != nil {
+		return nil, err
+	}
+	rekeys := make([]*Rekey, len(found))
+	for i, rekey := range found {
+		stripped := *rekey
+		stripped.PreviousIdk = nr.store.strip(stripped.PreviousIdk)
+		stripped.Idk = nr.store.strip(stripped.Idk)
+		rekeys[i] = &stripped
+	}
+	return rekeys, nil
+}
+
+// txAuthStoreOf returns the TxAuthStore of store, looking through
+// NamespaceAuthStore
+func txAuthStoreOf(store interface{}) TxAuthStore {
+	if namespaced, ok := store.(*namespacedAuthStore); ok {
+		txStore := txAuthStoreOf(namespaced.store)
+		if txStore == nil {
+			return nil
+		}
+		return &namespacedTxStore{txStore, namespaced.namespace}
+	}
+	txStore, _ := store.(TxAuthStore)
+	return txStore
+}
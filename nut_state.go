@@ -0,0 +1,107 @@
+package ssp
+
+import (
+	"fmt"
+	"time"
+)
+
+// NutState is where a nut saved in the Hoard is in the login lifecycle
+type NutState string
+
+// Nut states. A nut is issued to the browser by /nut.sqrl or /png.sqrl,
+// each /cli.sqrl request trades it for an associated nut handed to the
+// SQRL client, and a successful ident saves the pag nut as authenticated
+// until /pag.sqrl redeems it.
+const (
+	NutIssued        NutState = "issued"
+	NutAssociated    NutState = "associated"
+	NutAuthenticated NutState = "authenticated"
+	// the pag nut was used to log in; never saved
+	NutRedeemed NutState = "redeemed"
+	// a record of how far a login has got, saved for the Status WebSocket
+	// next to the pag nut; it's never handed out and can't move on
+	NutStatus NutState = "status"
+)
+
+// nutTransitions lists the states each state may move to. A client may
+// send ident without a query first, so an issued nut can authenticate.
+var nutTransitions = map[NutState][]NutState{
+	"":               {NutIssued},
+	NutIssued:        {NutAssociated, NutAuthenticated},
+	NutAssociated:    {NutAssociated, NutAuthenticated},
+	NutAuthenticated: {NutRedeemed},
+}
+
+// ErrInvalidTransition is returned for a nut state change the lifecycle
+// doesn't allow
+var ErrInvalidTransition = fmt.Errorf("Invalid nut state transition")
+
+// CanTransition is true if a nut in state s may move to next. The empty
+// state is a nut that doesn't exist yet.
+func (s NutState) CanTransition(next NutState) bool {
+	for _, allowed := range nutTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// NutTransition is a change of NutState and when it happened
+type NutTransition struct {
+	From NutState  `json:"from"`
+	To   NutState  `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// transition checks the nut of hc, which may be nil for a new nut, can
+// move to next and returns its transitions with the move added
+func (hc *HoardCache) transition(next NutState) ([]NutTransition, error) {
+	var from NutState
+	var transitions []NutTransition
+	if hc != nil {
+		from = hc.State
+		transitions = hc.Transitions
+	}
+	if !from.CanTransition(next) {
+		return nil, fmt.Errorf("%w: %q to %q", ErrInvalidTransition, from, next)
+	}
+	moved := make([]NutTransition, len(transitions), len(transitions)+1)
+	copy(moved, transitions)
+	return append(moved, NutTransition{From: from, To: next, Time: time.Now()}), nil
+}
+
+// Since returns when the nut moved to its current state, or the zero time
+// for a nut saved without transitions
+func (hc *HoardCache) Since() time.Time {
+	if len(hc.Transitions) == 0 {
+		return time.Time{}
+	}
+	return hc.Transitions[len(hc.Transitions)-1].Time
+}
+
+// checkCliNut checks a nut taken from the Hoard by /cli.sqrl was handed
+// out for a SQRL client to use
+func checkCliNut(hoardCache *HoardCache) error {
+	if !hoardCache.State.CanTransition(NutAssociated) {
+		return fmt.Errorf("%w: %q nut used with /cli.sqrl", ErrInvalidTransition, hoardCache.State)
+	}
+	return nil
+}
+
+// nutTransitioned records a nut state change, or an attempted one that
+// was rejected, in Metrics
+func (api *SqrlSspAPI) nutTransitioned(from, to NutState, err error) {
+	if api.Metrics == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "rejected"
+	}
+	if from == "" {
+		from = "none"
+	}
+	api.Metrics.Inc("sqrl_nut_transitions_total", "Nut state transitions by result.",
+		"from", string(from), "to", string(to), "result", result)
+}
@@ -0,0 +1,160 @@
+package ssp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNutStateCanTransition(t *testing.T) {
+	cases := []struct {
+		from, to NutState
+		allowed  bool
+	}{
+		{"", NutIssued, true},
+		{"", NutAssociated, false},
+		{NutIssued, NutAssociated, true},
+		{NutIssued, NutAuthenticated, true},
+		{NutIssued, NutRedeemed, false},
+		{NutAssociated, NutAssociated, true},
+		{NutAssociated, NutAuthenticated, true},
+		{NutAssociated, NutIssued, false},
+		{NutAuthenticated, NutRedeemed, true},
+		{NutAuthenticated, NutAssociated, false},
+		{NutRedeemed, NutIssued, false},
+		{"bogus", NutAssociated, false},
+		{NutStatus, NutAssociated, false},
+		{NutStatus, NutRedeemed, false},
+	}
+	for _, c := range cases {
+		if allowed := c.from.CanTransition(c.to); allowed != c.allowed {
+			t.Errorf("%q to %q: expected %v, got %v", c.from, c.to, c.allowed, allowed)
+		}
+	}
+
+	_, err := (&HoardCache{State: NutAuthenticated}).transition(NutAssociated)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected ErrInvalidTransition, got %v", err)
+	}
+}
+
+func TestNutTransitionsRecorded(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	login(client)
+
+	pag, err := api.hoard.Get(context.Background(), client.pag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []NutTransition{{From: "", To: NutIssued}, {From: NutIssued, To: NutAssociated}, {From: NutAssociated, To: NutAuthenticated}}
+	if pag.State != NutAuthenticated || len(pag.Transitions) != len(expected) {
+		t.Fatalf("Unexpected pag nut %v %+v", pag.State, pag.Transitions)
+	}
+	for i, transition := range pag.Transitions {
+		if transition.From != expected[i].From || transition.To != expected[i].To || transition.Time.IsZero() {
+			t.Errorf("Expected %v to %v, got %+v", expected[i].From, expected[i].To, transition)
+		}
+		if i > 0 && transition.Time.Before(pag.Transitions[i-1].Time) {
+			t.Errorf("Transitions out of order: %+v", pag.Transitions)
+		}
+	}
+	if !pag.Since().Equal(pag.Transitions[2].Time) {
+		t.Errorf("Expected Since to be the last transition, got %v", pag.Since())
+	}
+}
+
+func TestCliRejectsNutState(t *testing.T) {
+	api := newTestAPI(t)
+	api.StatusUpdates = true
+	api.Metrics = NewMetrics()
+	sink := NewChannelSink(32)
+	api.Events = NewEventBus(sink)
+
+	client := newTestSqrlClient(t, api)
+	login(client)
+	used := client.pag
+	client.nut = used
+	resp := client.send("ident", withOpt("noiptest"))
+	if resp.TIF&(TIFCommandFailed|TIFClientFailure) != TIFCommandFailed|TIFClientFailure {
+		t.Errorf("Expected failure, got TIF 0x%x", resp.TIF)
+	}
+	// the rejected nut isn't saved back
+	if _, err := api.hoard.Get(context.Background(), used); err != ErrNotFound {
+		t.Errorf("Expected pag nut gone, got %v", err)
+	}
+
+	// the status record isn't a nut and isn't even looked up
+	status := statusNut(used)
+	if _, err := api.hoard.Get(context.Background(), status); err != nil {
+		t.Fatalf("Expected a status record, got %v", err)
+	}
+	client.nut = status
+	resp = client.send("ident", withOpt("noiptest"))
+	if resp.TIF&TIFClientFailure == 0 {
+		t.Errorf("Expected failure, got TIF 0x%x", resp.TIF)
+	}
+	if _, err := api.hoard.Get(context.Background(), status); err != nil {
+		t.Errorf("Expected the status record left alone, got %v", err)
+	}
+	if err := checkCliNut(&HoardCache{State: NutStatus, Progress: NutAssociated}); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected a status record rejected, got %v", err)
+	}
+
+	rejected := 0
+	for _, event := range drain(sink) {
+		if event.Type == EventValidationFailed && event.Reason == ReasonNutState {
+			rejected++
+		}
+	}
+	if rejected != 1 {
+		t.Errorf("Expected 1 rejection, got %d", rejected)
+	}
+	if !strings.Contains(api.Metrics.String(), `sqrl_nut_transitions_total{from="authenticated",to="associated",result="rejected"} 1`) {
+		t.Errorf("Expected rejected transitions counted, got\n%v", api.Metrics.String())
+	}
+}
+
+func TestPagRejectsNutState(t *testing.T) {
+	api := newTestAPI(t)
+	sink := NewChannelSink(32)
+	api.Events = NewEventBus(sink)
+	client := newTestSqrlClient(t, api)
+	original := client.nut
+	client.send("query")
+
+	// the associated nut handed to the SQRL client isn't a pag nut
+	w := httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut="+string(original)+"&pag="+string(client.nut), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+	events := drain(sink)
+	last := events[len(events)-1]
+	if last.Type != EventValidationFailed || last.Reason != ReasonNutState || last.NutState != NutAssociated {
+		t.Errorf("Unexpected event %+v", last)
+	}
+}
+
+func TestPagRejectsStatusRecord(t *testing.T) {
+	api := newTestAPI(t)
+	api.StatusUpdates = true
+	client := newTestSqrlClient(t, api)
+	original := client.nut
+	login(client)
+
+	for _, pag := range []Nut{statusNut(client.pag), "a b", "%2e"} {
+		w := httptest.NewRecorder()
+		api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut="+string(original)+"&pag="+url.QueryEscape(string(pag)), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", pag, w.Code)
+		}
+	}
+	if _, err := api.hoard.Get(context.Background(), statusNut(client.pag)); err != nil {
+		t.Errorf("Expected the status record left alone, got %v", err)
+	}
+}
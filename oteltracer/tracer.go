@@ -0,0 +1,65 @@
+// Package oteltracer adapts an OpenTelemetry tracer to ssp.Tracer so the
+// /cli.sqrl spans are exported with the rest of a service's traces.
+//
+//	api.Tracer = oteltracer.New(otel.Tracer("sqrl"))
+package oteltracer
+
+import (
+	"context"
+	"fmt"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer implements ssp.Tracer with an OpenTelemetry trace.Tracer
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// New creates a Tracer starting spans with tracer
+func New(tracer trace.Tracer) *Tracer {
+	return &Tracer{tracer: tracer}
+}
+
+// Start implements ssp.Tracer
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, ssp.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &Span{span}
+}
+
+// Span implements ssp.Span with an OpenTelemetry trace.Span
+type Span struct {
+	span trace.Span
+}
+
+// SetAttribute implements ssp.Span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	s.span.SetAttributes(kv)
+}
+
+// RecordError implements ssp.Span and marks the span as failed
+func (s *Span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End implements ssp.Span
+func (s *Span) End() {
+	s.span.End()
+}
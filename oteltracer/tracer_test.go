@@ -0,0 +1,49 @@
+package oteltracer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := New(provider.Tracer("test"))
+
+	ctx, parent := tracer.Start(context.Background(), "cli")
+	_, child := tracer.Start(ctx, "parse")
+	child.SetAttribute("sqrl.cmd", "query")
+	child.SetAttribute("sqrl.tif", int64(5))
+	child.SetAttribute("flag", true)
+	child.RecordError(fmt.Errorf("bad request"))
+	child.End()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	parse := spans[0]
+	if parse.Name != "parse" {
+		t.Fatalf("Expected parse span first, got %s", parse.Name)
+	}
+	if parse.Parent.SpanID() != spans[1].SpanContext.SpanID() {
+		t.Error("Expected parse to be a child of cli")
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range parse.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["sqrl.cmd"].AsString() != "query" || attrs["sqrl.tif"].AsInt64() != 5 || !attrs["flag"].AsBool() {
+		t.Errorf("Wrong attributes: %v", parse.Attributes)
+	}
+	if parse.Status.Code != codes.Error || len(parse.Events) != 1 {
+		t.Errorf("Expected error to be recorded, got %v %v", parse.Status, parse.Events)
+	}
+}
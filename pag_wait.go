@@ -0,0 +1,289 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HoardNotifier is optionally implemented by a ContextHoard that can tell
+// waiters when a nut is saved. It lets /pag.sqrl wait for a login to
+// finish without polling the Hoard.
+type HoardNotifier interface {
+	// Subscribe returns a channel that receives a value every time nut is
+	// saved. cancel must be called once the caller stops waiting.
+	Subscribe(ctx context.Context, nut Nut) (saved <-chan struct{}, cancel func(), err error)
+}
+
+// NutSubscribers keeps track of the channels waiting on nuts. It's a
+// building block for HoardNotifier implementations.
+type NutSubscribers struct {
+	mutex       *sync.Mutex
+	subscribers map[Nut]map[chan struct{}]bool
+}
+
+// NewNutSubscribers creates an empty NutSubscribers
+func NewNutSubscribers() *NutSubscribers {
+	return &NutSubscribers{
+		mutex:       &sync.Mutex{},
+		subscribers: make(map[Nut]map[chan struct{}]bool),
+	}
+}
+
+// Subscribe adds a channel waiting on nut; cancel removes it
+func (ns *NutSubscribers) Subscribe(nut Nut) (<-chan struct{}, func()) {
+	saved := make(chan struct{}, 1)
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.subscribers[nut] == nil {
+		ns.subscribers[nut] = make(map[chan struct{}]bool)
+	}
+	ns.subscribers[nut][saved] = true
+	return saved, func() {
+		ns.mutex.Lock()
+		defer ns.mutex.Unlock()
+		delete(ns.subscribers[nut], saved)
+		if len(ns.subscribers[nut]) == 0 {
+			delete(ns.subscribers, nut)
+		}
+	}
+}
+
+// Notify wakes everything waiting on nut. It never blocks; a subscriber
+// that hasn't consumed the last notification gets only one.
+func (ns *NutSubscribers) Notify(nut Nut) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	for saved := range ns.subscribers[nut] {
+		select {
+		case saved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Len returns the number of nuts being waited on
+func (ns *NutSubscribers) Len() int {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	return len(ns.subscribers)
+}
+
+// hoardNotifierOf returns the HoardNotifier of hoard, looking through
+// WrapHoard and NamespaceHoard
+func hoardNotifierOf(hoard interface{}) HoardNotifier {
+	if namespaced, ok := hoard.(*namespacedHoard); ok {
+		notifier := hoardNotifierOf(namespaced.hoard)
+		if notifier == nil {
+			return nil
+		}
+		return &namespacedNotifier{notifier, namespaced}
+	}
+	if adapter, ok := hoard.(*hoardAdapter); ok {
+		hoard = adapter.hoard
+	}
+	notifier, _ := hoard.(HoardNotifier)
+	return notifier
+}
+
+// pagPollInterval is how often the Hoard is checked while waiting on a
+// Hoard that isn't a HoardNotifier
+const pagPollInterval = 500 * time.Millisecond
+
+// pagKeepAlive is how often an idle event stream gets a comment so
+// proxies don't close it
+const pagKeepAlive = 15 * time.Second
+
+// waitForPag takes the pag nut from the Hoard, waiting up to wait for it
+// to be saved. It returns ErrNotFound if it isn't saved in time.
+func (api *SqrlSspAPI) waitForPag(ctx context.Context, pagnut Nut, wait time.Duration) (*HoardCache, error) {
+	if wait <= 0 {
+		return api.getAndDelete(ctx, pagnut)
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	saved, unsubscribe, err := api.watchNuts(ctx, pagnut)
+	if err != nil {
+		return nil, err
+	}
+	defer unsubscribe()
+
+	// subscribed before looking so a save in between isn't missed
+	for {
+		hoardCache, err := api.getAndDelete(ctx, pagnut)
+		if err != nil && ctx.Err() != nil {
+			// timed out during the lookup
+			return nil, ErrNotFound
+		}
+		if err != ErrNotFound {
+			return hoardCache, err
+		}
+		select {
+		case <-saved:
+		case <-ctx.Done():
+			return nil, ErrNotFound
+		}
+	}
+}
+
+// watchNuts returns a channel that receives a value whenever one of nuts
+// may have been saved: on each save with a HoardNotifier, otherwise every
+// pagPollInterval. cancel must be called once the caller stops waiting.
+func (api *SqrlSspAPI) watchNuts(ctx context.Context, nuts ...Nut) (<-chan struct{}, func(), error) {
+	ctx, stop := context.WithCancel(ctx)
+	changed := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	notifier := hoardNotifierOf(api.hoard)
+	if notifier == nil {
+		ticker := time.NewTicker(pagPollInterval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					signal()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return changed, stop, nil
+	}
+
+	cancels := []func(){stop}
+	cancel := func() {
+		for _, c := range cancels {
+			c()
+		}
+	}
+	for _, nut := range nuts {
+		saved, unsubscribe, err := notifier.Subscribe(ctx, nut)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		cancels = append(cancels, unsubscribe)
+		go func() {
+			for {
+				select {
+				case <-saved:
+					signal()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return changed, cancel, nil
+}
+
+// pagWait returns how long a /pag.sqrl request may wait, bounded by the
+// nut lifetime
+func (api *SqrlSspAPI) pagWait(limit time.Duration) time.Duration {
+	if limit > api.NutExpiration {
+		return api.NutExpiration
+	}
+	return limit
+}
+
+// acceptsEventStream reports whether r lists text/event-stream in its
+// Accept header, with any parameters and among other types
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, entry := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(entry)
+			if err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nutExpires returns when nut expires if it's still waiting for a SQRL
+// client. Once a client has used it the time isn't known.
+func (api *SqrlSspAPI) nutExpires(ctx context.Context, nut Nut) (time.Time, bool) {
+	hoardCache, err := api.nutHoard().Get(ctx, nut)
+	if err != nil || hoardCache.State != NutIssued || len(hoardCache.Transitions) == 0 {
+		return time.Time{}, false
+	}
+	return hoardCache.Transitions[0].Time.Add(api.NutExpiration), true
+}
+
+// pagEvents serves /pag.sqrl as a Server-Sent Events stream. A "redirect"
+// event carries the URL once the login finishes; "expired" is sent if it
+// doesn't finish within the nut lifetime and "error" if it fails. The
+// stream is held for at most PagWait and then ends without an event so
+// the browser reconnects.
+func (api *SqrlSspAPI) pagEvents(w http.ResponseWriter, r *http.Request, nut, pagnut Nut) {
+	rc := http.NewResponseController(w)
+	// the stream outlives the server's WriteTimeout
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	deadline := time.Now().Add(api.pagWait(api.PagWait))
+	expires, known := api.nutExpires(r.Context(), nut)
+	expiring := known && expires.Before(deadline)
+	if expiring {
+		deadline = expires
+	}
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if expiring {
+				writeEvent(rc, w, "expired", "")
+			}
+			return
+		}
+		wait := pagKeepAlive
+		if remaining < wait {
+			wait = remaining
+		}
+		hoardCache, err := api.waitForPag(r.Context(), pagnut, wait)
+		if err == ErrNotFound {
+			if r.Context().Err() != nil {
+				return
+			}
+			if time.Until(deadline) <= 0 {
+				continue
+			}
+			_, _ = fmt.Fprint(w, ": keepalive\n\n")
+			_ = rc.Flush()
+			continue
+		}
+		if err != nil {
+			api.log().Error("pag_nut_lookup", err)
+			writeEvent(rc, w, "error", "Failed nut lookup")
+			return
+		}
+		redirect, status := api.pagRedirect(r.Context(), hoardCache, nut)
+		if status != http.StatusOK {
+			writeEvent(rc, w, "error", http.StatusText(status))
+			return
+		}
+		writeEvent(rc, w, "redirect", redirect)
+		return
+	}
+}
+
+// writeEvent writes a single line Server-Sent Event and flushes it
+func writeEvent(rc *http.ResponseController, w http.ResponseWriter, event, data string) {
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, sanitizeControlChars(data))
+	_ = rc.Flush()
+}
@@ -0,0 +1,244 @@
+package ssp
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pollingHoard hides the HoardNotifier of a MapHoard
+type pollingHoard struct {
+	ContextHoard
+}
+
+func pagRequest(client *testSqrlClient, original Nut) *http.Request {
+	return httptest.NewRequest("GET", "/pag.sqrl?nut="+string(original)+"&pag="+string(client.pag), nil)
+}
+
+func login(client *testSqrlClient) {
+	client.send("query")
+	client.send("ident")
+}
+
+func TestPagWait(t *testing.T) {
+	for name, hoard := range map[string]ContextHoard{
+		"notifier": WrapHoard(NewMapHoard()),
+		"polling":  &pollingHoard{WrapHoard(NewMapHoard())},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tree, _ := NewRandomTree(8)
+			api := NewSqrlSspAPIContext(tree, hoard, nil, WrapAuthStore(NewMapAuthStore()))
+			api.Authenticator = &MockAuthenticator{}
+			api.PagWait = 5 * time.Second
+			client := newTestSqrlClient(t, api)
+			original := client.nut
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				w := httptest.NewRecorder()
+				api.Pag(w, pagRequest(client, original))
+				done <- w
+			}()
+			time.Sleep(50 * time.Millisecond)
+			login(client)
+
+			select {
+			case w := <-done:
+				if w.Code != http.StatusOK || w.Body.String() != "https://example.com/dashboard" {
+					t.Errorf("Expected redirect, got %d %q", w.Code, w.Body.String())
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("Pag didn't return after login")
+			}
+		})
+	}
+}
+
+func TestPagWaitTimeout(t *testing.T) {
+	api := newTestAPI(t)
+	api.PagWait = 50 * time.Millisecond
+	client := newTestSqrlClient(t, api)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	api.Pag(w, pagRequest(client, client.nut))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected to wait, returned after %v", elapsed)
+	}
+
+	// never longer than the nut lifetime
+	api.PagWait = time.Hour
+	api.NutExpiration = 50 * time.Millisecond
+	start = time.Now()
+	api.Pag(httptest.NewRecorder(), pagRequest(client, client.nut))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected wait bounded by nut expiration, took %v", elapsed)
+	}
+}
+
+func TestPagEvents(t *testing.T) {
+	api := newTestAPI(t)
+	api.PagWait = time.Second
+	server := httptest.NewServer(http.HandlerFunc(api.Pag))
+	defer server.Close()
+	client := newTestSqrlClient(t, api)
+	original := client.nut
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/pag.sqrl?nut="+string(original)+"&pag="+string(client.pag), nil)
+	r.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	login(client)
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() {
+		if scanner.Text() == "" && len(lines) > 0 {
+			break
+		}
+		lines = append(lines, scanner.Text())
+	}
+	if strings.Join(lines, "\n") != "event: redirect\ndata: https://example.com/dashboard" {
+		t.Errorf("Unexpected event %q", lines)
+	}
+}
+
+func TestPagEventsExpired(t *testing.T) {
+	api := newTestAPI(t)
+	api.NutExpiration = 50 * time.Millisecond
+	api.PagWait = time.Second
+	client := newTestSqrlClient(t, api)
+	r := pagRequest(client, client.nut)
+	r.Header.Set("Accept", "text/html, text/event-stream;q=0.9")
+	w := httptest.NewRecorder()
+	api.Pag(w, r)
+	if w.Body.String() != "event: expired\ndata: \n\n" {
+		t.Errorf("Expected expired event, got %q", w.Body.String())
+	}
+}
+
+func TestPagEventsNutIssuedEarlier(t *testing.T) {
+	api := newTestAPI(t)
+	api.NutExpiration = time.Hour
+	api.PagWait = time.Hour
+	client := newTestSqrlClient(t, api)
+	ctx := context.Background()
+	hoardCache, err := api.hoard.Get(ctx, client.nut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a stream opened just before the nut expires
+	hoardCache.Transitions[0].Time = time.Now().Add(50*time.Millisecond - time.Hour)
+	if err := api.hoard.Save(ctx, client.nut, hoardCache, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	r := pagRequest(client, client.nut)
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	api.Pag(w, r)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the stream bounded by the nut's life, took %v", elapsed)
+	}
+	if w.Body.String() != "event: expired\ndata: \n\n" {
+		t.Errorf("Expected expired event, got %q", w.Body.String())
+	}
+}
+
+func TestPagEventsBoundedByPagWait(t *testing.T) {
+	api := newTestAPI(t)
+	api.NutExpiration = time.Hour
+	api.PagWait = 50 * time.Millisecond
+	client := newTestSqrlClient(t, api)
+	r := pagRequest(client, client.nut)
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	api.Pag(w, r)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the stream bounded by PagWait, took %v", elapsed)
+	}
+	// the nut hasn't expired so the browser reconnects
+	if w.Body.String() != "" {
+		t.Errorf("Expected the stream to end without an event, got %q", w.Body.String())
+	}
+}
+
+func TestPagEventsNeedPagWait(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	r := pagRequest(client, client.nut)
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	api.Pag(w, r)
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") == "text/event-stream" {
+		t.Errorf("Expected an immediate 404 without PagWait, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	cases := []struct {
+		accept []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"text/event-stream"}, true},
+		{[]string{"Text/Event-Stream"}, true},
+		{[]string{"text/event-stream; charset=utf-8"}, true},
+		{[]string{"application/json, text/event-stream;q=0.5"}, true},
+		{[]string{"application/json", "text/event-stream"}, true},
+		{[]string{"text/event-streams"}, false},
+		{[]string{"*/*"}, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/pag.sqrl", nil)
+		for _, accept := range c.accept {
+			r.Header.Add("Accept", accept)
+		}
+		if got := acceptsEventStream(r); got != c.want {
+			t.Errorf("%q: expected %v, got %v", c.accept, c.want, got)
+		}
+	}
+}
+
+func TestNutSubscribers(t *testing.T) {
+	ns := NewNutSubscribers()
+	saved, cancel := ns.Subscribe("a")
+	other, cancelOther := ns.Subscribe("b")
+	ns.Notify("a")
+	ns.Notify("a")
+	select {
+	case <-saved:
+	default:
+		t.Error("Expected notification")
+	}
+	select {
+	case <-saved:
+		t.Error("Expected notifications to coalesce")
+	case <-other:
+		t.Error("Expected no notification for another nut")
+	default:
+	}
+	cancel()
+	cancelOther()
+	if ns.Len() != 0 {
+		t.Errorf("Expected no subscribers, got %d", ns.Len())
+	}
+}
@@ -0,0 +1,126 @@
+package ssp
+
+import (
+	"context"
+)
+
+// Policy is the lock-down an identity has asked for. SQRLOnly asks the
+// site to refuse every other way of logging in and Hardlock asks it to
+// refuse every other way of recovering the account, such as email.
+type Policy struct {
+	SQRLOnly bool `json:"sqrlOnly"`
+	Hardlock bool `json:"hardlock"`
+}
+
+// PolicyChange is a change of Policy requested by a SQRL client with the
+// sqrlonly and hardlock options of ident or enable, or made by support
+// staff through the admin API
+type PolicyChange struct {
+	Idk string
+	// the policy of the identity, or when it's new and replaces another
+	// with a pidk, the policy of the identity it replaces
+	Previous Policy
+	// the policy the client asked for
+	Requested Policy
+	// the identity is being created by this request
+	New bool
+	// the change was made through the admin API rather than by a client
+	Admin bool
+}
+
+// PolicyEnforcer is told about Policy changes before they are saved and
+// can veto them by returning an error; the identity then keeps its
+// previous policy but the command still succeeds.
+type PolicyEnforcer interface {
+	PolicyChanged(ctx context.Context, change *PolicyChange) error
+}
+
+// ChangePolicy sets change.Requested on identity unless enforcer, which
+// may be nil, vetoes it. The veto is returned and identity is left as it
+// was. It's for changes made outside a SQRL request; the caller saves
+// identity and publishes EventPolicyChanged.
+func ChangePolicy(ctx context.Context, enforcer PolicyEnforcer, identity *SqrlIdentity, change *PolicyChange) error {
+	if enforcer != nil {
+		if err := enforcer.PolicyChanged(ctx, change); err != nil {
+			return err
+		}
+	}
+	identity.SQRLOnly = change.Requested.SQRLOnly
+	identity.Hardlock = change.Requested.Hardlock
+	return nil
+}
+
+// applyPolicy sets the policy requested by req on identity unless the
+// PolicyEnforcer vetoes it. previousIdentity is the identity a created
+// one replaces, if any. It returns true if identity was changed.
+func (api *SqrlSspAPI) applyPolicy(ctx context.Context, uow *unitOfWork, req *CliRequest, identity *SqrlIdentity, created bool, previousIdentity *SqrlIdentity) bool {
+	change := &PolicyChange{
+		Idk:       identity.Idk,
+		Requested: Policy{SQRLOnly: req.Client.Opt["sqrlonly"], Hardlock: req.Client.Opt["hardlock"]},
+		New:       created,
+	}
+	if !created {
+		change.Previous = policyOf(identity)
+	} else if previousIdentity != nil {
+		// a rekeyed account keeps its policy
+		change.Previous = policyOf(previousIdentity)
+	}
+	if change.Requested == change.Previous {
+		return false
+	}
+	if err := ChangePolicy(ctx, api.PolicyEnforcer, identity, change); err != nil {
+		api.log().Info("Policy change vetoed", "idk", RedactedKey(identity.Idk), "error", err)
+		identity.SQRLOnly = change.Previous.SQRLOnly
+		identity.Hardlock = change.Previous.Hardlock
+		return false
+	}
+	event := identityEvent(EventPolicyChanged, req, identity)
+	event.Policy = &change.Requested
+	uow.publish(event)
+	return true
+}
+
+func policyOf(identity *SqrlIdentity) Policy {
+	return Policy{SQRLOnly: identity.SQRLOnly, Hardlock: identity.Hardlock}
+}
+
+// Policy returns the policy of the account linked to idk, following any
+// rekeys to the identity currently in use. An unknown idk has no policy
+// and neither does a disabled identity: SQRL can't be used to log in
+// until it's enabled again, so the site has to offer the other ways.
+func (api *SqrlSspAPI) Policy(ctx context.Context, idk string) (Policy, error) {
+	identity, err := api.ResolveCurrentIdentity(ctx, idk)
+	if err == ErrNotFound {
+		return Policy{}, nil
+	}
+	if err != nil {
+		return Policy{}, err
+	}
+	if identity.Disabled {
+		return Policy{}, nil
+	}
+	return policyOf(identity), nil
+}
+
+// PasswordLoginAllowed reports whether the site may offer a non-SQRL
+// login, such as a password, to the account linked to idk. It's false
+// once the identity has asked for SQRL only, unless it's disabled.
+func (api *SqrlSspAPI) PasswordLoginAllowed(ctx context.Context, idk string) (bool, error) {
+	policy, err := api.Policy(ctx, idk)
+	if err != nil {
+		return false, err
+	}
+	return !policy.SQRLOnly, nil
+}
+
+// EmailRecoveryAllowed reports whether the site may offer account
+// recovery by email, or any other non-SQRL means, to the account linked
+// to idk. It's false once the identity has asked for a hardlock, unless
+// it's disabled.
+func (api *SqrlSspAPI) EmailRecoveryAllowed(ctx context.Context, idk string) (bool, error) {
+	policy, err := api.Policy(ctx, idk)
+	if err != nil {
+		return false, err
+	}
+	return !policy.Hardlock, nil
+}
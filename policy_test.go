@@ -0,0 +1,166 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type recordingEnforcer struct {
+	changes []*PolicyChange
+	veto    bool
+}
+
+func (re *recordingEnforcer) PolicyChanged(ctx context.Context, change *PolicyChange) error {
+	re.changes = append(re.changes, change)
+	if re.veto {
+		return fmt.Errorf("not on this site")
+	}
+	return nil
+}
+
+func TestPolicyChanges(t *testing.T) {
+	api, store := newRekeyTestAPI(t)
+	enforcer := &recordingEnforcer{}
+	api.PolicyEnforcer = enforcer
+	sink := NewChannelSink(32)
+	api.Events = NewEventBus(sink)
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	client.send("ident", withOpt("sqrlonly"))
+	if len(enforcer.changes) != 1 || !enforcer.changes[0].New ||
+		enforcer.changes[0].Requested != (Policy{SQRLOnly: true}) {
+		t.Fatalf("Expected new sqrlonly change, got %+v", enforcer.changes)
+	}
+
+	client.newNut()
+	client.send("query")
+	client.send("ident", withOpt("sqrlonly", "hardlock"))
+	if len(enforcer.changes) != 2 {
+		t.Fatalf("Expected second change, got %+v", enforcer.changes)
+	}
+	change := enforcer.changes[1]
+	if change.New || change.Previous != (Policy{SQRLOnly: true}) || change.Requested != (Policy{SQRLOnly: true, Hardlock: true}) {
+		t.Errorf("Unexpected change %+v", change)
+	}
+	identity, _ := store.FindIdentity(client.idk())
+	if !identity.SQRLOnly || !identity.Hardlock {
+		t.Errorf("Expected both flags saved, got %+v", identity)
+	}
+
+	// no change, no call
+	client.newNut()
+	client.send("query")
+	client.send("ident", withOpt("sqrlonly", "hardlock"))
+	if len(enforcer.changes) != 2 {
+		t.Errorf("Expected no call without a change, got %+v", enforcer.changes)
+	}
+
+	policies := 0
+	for len(sink.C) > 0 {
+		if event := <-sink.C; event.Type == EventPolicyChanged {
+			policies++
+			if event.Policy == nil || event.Idk != client.idk() {
+				t.Errorf("Unexpected event %+v", event)
+			}
+		}
+	}
+	if policies != 2 {
+		t.Errorf("Expected 2 policy events, got %d", policies)
+	}
+}
+
+func TestPolicyRekey(t *testing.T) {
+	api, store := newRekeyTestAPI(t)
+	enforcer := &recordingEnforcer{}
+	api.PolicyEnforcer = enforcer
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident", withOpt("sqrlonly"))
+
+	// the new identity asks for the policy the account already has
+	client.previous = client.key
+	client.key = newTestKey(t)
+	client.newNut()
+	client.send("query")
+	client.send("ident", withOpt("sqrlonly"))
+	if len(enforcer.changes) != 1 {
+		t.Errorf("Expected no change when rekeying with the same policy, got %+v", enforcer.changes)
+	}
+
+	// and then for more
+	client.previous = client.key
+	client.key = newTestKey(t)
+	client.newNut()
+	client.send("query")
+	client.send("ident", withOpt("sqrlonly", "hardlock"))
+	if len(enforcer.changes) != 2 {
+		t.Fatalf("Expected a second change, got %+v", enforcer.changes)
+	}
+	change := enforcer.changes[1]
+	if !change.New || change.Previous != (Policy{SQRLOnly: true}) || change.Requested != (Policy{SQRLOnly: true, Hardlock: true}) {
+		t.Errorf("Expected the previous identity's policy, got %+v", change)
+	}
+	identity, _ := store.FindIdentity(client.idk())
+	if !identity.SQRLOnly || !identity.Hardlock {
+		t.Errorf("Expected both flags saved, got %+v", identity)
+	}
+}
+
+func TestPolicyVeto(t *testing.T) {
+	api, store := newRekeyTestAPI(t)
+	api.PolicyEnforcer = &recordingEnforcer{veto: true}
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	resp := client.send("ident", withOpt("sqrlonly", "hardlock"))
+	if resp.TIF&TIFCommandFailed != 0 {
+		t.Errorf("Expected ident to succeed despite the veto, got TIF 0x%x", resp.TIF)
+	}
+	identity, err := store.FindIdentity(client.idk())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.SQRLOnly || identity.Hardlock {
+		t.Errorf("Expected vetoed flags not saved, got %+v", identity)
+	}
+}
+
+func TestLoginAndRecoveryAllowed(t *testing.T) {
+	api, store := newRekeyTestAPI(t)
+	_ = store.SaveIdentity(&SqrlIdentity{Idk: "locked", SQRLOnly: true, Hardlock: true})
+	_ = store.SaveIdentity(&SqrlIdentity{Idk: "sqrlonly", SQRLOnly: true})
+	_ = store.SaveIdentity(&SqrlIdentity{Idk: "old", Rekeyed: "locked"})
+	_ = store.SaveIdentity(&SqrlIdentity{Idk: "loop", Rekeyed: "loop"})
+	_ = store.SaveIdentity(&SqrlIdentity{Idk: "disabled", SQRLOnly: true, Hardlock: true, Disabled: true})
+	_ = store.SaveIdentity(&SqrlIdentity{Idk: "old-disabled", Rekeyed: "disabled"})
+	ctx := context.Background()
+
+	cases := []struct {
+		idk      string
+		password bool
+		recovery bool
+	}{
+		{"locked", false, false},
+		{"sqrlonly", false, true},
+		{"old", false, false},
+		{"unknown", true, true},
+		{"disabled", true, true},
+		{"old-disabled", true, true},
+	}
+	for _, c := range cases {
+		password, err := api.PasswordLoginAllowed(ctx, c.idk)
+		if err != nil || password != c.password {
+			t.Errorf("%v: expected password login %v, got %v %v", c.idk, c.password, password, err)
+		}
+		recovery, err := api.EmailRecoveryAllowed(ctx, c.idk)
+		if err != nil || recovery != c.recovery {
+			t.Errorf("%v: expected email recovery %v, got %v %v", c.idk, c.recovery, recovery, err)
+		}
+	}
+
+	if allowed, err := api.PasswordLoginAllowed(ctx, "loop"); allowed || err != ErrRekeyCycle {
+		t.Errorf("Expected a rekey cycle to refuse, got %v %v", allowed, err)
+	}
+}
@@ -3,7 +3,7 @@ package ssp
 import (
 	"crypto/rand"
 	"fmt"
-	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,6 +11,7 @@ import (
 type RandomTree struct {
 	byteSize  int
 	valueChan chan Nut
+	timeouts  atomic.Int64
 }
 
 // NewRandomTree takes a bytesize between 8 and 20
@@ -34,7 +35,7 @@ func (rt *RandomTree) valueReader() {
 		valueBytes := make([]byte, rt.byteSize)
 		_, err := rand.Read(valueBytes)
 		if err != nil {
-			log.Printf("error reading random bytes: %v", err)
+			SafeLogError("random_tree", err)
 			time.Sleep(time.Millisecond * 10)
 			continue
 		}
@@ -48,6 +49,17 @@ func (rt *RandomTree) Nut() (Nut, error) {
 	case val := <-rt.valueChan:
 		return val, nil
 	case <-time.After(20 * time.Millisecond):
+		rt.timeouts.Add(1)
 		return "", fmt.Errorf("timeout failed waiting for random nut generation")
 	}
 }
+
+// Buffered returns the number of nuts generated and waiting to be issued
+func (rt *RandomTree) Buffered() int {
+	return len(rt.valueChan)
+}
+
+// Timeouts returns the number of times Nut timed out
+func (rt *RandomTree) Timeouts() int64 {
+	return rt.timeouts.Load()
+}
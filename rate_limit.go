@@ -0,0 +1,151 @@
+package ssp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether another request for key may proceed. Keys
+// are prefixed with the endpoint (e.g. "nut:203.0.113.7" or "idk:<idk>")
+// so a single shared backend such as Redis can serve every endpoint.
+// Implementations must be safe for concurrent use.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (bool, error)
+}
+
+// RateLimits configures a RateLimiter per endpoint. Nil limiters don't
+// limit. The web endpoints are keyed on SqrlSspAPI.RemoteIP and answer
+// with 429 Too Many Requests. /cli.sqrl is limited both by IP and, once
+// the signature is verified, by idk; over the limit the client gets
+// TIFTransientError so it can retry with the same nut.
+//
+// If a limiter returns an error the request is allowed so an outage of a
+// shared backend doesn't lock every user out.
+type RateLimits struct {
+	Nut      RateLimiter
+	PNG      RateLimiter
+	Pag      RateLimiter
+	Cli      RateLimiter
+	Identity RateLimiter
+}
+
+// allow checks limiter for key; a nil limiter always allows
+func (api *SqrlSspAPI) allow(ctx context.Context, limiter RateLimiter, key string) bool {
+	if limiter == nil {
+		return true
+	}
+	ok, err := limiter.Allow(ctx, key)
+	if err != nil {
+		api.log().Error("rate_limit", err)
+		return true
+	}
+	if !ok {
+		api.log().Info("Rate limited", "key", RedactedKey(key))
+	}
+	return ok
+}
+
+// allowRemoteIP checks limiter for the request's client IP and writes a
+// 429 response if it's over the limit
+func (api *SqrlSspAPI) allowRemoteIP(w http.ResponseWriter, r *http.Request, limiter RateLimiter, endpoint string) bool {
+	if limiter == nil {
+		return true
+	}
+	if api.allow(r.Context(), limiter, endpoint+":"+api.RemoteIP(r)) {
+		return true
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	return false
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// TokenBucketLimiter is an in-memory RateLimiter with one token bucket
+// per key. Buckets refill at rate tokens per second up to burst. It's only
+// suitable for a single server; use a shared backend when running several.
+type TokenBucketLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	mutex   *sync.Mutex
+	now     func() time.Time
+	swept   time.Time
+}
+
+// NewTokenBucketLimiter creates a TokenBucketLimiter allowing rate
+// requests per second per key with bursts of up to burst requests
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucketLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		mutex:   &sync.Mutex{},
+		now:     time.Now,
+	}
+}
+
+// Allow implements RateLimiter
+func (tb *TokenBucketLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	now := tb.now()
+	tb.sweep(now)
+
+	bucket, ok := tb.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: tb.burst, last: now}
+		tb.buckets[key] = bucket
+	}
+	bucket.tokens = tb.refill(bucket, now)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, nil
+	}
+	bucket.tokens--
+	return true, nil
+}
+
+func (tb *TokenBucketLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	tokens := bucket.tokens + now.Sub(bucket.last).Seconds()*tb.rate
+	if tokens > tb.burst {
+		tokens = tb.burst
+	}
+	return tokens
+}
+
+// sweep drops buckets that have refilled completely; they're the same as a
+// missing bucket. It runs at most once per refill period to keep Allow cheap.
+func (tb *TokenBucketLimiter) sweep(now time.Time) {
+	period := time.Minute
+	if tb.rate > 0 {
+		period = time.Duration(tb.burst / tb.rate * float64(time.Second))
+	}
+	if now.Sub(tb.swept) < period {
+		return
+	}
+	tb.swept = now
+	for key, bucket := range tb.buckets {
+		if tb.refill(bucket, now) >= tb.burst {
+			delete(tb.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of keys currently tracked
+func (tb *TokenBucketLimiter) Len() int {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	return len(tb.buckets)
+}
@@ -0,0 +1,154 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	return false, fmt.Errorf("backend down")
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewTokenBucketLimiter(1, 2)
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow(ctx, "a"); !ok {
+			t.Fatalf("Expected request %d within burst to be allowed", i)
+		}
+	}
+	if ok, _ := limiter.Allow(ctx, "a"); ok {
+		t.Error("Expected request over burst to be limited")
+	}
+	if ok, _ := limiter.Allow(ctx, "b"); !ok {
+		t.Error("Expected other key to be allowed")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := limiter.Allow(ctx, "a"); !ok {
+		t.Error("Expected request after refill to be allowed")
+	}
+	if ok, _ := limiter.Allow(ctx, "a"); ok {
+		t.Error("Expected only one token to refill")
+	}
+}
+
+func TestTokenBucketLimiterSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewTokenBucketLimiter(1, 2)
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		_, _ = limiter.Allow(ctx, fmt.Sprintf("key%d", i))
+	}
+	if limiter.Len() != 10 {
+		t.Fatalf("Expected 10 buckets, got %d", limiter.Len())
+	}
+	now = now.Add(time.Minute)
+	_, _ = limiter.Allow(ctx, "new")
+	if limiter.Len() != 1 {
+		t.Errorf("Expected idle buckets to be swept, got %d", limiter.Len())
+	}
+}
+
+func TestNutRateLimited(t *testing.T) {
+	api := newTestAPI(t)
+	api.RateLimits.Nut = NewTokenBucketLimiter(0, 1)
+
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, expected := range codes {
+		w := httptest.NewRecorder()
+		api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+		if w.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, w.Code)
+		}
+	}
+
+	// a different client IP has its own limit
+	r := httptest.NewRequest("GET", "/nut.sqrl", nil)
+	r.RemoteAddr = "203.0.113.9:1234"
+	w := httptest.NewRecorder()
+	api.Nut(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected other IP to be allowed, got %d", w.Code)
+	}
+}
+
+func TestPagAndPNGRateLimited(t *testing.T) {
+	api := newTestAPI(t)
+	api.RateLimits.Pag = NewTokenBucketLimiter(0, 0)
+	api.RateLimits.PNG = NewTokenBucketLimiter(0, 0)
+
+	w := httptest.NewRecorder()
+	api.PNG(w, httptest.NewRequest("GET", "/png.sqrl", nil))
+	w = httptest.NewRecorder()
+	api.PNG(w, httptest.NewRequest("GET", "/png.sqrl", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected png to be limited, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut=a&pag=b", nil))
+	w = httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut=a&pag=b", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected pag to be limited, got %d", w.Code)
+	}
+}
+
+func TestCliRateLimitedByIP(t *testing.T) {
+	api := newTestAPI(t)
+	api.RateLimits.Cli = NewTokenBucketLimiter(0, 1)
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	nut := client.nut
+	resp := client.send("query")
+	if resp.TIF&(TIFTransientError|TIFCommandFailed) != TIFTransientError|TIFCommandFailed {
+		t.Errorf("Expected transient error, got 0x%x", resp.TIF)
+	}
+	if resp.Nut != nut {
+		t.Error("Expected nut to be kept for retry")
+	}
+	if _, err := api.hoard.Get(context.Background(), nut); err != nil {
+		t.Errorf("Expected nut to remain in hoard: %v", err)
+	}
+}
+
+func TestCliRateLimitedByIdentity(t *testing.T) {
+	api := newTestAPI(t)
+	api.RateLimits.Identity = NewTokenBucketLimiter(0, 1)
+	client := newTestSqrlClient(t, api)
+	other := newTestSqrlClient(t, api)
+
+	client.send("query")
+	resp := client.send("ident")
+	if resp.TIF&TIFTransientError == 0 {
+		t.Errorf("Expected identity to be limited, got 0x%x", resp.TIF)
+	}
+	resp = other.send("query")
+	if resp.TIF&TIFCommandFailed != 0 {
+		t.Errorf("Expected other identity to be allowed, got 0x%x", resp.TIF)
+	}
+}
+
+func TestRateLimiterErrorAllows(t *testing.T) {
+	api := newTestAPI(t)
+	api.RateLimits.Nut = failingLimiter{}
+
+	w := httptest.NewRecorder()
+	api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected limiter error to allow request, got %d", w.Code)
+	}
+}
@@ -0,0 +1,179 @@
+// Package redishoard implements an ssp.ContextHoard backed by Redis. Since all
+// state is kept in Redis, any number of SSP servers can share the same
+// Hoard behind a load balancer. Nut expiration uses native Redis TTLs and
+// GetAndDelete uses GETDEL (Redis 6.2+) so a nut can only ever be redeemed
+// once across all nodes. Saves are announced on a pub/sub channel so
+// Hoard implements ssp.HoardNotifier on every node.
+package redishoard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultPrefix is prepended to every nut to form the Redis key
+const DefaultPrefix = "sqrl:nut:"
+
+// savedChannel is appended to Prefix to name the pub/sub channel saved
+// nuts are published on
+const savedChannel = "saved"
+
+// Hoard implements ssp.ContextHoard using Redis
+type Hoard struct {
+	client redis.UniversalClient
+	// Prefix is prepended to every nut to form the Redis key; it can be
+	// changed to share a Redis database between several deployments
+	Prefix string
+
+	mutex       *sync.Mutex
+	pubsub      *redis.PubSub
+	subscribers *ssp.NutSubscribers
+}
+
+// NewHoard creates a Hoard using an already configured Redis client
+func NewHoard(client redis.UniversalClient) *Hoard {
+	return &Hoard{
+		client:      client,
+		Prefix:      DefaultPrefix,
+		mutex:       &sync.Mutex{},
+		subscribers: ssp.NewNutSubscribers(),
+	}
+}
+
+func (h *Hoard) key(nut ssp.Nut) string {
+	return h.Prefix + string(nut)
+}
+
+// Get implements ssp.ContextHoard
+func (h *Hoard) Get(ctx context.Context, nut ssp.Nut) (*ssp.HoardCache, error) {
+	value, err := h.client.Get(ctx, h.key(nut)).Bytes()
+	return decode(value, err)
+}
+
+// GetAndDelete implements ssp.ContextHoard. The read and delete are a single
+// atomic GETDEL so concurrent callers can't both receive the value.
+func (h *Hoard) GetAndDelete(ctx context.Context, nut ssp.Nut) (*ssp.HoardCache, error) {
+	value, err := h.client.GetDel(ctx, h.key(nut)).Bytes()
+	return decode(value, err)
+}
+
+// Save implements ssp.ContextHoard. The expiration is set as the key's TTL;
+// a non-positive expiration means the value is already expired so nothing
+// is stored.
+func (h *Hoard) Save(ctx context.Context, nut ssp.Nut, value *ssp.HoardCache, expiration time.Duration) error {
+	if nut == "" {
+		return fmt.Errorf("empty nuts are not allowed")
+	}
+	if value == nil {
+		return fmt.Errorf("nil values are not allowed")
+	}
+	if expiration <= 0 {
+		return h.client.Del(ctx, h.key(nut)).Err()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed encoding hoard cache: %v", err)
+	}
+	defer ssp.ClearBytes(encoded)
+	if err := h.client.Set(ctx, h.key(nut), encoded, expiration).Err(); err != nil {
+		return err
+	}
+	// waiters will find the nut when they next look so a lost
+	// notification only delays them
+	_ = h.client.Publish(ctx, h.Prefix+savedChannel, string(nut)).Err()
+	return nil
+}
+
+// Subscribe implements ssp.HoardNotifier. The first call subscribes to the
+// saved channel; notifications for every waiter on this node share it.
+func (h *Hoard) Subscribe(ctx context.Context, nut ssp.Nut) (<-chan struct{}, func(), error) {
+	if err := h.listen(ctx); err != nil {
+		return nil, nil, err
+	}
+	saved, cancel := h.subscribers.Subscribe(nut)
+	return saved, cancel, nil
+}
+
+func (h *Hoard) listen(ctx context.Context) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.pubsub != nil {
+		return nil
+	}
+	pubsub := h.client.Subscribe(context.WithoutCancel(ctx), h.Prefix+savedChannel)
+	// wait for the subscription so no save after Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return fmt.Errorf("failed subscribing to saved nuts: %v", err)
+	}
+	h.pubsub = pubsub
+	go func() {
+		for msg := range pubsub.Channel() {
+			h.subscribers.Notify(ssp.Nut(msg.Payload))
+		}
+	}()
+	return nil
+}
+
+// Close stops listening for saved nuts. The Redis client isn't closed.
+func (h *Hoard) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.pubsub == nil {
+		return nil
+	}
+	err := h.pubsub.Close()
+	h.pubsub = nil
+	return err
+}
+
+// PurgeNuts implements ssp.NutPurger. It scans every key under Prefix so
+// it's meant for occasional administrative use, not the request path.
+func (h *Hoard) PurgeNuts(ctx context.Context, idk string) (int, error) {
+	purged := 0
+	iter := h.client.Scan(ctx, 0, h.Prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		hoardCache, err := decode(h.client.Get(ctx, key).Bytes())
+		if errors.Is(err, ssp.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		if !hoardCache.ForIdentity(idk) {
+			continue
+		}
+		deleted, err := h.client.Del(ctx, key).Result()
+		if err != nil {
+			return purged, err
+		}
+		purged += int(deleted)
+	}
+	if err := iter.Err(); err != nil {
+		return purged, fmt.Errorf("failed scanning nuts: %v", err)
+	}
+	return purged, nil
+}
+
+func decode(value []byte, err error) (*ssp.HoardCache, error) {
+	if errors.Is(err, redis.Nil) {
+		return nil, ssp.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer ssp.ClearBytes(value)
+	hoardCache := &ssp.HoardCache{}
+	if err := json.Unmarshal(value, hoardCache); err != nil {
+		return nil, fmt.Errorf("failed decoding hoard cache: %v", err)
+	}
+	return hoardCache, nil
+}
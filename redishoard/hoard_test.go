@@ -0,0 +1,257 @@
+package redishoard
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/dxcSithLord/server-go-ssp/ssptest"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestHoard(t *testing.T) (*Hoard, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewHoard(client), mr
+}
+
+func testHoardCache() *ssp.HoardCache {
+	return &ssp.HoardCache{
+		State:       "associated",
+		RemoteIP:    "192.0.2.1",
+		OriginalNut: "original",
+		PagNut:      "pag",
+		LastRequest: &ssp.CliRequest{
+			Client: &ssp.ClientBody{
+				Version: ssp.Versions{1},
+				Cmd:     "query",
+				Opt:     map[string]bool{"suk": true},
+				Idk:     "idk",
+				Btn:     -1,
+			},
+			ClientEncoded: "client",
+			Server:        "server",
+			Ids:           "ids",
+			Version:       1,
+			IPAddress:     "192.0.2.1",
+		},
+		Identity:     &ssp.SqrlIdentity{Idk: "idk", Suk: "suk", Vuk: "vuk"},
+		LastResponse: []byte("response"),
+	}
+}
+
+func TestHoardRoundTrip(t *testing.T) {
+	h, _ := newTestHoard(t)
+	ctx := context.Background()
+
+	saved := testHoardCache()
+	if err := h.Save(ctx, "nut", saved, time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+
+	val, err := h.Get(ctx, "nut")
+	if err != nil {
+		t.Fatalf("Failed get: %v", err)
+	}
+	if !reflect.DeepEqual(val, testHoardCache()) {
+		t.Errorf("Round trip mismatch:\n got %#v\nwant %#v", val, saved)
+	}
+
+	// Get doesn't remove the nut
+	if _, err := h.Get(ctx, "nut"); err != nil {
+		t.Errorf("Second get failed: %v", err)
+	}
+}
+
+func TestHoardGetAndDelete(t *testing.T) {
+	h, _ := newTestHoard(t)
+	ctx := context.Background()
+
+	if err := h.Save(ctx, "nut", testHoardCache(), time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if _, err := h.GetAndDelete(ctx, "nut"); err != nil {
+		t.Fatalf("Failed get and delete: %v", err)
+	}
+	val, err := h.GetAndDelete(ctx, "nut")
+	if err != ssp.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if val != nil {
+		t.Errorf("Value should be nil: %v", val)
+	}
+}
+
+func TestHoardExpiration(t *testing.T) {
+	h, mr := newTestHoard(t)
+	ctx := context.Background()
+
+	if err := h.Save(ctx, "nut", testHoardCache(), time.Second); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if ttl := mr.TTL(h.key("nut")); ttl != time.Second {
+		t.Errorf("Expected TTL of 1s, got %v", ttl)
+	}
+	mr.FastForward(2 * time.Second)
+	if _, err := h.Get(ctx, "nut"); err != ssp.ErrNotFound {
+		t.Errorf("Expected ErrNotFound after expiration, got %v", err)
+	}
+
+	if err := h.Save(ctx, "nut", testHoardCache(), 0); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if _, err := h.Get(ctx, "nut"); err != ssp.ErrNotFound {
+		t.Errorf("Expected zero expiration to not be stored, got %v", err)
+	}
+}
+
+func TestHoardEmptyNut(t *testing.T) {
+	h, _ := newTestHoard(t)
+	ctx := context.Background()
+	if err := h.Save(ctx, "", testHoardCache(), time.Minute); err == nil {
+		t.Error("Expected error saving empty nut")
+	}
+}
+
+func TestHoardPrefix(t *testing.T) {
+	h, mr := newTestHoard(t)
+	ctx := context.Background()
+	h.Prefix = "tenant:"
+	if err := h.Save(ctx, "nut", testHoardCache(), time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if !mr.Exists("tenant:nut") {
+		t.Errorf("Expected key with custom prefix, got %v", mr.Keys())
+	}
+}
+
+func TestHoardConcurrentGetAndDelete(t *testing.T) {
+	h, _ := newTestHoard(t)
+	ctx := context.Background()
+	if err := h.Save(ctx, "nut", testHoardCache(), time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+
+	var redeemed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := h.GetAndDelete(ctx, "nut"); err == nil {
+				atomic.AddInt32(&redeemed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if redeemed != 1 {
+		t.Errorf("Expected nut redeemed exactly once, got %d", redeemed)
+	}
+}
+
+func TestPurgeNuts(t *testing.T) {
+	hoard, _ := newTestHoard(t)
+	ctx := context.Background()
+	other := testHoardCache()
+	other.Identity = nil
+	other.LastRequest.Client.Idk = "other"
+	for nut, value := range map[ssp.Nut]*ssp.HoardCache{
+		"mine":   testHoardCache(),
+		"other":  other,
+		"issued": {State: "issued"},
+	} {
+		if err := hoard.Save(ctx, nut, value, time.Minute); err != nil {
+			t.Fatalf("Failed save: %v", err)
+		}
+	}
+	purged, err := hoard.PurgeNuts(ctx, "idk")
+	if err != nil {
+		t.Fatalf("Failed purge: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected 1 nut purged, got %d", purged)
+	}
+	if _, err := hoard.Get(ctx, "mine"); err != ssp.ErrNotFound {
+		t.Errorf("Expected purged nut gone, got %v", err)
+	}
+	for _, nut := range []ssp.Nut{"other", "issued"} {
+		if _, err := hoard.Get(ctx, nut); err != nil {
+			t.Errorf("Expected nut %s kept, got %v", nut, err)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	hoard, _ := newTestHoard(t)
+	t.Cleanup(func() { hoard.Close() })
+	ctx := context.Background()
+
+	saved, cancel, err := hoard.Subscribe(ctx, "pag")
+	if err != nil {
+		t.Fatalf("Failed subscribe: %v", err)
+	}
+	defer cancel()
+	if err := hoard.Save(ctx, "other", testHoardCache(), time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if err := hoard.Save(ctx, "pag", testHoardCache(), time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	select {
+	case <-saved:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected notification of saved nut")
+	}
+	select {
+	case <-saved:
+		t.Error("Expected a single notification")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a second node sharing the database is notified too
+	other := NewHoard(hoard.client)
+	t.Cleanup(func() { other.Close() })
+	otherSaved, otherCancel, err := other.Subscribe(ctx, "pag2")
+	if err != nil {
+		t.Fatalf("Failed subscribe: %v", err)
+	}
+	defer otherCancel()
+	if err := hoard.Save(ctx, "pag2", testHoardCache(), time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	select {
+	case <-otherSaved:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected notification on the other node")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	hoard, _ := newTestHoard(t)
+	api := ssp.NewSqrlSspAPIContext(nil, hoard, nil, ssp.WrapAuthStore(ssp.NewMapAuthStore()))
+	api.Authenticator = ssptest.NewAuthenticator()
+	ssptest.RunTests(t, &ssptest.Target{Handler: api.Handler()})
+}
+
+func TestHoardSuite(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	suite := &ssptest.HoardSuite{
+		New: func(t *testing.T) ssp.ContextHoard {
+			hoard := NewHoard(client)
+			// tests share the server
+			hoard.Prefix = t.Name() + ":"
+			t.Cleanup(func() { hoard.Close() })
+			return hoard
+		},
+		Advance: mr.FastForward,
+	}
+	suite.Run(t)
+}
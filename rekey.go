@@ -0,0 +1,126 @@
+package ssp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MaxRekeyChain bounds how many Rekeyed links are followed when resolving
+// an identity; longer chains are treated as cycles
+const MaxRekeyChain = 32
+
+// ErrRekeyCycle is returned when following Rekeyed links loops or exceeds
+// MaxRekeyChain
+var ErrRekeyCycle = errors.New("rekey cycle")
+
+// ErrAlreadyRekeyed is returned when an identity that has already been
+// rekeyed to one idk is presented as the pidk of a different one
+var ErrAlreadyRekeyed = errors.New("previous identity already rekeyed")
+
+// Rekey records one swap of a previous identity for a new one
+type Rekey struct {
+	PreviousIdk string    `json:"previousIdk"`
+	Idk         string    `json:"idk"`
+	RemoteIP    string    `json:"remoteIP,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// RekeyStore is optionally implemented by a ContextAuthStore to keep an
+// audit trail of rekeys. If the store also implements TxAuthStore, the
+// AuthStoreTx should implement it too so the record is saved in the same
+// transaction as the swap.
+type RekeyStore interface {
+	SaveRekey(ctx context.Context, rekey *Rekey) error
+	// FindRekeys returns the rekeys where idk is either the previous or
+	// the new identity, oldest first
+	FindRekeys(ctx context.Context, idk string) ([]*Rekey, error)
+}
+
+// rekeyStoreOf returns the RekeyStore of store, looking through
+// WrapAuthStore and NamespaceAuthStore
+func rekeyStoreOf(store interface{}) RekeyStore {
+	switch s := store.(type) {
+	case *authStoreAdapter:
+		store = s.authStore
+	case *namespacedTx:
+		return namespacedRekeysOf(&s.namespacedAuthStore)
+	case *namespacedAuthStore:
+		return namespacedRekeysOf(s)
+	}
+	rekeys, _ := store.(RekeyStore)
+	return rekeys
+}
+
+func namespacedRekeysOf(store *namespacedAuthStore) RekeyStore {
+	rekeys := rekeyStoreOf(store.store)
+	if rekeys == nil {
+		return nil
+	}
+	return &namespacedRekeys{rekeys, store}
+}
+
+// ResolveCurrentIdentity follows the Rekeyed links from idk and returns the
+// identity that replaced it, or the identity itself if it hasn't been
+// rekeyed. It returns ErrNotFound if idk or a link is unknown and
+// ErrRekeyCycle if the links loop.
+func ResolveCurrentIdentity(ctx context.Context, store ContextAuthStore, idk string) (*SqrlIdentity, error) {
+	seen := make(map[string]bool)
+	for {
+		identity, err := store.FindIdentity(ctx, idk)
+		if err != nil {
+			return nil, err
+		}
+		if identity.Rekeyed == "" {
+			return identity, nil
+		}
+		seen[idk] = true
+		if seen[identity.Rekeyed] || len(seen) >= MaxRekeyChain {
+			return nil, ErrRekeyCycle
+		}
+		idk = identity.Rekeyed
+	}
+}
+
+// ResolveCurrentIdentity resolves idk with the API's AuthStore; see the
+// package level ResolveCurrentIdentity
+func (api *SqrlSspAPI) ResolveCurrentIdentity(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	return ResolveCurrentIdentity(ctx, api.identityStore(), idk)
+}
+
+// RekeyHistory returns the audit trail of rekeys involving idk. It returns
+// nil if the AuthStore doesn't implement RekeyStore.
+func (api *SqrlSspAPI) RekeyHistory(ctx context.Context, idk string) ([]*Rekey, error) {
+	rekeys := rekeyStoreOf(api.authStore)
+	if rekeys == nil {
+		return nil, nil
+	}
+	return rekeys.FindRekeys(ctx, idk)
+}
+
+// checkRekey makes sure previousIdentity can be swapped for newIdk. An
+// identity can only ever be rekeyed once; presenting it again with the
+// idk it was rekeyed to is a retry and allowed.
+func checkRekey(ctx context.Context, rekeys RekeyStore, previousIdentity *SqrlIdentity, newIdk string) error {
+	if previousIdentity.Rekeyed != "" && previousIdentity.Rekeyed != newIdk {
+		return ErrAlreadyRekeyed
+	}
+	if rekeys == nil {
+		return nil
+	}
+	history, err := rekeys.FindRekeys(ctx, previousIdentity.Idk)
+	if err != nil {
+		return err
+	}
+	for _, rekey := range history {
+		if rekey.PreviousIdk == previousIdentity.Idk && rekey.Idk != newIdk {
+			return ErrAlreadyRekeyed
+		}
+		// the new identity was rekeyed away before, so swapping back to
+		// it would close a loop
+		if rekey.PreviousIdk == newIdk {
+			return ErrRekeyCycle
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package ssp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveCurrentIdentity(t *testing.T) {
+	store := NewMapAuthStore()
+	for _, identity := range []*SqrlIdentity{
+		{Idk: "a", Rekeyed: "b"},
+		{Idk: "b", Rekeyed: "c"},
+		{Idk: "c"},
+		{Idk: "x", Rekeyed: "y"},
+		{Idk: "y", Rekeyed: "x"},
+		{Idk: "broken", Rekeyed: "gone"},
+	} {
+		_ = store.SaveIdentity(identity)
+	}
+	ctx := context.Background()
+	wrapped := WrapAuthStore(store)
+
+	cases := []struct {
+		idk     string
+		current string
+		err     error
+	}{
+		{"a", "c", nil},
+		{"b", "c", nil},
+		{"c", "c", nil},
+		{"x", "", ErrRekeyCycle},
+		{"broken", "", ErrNotFound},
+		{"missing", "", ErrNotFound},
+	}
+	for _, c := range cases {
+		identity, err := ResolveCurrentIdentity(ctx, wrapped, c.idk)
+		if err != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.idk, c.err, err)
+			continue
+		}
+		if err == nil && identity.Idk != c.current {
+			t.Errorf("%v: expected current %v, got %v", c.idk, c.current, identity.Idk)
+		}
+	}
+}
+
+func TestCheckRekey(t *testing.T) {
+	ctx := context.Background()
+	store := NewMapAuthStore()
+	_ = store.SaveRekey(ctx, &Rekey{PreviousIdk: "old", Idk: "new"})
+	_ = store.SaveRekey(ctx, &Rekey{PreviousIdk: "back", Idk: "fresh"})
+
+	cases := []struct {
+		name     string
+		previous *SqrlIdentity
+		newIdk   string
+		err      error
+	}{
+		{"replacement rekeyed", &SqrlIdentity{Idk: "fresh"}, "other", nil},
+		{"unrekeyed", &SqrlIdentity{Idk: "plain"}, "next", nil},
+		{"retry", &SqrlIdentity{Idk: "old", Rekeyed: "new"}, "new", nil},
+		{"rekeyed elsewhere", &SqrlIdentity{Idk: "plain", Rekeyed: "new"}, "other", ErrAlreadyRekeyed},
+		{"history elsewhere", &SqrlIdentity{Idk: "old"}, "other", ErrAlreadyRekeyed},
+		{"swap back", &SqrlIdentity{Idk: "fresh"}, "back", ErrRekeyCycle},
+	}
+	for _, c := range cases {
+		if err := checkRekey(ctx, store, c.previous, c.newIdk); err != c.err {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+	if err := checkRekey(ctx, nil, &SqrlIdentity{Idk: "old"}, "other"); err != nil {
+		t.Errorf("Expected no history check without a RekeyStore, got %v", err)
+	}
+}
+
+func newRekeyTestAPI(t *testing.T) (*SqrlSspAPI, *MapAuthStore) {
+	tree, err := NewRandomTree(8)
+	if err != nil {
+		t.Fatalf("Failed to create RandomTree: %v", err)
+	}
+	store := NewMapAuthStore()
+	return NewSqrlSspAPI(tree, NewMapHoard(), &MockAuthenticator{}, store), store
+}
+
+// rekeyTo logs in with a new key that replaces the client's current key
+func rekeyTo(t *testing.T, client *testSqrlClient) {
+	client.previous = client.key
+	client.key = newTestKey(t)
+	client.newNut()
+	client.send("query")
+	if resp := client.send("ident"); resp.TIF&TIFCommandFailed != 0 {
+		t.Fatalf("Rekey failed with TIF 0x%x", resp.TIF)
+	}
+}
+
+func TestCliRekeyAuditTrail(t *testing.T) {
+	api, store := newRekeyTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+	first := client.idk()
+
+	rekeyTo(t, client)
+	second := client.idk()
+	rekeyTo(t, client)
+	third := client.idk()
+
+	ctx := context.Background()
+	current, err := api.ResolveCurrentIdentity(ctx, first)
+	if err != nil || current.Idk != third {
+		t.Fatalf("Expected %v to resolve to %v, got %v %v", first, third, current, err)
+	}
+
+	history, err := api.RekeyHistory(ctx, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 ||
+		history[0].PreviousIdk != first || history[0].Idk != second ||
+		history[1].PreviousIdk != second || history[1].Idk != third {
+		t.Errorf("Unexpected history %+v", history)
+	}
+	if history[0].Time.IsZero() || history[0].RemoteIP == "" {
+		t.Errorf("Expected time and remote IP recorded, got %+v", history[0])
+	}
+	if all, _ := store.FindRekeys(ctx, first); len(all) != 1 {
+		t.Errorf("Expected 1 rekey of the first identity, got %+v", all)
+	}
+}
+
+func TestCliPreviousIdentityRekeyedElsewhere(t *testing.T) {
+	api, store := newRekeyTestAPI(t)
+	sink := NewChannelSink(32)
+	api.Events = NewEventBus(sink)
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+	original := client.key
+	rekeyTo(t, client)
+
+	// a second client presenting the same, already rekeyed, previous key
+	other := newTestSqrlClient(t, api)
+	other.previous = original
+	resp := other.send("query")
+	if resp.TIF&TIFPreviousIDMatch != 0 {
+		t.Errorf("Expected no previous ID match on query, got TIF 0x%x", resp.TIF)
+	}
+	if resp.TIF&TIFCommandFailed != 0 {
+		t.Errorf("Expected query to succeed, got TIF 0x%x", resp.TIF)
+	}
+	resp = other.send("ident")
+	if resp.TIF&TIFCommandFailed == 0 {
+		t.Errorf("Expected ident to fail, got TIF 0x%x", resp.TIF)
+	}
+	if _, err := store.FindIdentity(other.idk()); err != ErrNotFound {
+		t.Errorf("Expected no identity created, got %v", err)
+	}
+
+	found := false
+	for len(sink.C) > 0 {
+		event := <-sink.C
+		if event.Type == EventValidationFailed && event.Reason == ReasonPreviousSuperseded {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected previous_identity_superseded validation event")
+	}
+}
+
+func TestCliSupersededIdentity(t *testing.T) {
+	api, store := newRekeyTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+	original := client.key
+	rekeyTo(t, client)
+	current := client.idk()
+
+	// a device still holding the original key
+	old := newTestSqrlClient(t, api)
+	old.key = original
+	resp := old.send("query")
+	if resp.TIF&(TIFIdentitySuperseded|TIFSQRLDisabled|TIFCommandFailed) != TIFIdentitySuperseded {
+		t.Errorf("Expected superseded identity, got TIF 0x%x", resp.TIF)
+	}
+
+	// the state of the account comes from the current identity
+	identity, err := store.FindIdentity(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity.Disabled = true
+	if err := store.SaveIdentity(identity); err != nil {
+		t.Fatal(err)
+	}
+	old.newNut()
+	resp = old.send("query")
+	if resp.TIF&(TIFIdentitySuperseded|TIFSQRLDisabled|TIFCommandFailed) != TIFIdentitySuperseded|TIFSQRLDisabled {
+		t.Errorf("Expected superseded and disabled, got TIF 0x%x", resp.TIF)
+	}
+
+	// nothing left to move to once the current identity is removed
+	if err := store.DeleteIdentity(current); err != nil {
+		t.Fatal(err)
+	}
+	old.newNut()
+	resp = old.send("query")
+	if resp.TIF&(TIFIdentitySuperseded|TIFCommandFailed) != TIFIdentitySuperseded|TIFCommandFailed {
+		t.Errorf("Expected superseded query to fail, got TIF 0x%x", resp.TIF)
+	}
+}
+
+func TestCliRekeyRetry(t *testing.T) {
+	api, _ := newRekeyTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+	rekeyTo(t, client)
+
+	// the client lost the response and logs in again with both keys
+	client.newNut()
+	resp := client.send("query")
+	if resp.TIF&(TIFIDMatch|TIFPreviousIDMatch) != TIFIDMatch|TIFPreviousIDMatch {
+		t.Errorf("Expected ID and previous ID match, got TIF 0x%x", resp.TIF)
+	}
+	if resp := client.send("ident"); resp.TIF&TIFCommandFailed != 0 {
+		t.Errorf("Expected retried ident to succeed, got TIF 0x%x", resp.TIF)
+	}
+}
@@ -0,0 +1,52 @@
+package ssp
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+// secretIndexSize is the decoded size of an ins or pins value
+const secretIndexSize = 32
+
+// SecretIndexProvider lets a site issue a server-chosen secret index
+// challenge (sin) to the SQRL client. The client answers on its next
+// request with ins, a value derived from the identity and the sin, and
+// with pins for the previous identity if it has one. Since the answer is
+// stable for a given identity and sin, it can be used as a secret known
+// only to the SQRL identity owner.
+type SecretIndexProvider interface {
+	// SecretIndex is called on query and returns the sin to send to
+	// the client, or "" to not request a secret index. The identity
+	// is the stored identity if known, otherwise it contains only
+	// the Idk from the request.
+	SecretIndex(identity *SqrlIdentity) string
+}
+
+// validSin checks that a sin can be safely written into a response
+func validSin(sin string) bool {
+	for i := 0; i < len(sin); i++ {
+		if sin[i] < 0x21 || sin[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// validSecretIndex checks an ins or pins value is a Sqrl64 encoded 256-bit value
+func validSecretIndex(index string) error {
+	decoded, err := Sqrl64.DecodeString(index)
+	if err != nil {
+		return fmt.Errorf("can't decode secret index: %v", err)
+	}
+	defer ClearBytes(decoded)
+	if len(decoded) != secretIndexSize {
+		return fmt.Errorf("invalid secret index length %d", len(decoded))
+	}
+	return nil
+}
+
+// matchSecretIndex checks a client supplied index against the one stored
+// for an identity in constant time
+func matchSecretIndex(stored, supplied string) bool {
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(supplied)) == 1
+}
@@ -0,0 +1,127 @@
+package ssp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+type staticSinProvider struct {
+	sin string
+}
+
+func (s *staticSinProvider) SecretIndex(identity *SqrlIdentity) string {
+	return s.sin
+}
+
+func testIns(b byte) string {
+	return Sqrl64.EncodeToString(bytes.Repeat([]byte{b}, secretIndexSize))
+}
+
+func TestSecretIndexIssuedOnQuery(t *testing.T) {
+	api := newTestAPI(t)
+	api.SecretIndexProvider = &staticSinProvider{"vault"}
+	client := newTestSqrlClient(t, api)
+
+	resp := client.send("query")
+	if resp.Sin != "vault" {
+		t.Errorf("Expected sin vault, got %q", resp.Sin)
+	}
+}
+
+func TestSecretIndexStoredAndVerified(t *testing.T) {
+	api := newTestAPI(t)
+	api.SecretIndexProvider = &staticSinProvider{"vault"}
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	resp := client.send("ident", func(cb *ClientBody) { cb.Ins = testIns(1) })
+	if resp.TIF&TIFCommandFailed != 0 {
+		t.Fatalf("Ident with ins failed: 0x%x", resp.TIF)
+	}
+	identity, err := api.authStore.FindIdentity(context.Background(), client.idk())
+	if err != nil {
+		t.Fatalf("Identity not saved: %v", err)
+	}
+	if identity.Sin != "vault" || identity.Ins != testIns(1) {
+		t.Errorf("Secret index not stored: sin=%q ins=%q", identity.Sin, identity.Ins)
+	}
+
+	// same answer on a later login
+	client.newNut()
+	client.send("query")
+	resp = client.send("ident", func(cb *ClientBody) { cb.Ins = testIns(1) })
+	if resp.TIF&TIFCommandFailed != 0 {
+		t.Errorf("Ident with matching ins failed: 0x%x", resp.TIF)
+	}
+
+	// different answer on a later login
+	client.newNut()
+	client.send("query")
+	resp = client.send("ident", func(cb *ClientBody) { cb.Ins = testIns(2) })
+	if resp.TIF&(TIFCommandFailed|TIFClientFailure) != TIFCommandFailed|TIFClientFailure {
+		t.Errorf("Expected ident with wrong ins to fail, got 0x%x", resp.TIF)
+	}
+}
+
+func TestSecretIndexMissingIns(t *testing.T) {
+	api := newTestAPI(t)
+	api.SecretIndexProvider = &staticSinProvider{"vault"}
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	resp := client.send("ident")
+	if resp.TIF&(TIFCommandFailed|TIFClientFailure) != TIFCommandFailed|TIFClientFailure {
+		t.Errorf("Expected ident without ins to fail, got 0x%x", resp.TIF)
+	}
+}
+
+func TestSecretIndexPinsOnRekey(t *testing.T) {
+	api := newTestAPI(t)
+	api.SecretIndexProvider = &staticSinProvider{"vault"}
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	client.send("ident", func(cb *ClientBody) { cb.Ins = testIns(1) })
+
+	// rekey to a new identity
+	client.previous = client.key
+	client.key = newTestKey(t)
+	client.newNut()
+	client.send("query")
+	resp := client.send("ident", func(cb *ClientBody) {
+		cb.Ins = testIns(3)
+		cb.Pins = testIns(9)
+	})
+	if resp.TIF&TIFCommandFailed == 0 {
+		t.Errorf("Expected wrong pins to fail, got 0x%x", resp.TIF)
+	}
+
+	client.newNut()
+	client.send("query")
+	resp = client.send("ident", func(cb *ClientBody) {
+		cb.Ins = testIns(3)
+		cb.Pins = testIns(1)
+	})
+	if resp.TIF&TIFCommandFailed != 0 {
+		t.Fatalf("Rekey with matching pins failed: 0x%x", resp.TIF)
+	}
+	identity, err := api.authStore.FindIdentity(context.Background(), client.idk())
+	if err != nil {
+		t.Fatalf("New identity not saved: %v", err)
+	}
+	if identity.Ins != testIns(3) {
+		t.Errorf("New identity ins not stored: %q", identity.Ins)
+	}
+}
+
+func TestSecretIndexInvalidSinIgnored(t *testing.T) {
+	api := newTestAPI(t)
+	api.SecretIndexProvider = &staticSinProvider{"bad\r\nsin"}
+	client := newTestSqrlClient(t, api)
+
+	resp := client.send("query")
+	if resp.Sin != "" {
+		t.Errorf("Expected invalid sin to be dropped, got %q", resp.Sin)
+	}
+}
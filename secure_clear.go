@@ -59,6 +59,8 @@ func (si *SqrlIdentity) Clear() {
 	ClearString(&si.Vuk)
 	ClearString(&si.Pidk)
 	ClearString(&si.Rekeyed)
+	ClearString(&si.Sin)
+	ClearString(&si.Ins)
 	si.SQRLOnly = false
 	si.Hardlock = false
 	si.Disabled = false
@@ -74,6 +76,8 @@ func (cb *ClientBody) Clear() {
 	ClearString(&cb.Vuk)
 	ClearString(&cb.Pidk)
 	ClearString(&cb.Idk)
+	ClearString(&cb.Ins)
+	ClearString(&cb.Pins)
 	cb.Version = nil
 	cb.Cmd = ""
 	cb.Opt = nil
@@ -109,6 +113,8 @@ func (hc *HoardCache) Clear() {
 	}
 	ClearBytes(hc.LastResponse)
 	hc.State = ""
+	hc.Transitions = nil
+	hc.Sin = ""
 	hc.RemoteIP = ""
 	hc.OriginalNut = ""
 	hc.PagNut = ""
@@ -2,10 +2,157 @@ package ssp
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
+	"sync/atomic"
 )
 
+// RedactedKey is a key or other secret-ish value that is truncated to 8
+// characters whenever it's logged or formatted
+type RedactedKey string
+
+// LogValue implements slog.LogValuer
+func (k RedactedKey) LogValue() slog.Value {
+	return slog.StringValue(k.String())
+}
+
+func (k RedactedKey) String() string {
+	if k == "" {
+		return "(empty)"
+	}
+	return truncateKey(string(k), 8) + "..."
+}
+
+// MaskedIP is an IP address that is partially masked whenever it's
+// logged or formatted
+type MaskedIP string
+
+// LogValue implements slog.LogValuer
+func (ip MaskedIP) LogValue() slog.Value {
+	return slog.StringValue(ip.String())
+}
+
+func (ip MaskedIP) String() string {
+	return maskIP(string(ip))
+}
+
+// SafeString is user-controlled text that has control characters replaced
+// whenever it's logged or formatted
+type SafeString string
+
+// LogValue implements slog.LogValuer
+func (s SafeString) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+func (s SafeString) String() string {
+	return sanitizeControlChars(string(s))
+}
+
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger used by the SafeLog* helpers and by any
+// SqrlSspAPI without its own Logger. Until set, slog.Default is used.
+func SetLogger(logger *slog.Logger) {
+	packageLogger.Store(logger)
+}
+
+// Logger returns the logger set with SetLogger or slog.Default
+func Logger() *slog.Logger {
+	if logger := packageLogger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// safeLog writes the redacted log records of the SafeLog* helpers to a
+// slog.Logger
+type safeLog struct {
+	logger *slog.Logger
+}
+
+// log returns the SqrlSspAPI.Logger or the package logger
+func (api *SqrlSspAPI) log() safeLog {
+	if api.Logger != nil {
+		return safeLog{api.Logger}
+	}
+	return safeLog{Logger()}
+}
+
+func (sl safeLog) Request(req *CliRequest) {
+	if req == nil {
+		sl.logger.Info("Request: nil")
+		return
+	}
+	if req.Client == nil {
+		sl.logger.Info("Request", "cmd", "unknown", "idk", "nil", "ip", MaskedIP(req.IPAddress))
+		return
+	}
+	sl.logger.Info("Request", "cmd", SafeString(req.Client.Cmd), "idk", RedactedKey(req.Client.Idk), "ip", MaskedIP(req.IPAddress))
+}
+
+func (sl safeLog) Identity(identity *SqrlIdentity) {
+	if identity == nil {
+		sl.logger.Info("Identity: nil")
+		return
+	}
+	sl.logger.Info("Identity", "idk", RedactedKey(identity.Idk), "disabled", identity.Disabled, "rekeyed", identity.Rekeyed != "")
+}
+
+func (sl safeLog) Response(resp *CliResponse) {
+	if resp == nil {
+		sl.logger.Info("Response: nil")
+		return
+	}
+	sl.logger.Info("Response", "nut", RedactedKey(resp.Nut), "tif", fmt.Sprintf("0x%X", resp.TIF))
+}
+
+func (sl safeLog) Error(context string, err error) {
+	if err == nil {
+		return
+	}
+	sl.logger.Error("Error", "context", SafeString(context), "error", SafeString(err.Error()))
+}
+
+func (sl safeLog) ErrorMsg(context string, errMsg string) {
+	sl.logger.Error("Error", "context", SafeString(context), "error", SafeString(errMsg))
+}
+
+// Info logs msg with key/value attributes like slog.Logger.Info. String
+// and error values are logged as SafeString; wrap secrets in RedactedKey
+// or MaskedIP.
+func (sl safeLog) Info(msg string, args ...interface{}) {
+	sl.logger.Info(msg, safeArgs(args)...)
+}
+
+func (sl safeLog) Auth(event string, idk string, success bool) {
+	sl.logger.Info("Auth", "event", SafeString(event), "idk", RedactedKey(idk), "success", success)
+}
+
+// safeArgs wraps the string and error values of slog key/value pairs in
+// SafeString. Other values, including slog.Attrs, are left to their own
+// LogValue or formatting.
+func safeArgs(args []interface{}) []interface{} {
+	safe := make([]interface{}, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		key, ok := args[i].(string)
+		if !ok || i+1 == len(args) {
+			safe = append(safe, args[i])
+			continue
+		}
+		i++
+		switch value := args[i].(type) {
+		case string:
+			safe = append(safe, key, SafeString(value))
+		case error:
+			safe = append(safe, key, SafeString(value.Error()))
+		default:
+			safe = append(safe, key, value)
+		}
+	}
+	return safe
+}
+
 // SafeLogRequest logs a request while redacting sensitive cryptographic fields.
 //
 // If req is nil it logs "Request: nil". If req.Client is nil it logs the request
@@ -13,19 +160,7 @@ import (
 // logs the client command with newlines removed, the Idk truncated for display,
 // and a masked IP address to avoid exposing full sensitive values.
 func SafeLogRequest(req *CliRequest) {
-	if req == nil {
-		log.Printf("Request: nil")
-		return
-	}
-	if req.Client == nil {
-		log.Printf("Request: cmd=unknown, idk=nil, ip=%s", req.IPAddress)
-		return
-	}
-	safeCmd := strings.ReplaceAll(strings.ReplaceAll(req.Client.Cmd, "\n", ""), "\r", "")
-	log.Printf("Request: cmd=%s, idk=%s..., ip=%s",
-		safeCmd,
-		truncateKey(req.Client.Idk, 8),
-		maskIP(req.IPAddress))
+	safeLog{Logger()}.Request(req)
 }
 
 // SafeLogIdentity logs a short, privacy-preserving summary of an identity.
@@ -33,68 +168,48 @@ func SafeLogRequest(req *CliRequest) {
 // key truncated to 8 characters followed by "..." , the Disabled flag, and
 // whether the Rekeyed field is non-empty.
 func SafeLogIdentity(identity *SqrlIdentity) {
-	if identity == nil {
-		log.Printf("Identity: nil")
-		return
-	}
-	log.Printf("Identity: idk=%s..., disabled=%v, rekeyed=%v",
-		truncateKey(identity.Idk, 8),
-		identity.Disabled,
-		identity.Rekeyed != "")
+	safeLog{Logger()}.Identity(identity)
 }
 
 // SafeLogResponse logs a response's nut and TIF while redacting sensitive data.
 // If resp is nil it logs "Response: nil". Otherwise it logs the nut truncated to at most 8 characters followed by "..." and the TIF formatted in hexadecimal (prefixed with 0x).
 func SafeLogResponse(resp *CliResponse) {
-	if resp == nil {
-		log.Printf("Response: nil")
-		return
-	}
-	log.Printf("Response: nut=%s..., tif=0x%X",
-		truncateKey(string(resp.Nut), 8),
-		resp.TIF)
+	safeLog{Logger()}.Response(resp)
 }
 
 // SafeLogError logs the provided error with the given context if err is non-nil.
 // If err is nil, it performs no action. The context parameter is sanitized to
 // prevent log injection attacks.
 func SafeLogError(context string, err error) {
-	if err == nil {
-		return
-	}
-	// Sanitize both context and error message to prevent log injection
-	safeContext := sanitizeControlChars(context)
-	safeErr := sanitizeControlChars(err.Error())
-	log.Printf("Error [%s]: %s", safeContext, safeErr)
+	safeLog{Logger()}.Error(context, err)
 }
 
 // SafeLogErrorMsg logs an error message with sanitized context.
 // Use this for error strings that may contain user-controlled data.
 func SafeLogErrorMsg(context string, errMsg string) {
-	safeContext := sanitizeControlChars(context)
-	safeErr := sanitizeControlChars(errMsg)
-	log.Printf("Error [%s]: %s", safeContext, safeErr)
+	safeLog{Logger()}.ErrorMsg(context, errMsg)
 }
 
 // SafeLogInfo logs an informational message with sanitized content.
 // Use this for any log message that may contain user-controlled data.
+// SafeLogInfoAttrs keeps the values apart as slog attributes instead.
 func SafeLogInfo(format string, args ...interface{}) {
 	// Format the message first, then sanitize
-	msg := fmt.Sprintf(format, args...)
-	safeMsg := sanitizeControlChars(msg)
-	log.Print(safeMsg)
+	Logger().Info(sanitizeControlChars(fmt.Sprintf(format, args...)))
+}
+
+// SafeLogInfoAttrs logs an informational message with key/value
+// attributes. String and error values are sanitized; keep msg constant
+// and pass user-controlled data as attributes.
+func SafeLogInfoAttrs(msg string, args ...interface{}) {
+	safeLog{Logger()}.Info(msg, args...)
 }
 
 // SafeLogAuth logs an authentication event with the identity key truncated for privacy.
 // It records the event name, the idk truncated to at most 8 characters (followed by an ellipsis), and whether the authentication succeeded.
 // The event parameter is sanitized to prevent log injection attacks.
 func SafeLogAuth(event string, idk string, success bool) {
-	// Sanitize event to prevent log injection
-	safeEvent := sanitizeControlChars(event)
-	log.Printf("Auth [%s]: idk=%s..., success=%v",
-		safeEvent,
-		truncateKey(idk, 8),
-		success)
+	safeLog{Logger()}.Auth(event, idk, success)
 }
 
 // truncateKey safely truncates a key for logging purposes and fully removes newline, carriage return, and other control characters.
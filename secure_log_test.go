@@ -1,6 +1,11 @@
 package ssp
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
 	"testing"
 )
 
@@ -197,6 +202,32 @@ func TestSafeLogInfo(t *testing.T) {
 	SafeLogInfo("Test with format: %d items", 42)
 }
 
+func TestSafeLogInfoAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer SetLogger(nil)
+
+	SafeLogInfoAttrs("Test message", "text", "value\ninjected", "error", fmt.Errorf("bad\rerror"),
+		"idk", RedactedKey("abcdefghijklmnop"), "count", 42, slog.String("attr", "kept"), "dangling")
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Failed parsing log record %q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"msg":   "Test message",
+		"text":  "value injected",
+		"error": "bad error",
+		"idk":   "abcdefgh...",
+		"count": float64(42),
+		"attr":  "kept",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s=%v, got %v", key, value, record[key])
+		}
+	}
+}
+
 func TestSafeLogErrorMsg(t *testing.T) {
 	SafeLogErrorMsg("test_context", "normal error")
 	SafeLogErrorMsg("test_context", "error\nwith\nnewlines")
@@ -240,3 +271,72 @@ func BenchmarkSafeLogRequest(b *testing.B) {
 		SafeLogRequest(req)
 	}
 }
+
+func TestLogValuers(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Info("test",
+		"idk", RedactedKey("abcdefghijklmnop"),
+		"ip", MaskedIP("192.168.1.1"),
+		"text", SafeString("line\nbreak"),
+		"empty", RedactedKey(""))
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Failed parsing log record %q: %v", buf.String(), err)
+	}
+	expected := map[string]string{
+		"idk":   "abcdefgh...",
+		"ip":    "192.168.*.*",
+		"text":  "line break",
+		"empty": "(empty)",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s=%q, got %q", key, value, record[key])
+		}
+	}
+	if s := fmt.Sprintf("%v %s", RedactedKey("abcdefghijklmnop"), MaskedIP("10.1.2.3")); s != "abcdefgh... 10.1.*.*" {
+		t.Errorf("Expected formatting to redact, got %q", s)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer SetLogger(nil)
+
+	SafeLogAuth("login\nforged", "abcdefghijklmnop", true)
+	out := buf.String()
+	if !strings.Contains(out, `"event":"login forged"`) || !strings.Contains(out, `"idk":"abcdefgh..."`) {
+		t.Errorf("Expected structured redacted record, got %s", out)
+	}
+	if strings.Contains(out, "ijklmnop") {
+		t.Errorf("Full idk logged: %s", out)
+	}
+}
+
+func TestAPILoggerRedacts(t *testing.T) {
+	var buf bytes.Buffer
+	api := newTestAPI(t)
+	api.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+
+	out := buf.String()
+	if out == "" {
+		t.Fatal("Expected API to log through its Logger")
+	}
+	if strings.Contains(out, client.idk()) {
+		t.Errorf("Full idk logged: %s", out)
+	}
+	if strings.Contains(out, "192.0.2.1") {
+		t.Errorf("Unmasked IP logged: %s", out)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("Expected JSON record, got %q", line)
+		}
+	}
+}
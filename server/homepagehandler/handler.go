@@ -54,7 +54,7 @@ func (ta *TemplatedAssets) Handle(w http.ResponseWriter, r *http.Request) {
 
 	if assetName == "" {
 		// SECURITY: Sanitize URL path to prevent log injection
-		ssp.SafeLogInfo("No asset for path: %s", sanitizeAssetPath(r.URL.Path))
+		ssp.SafeLogInfoAttrs("No asset for path", "path", sanitizeAssetPath(r.URL.Path))
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -62,7 +62,7 @@ func (ta *TemplatedAssets) Handle(w http.ResponseWriter, r *http.Request) {
 	bytes, err := homepage.Asset(assetName)
 	if err != nil {
 		// SECURITY: Sanitize asset name to prevent log injection
-		ssp.SafeLogInfo("Error getting asset %s: %s", sanitizeAssetPath(assetName), sanitizeError(err))
+		ssp.SafeLogInfoAttrs("Error getting asset", "asset", sanitizeAssetPath(assetName), "error", sanitizeError(err))
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -4,15 +4,27 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/dxcSithLord/server-go-ssp/admin"
+	"github.com/dxcSithLord/server-go-ssp/redishoard"
 	"github.com/dxcSithLord/server-go-ssp/server/homepagehandler"
+	"github.com/redis/go-redis/v9"
 )
 
 var certFile, keyFile string
 var hostOverride, rootPath string
+var redisAddr string
+var trustedProxies string
+var trustedProxyHeader string
+var metricsAddr string
+var jsonLogs bool
+var adminAddr string
 var port int
 var help string
 
@@ -22,6 +34,12 @@ func main() {
 	flag.StringVar(&hostOverride, "h", "", "hostname used in creating URLs")
 	flag.StringVar(&rootPath, "path", "", "path used as the root for the SQRL handlers (if not /)")
 	flag.IntVar(&port, "p", 8000, "port to listen on")
+	flag.StringVar(&redisAddr, "redis", "", "host:port of a Redis server used to store nuts (default in-memory)")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated CIDRs of proxies allowed to set forwarding headers")
+	flag.StringVar(&trustedProxyHeader, "trusted-proxy-header", "x-forwarded-for", "forwarding header the trusted proxies write: x-forwarded-for or forwarded")
+	flag.BoolVar(&jsonLogs, "json-logs", false, "write structured JSON logs")
+	flag.StringVar(&adminAddr, "admin", "", "host:port to serve the admin API on; requires SQRL_ADMIN_TOKEN")
+	flag.StringVar(&metricsAddr, "metrics", "", "host:port to serve Prometheus metrics on at /metrics, such as localhost:9100")
 	flag.StringVar(&help, "help", "", "print usage")
 
 	flag.Parse()
@@ -31,21 +49,53 @@ func main() {
 		return
 	}
 
+	if jsonLogs {
+		ssp.SetLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	}
+
 	tree, err := ssp.NewRandomTree(8)
 	if err != nil {
 		log.Fatalf("Failed to create tree: %v", err)
 	}
 
+	metrics := ssp.NewMetrics()
+	metrics.CollectRandomTree(tree)
+
 	authStore := ssp.NewMapAuthStore()
-	hoard := ssp.NewMapHoard()
-	// redisClient := redis.NewUniversalClient(&redis.UniversalOptions{})
-	// hoard := redishoard.NewHoard(redisClient)
-	sspAPI := ssp.NewSqrlSspAPI(tree,
+	mapHoard := ssp.NewMapHoard()
+	hoard := ssp.WrapHoard(mapHoard)
+	if redisAddr == "" {
+		metrics.CollectMapHoard(mapHoard)
+	} else {
+		redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{redisAddr}})
+		hoard = redishoard.NewHoard(redisClient)
+	}
+	sspAPI := ssp.NewSqrlSspAPIContext(tree,
 		hoard,
-		&authy{hostOverride, rootPath},
-		authStore)
+		ssp.WrapAuthenticator(&authy{hostOverride, rootPath}),
+		ssp.WrapAuthStore(authStore))
 	sspAPI.HostOverride = hostOverride
 	sspAPI.RootPath = rootPath
+	sspAPI.Metrics = metrics
+	// hold /pag.sqrl polls until the login finishes, within the WriteTimeout
+	sspAPI.PagWait = 10 * time.Second
+	sspAPI.StatusUpdates = true
+	sspAPI.TrustedProxies, err = ssp.ParseTrustedProxies(strings.Split(trustedProxies, ","))
+	if err != nil {
+		log.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+	sspAPI.TrustedProxyHeader, err = ssp.ParseProxyHeader(trustedProxyHeader)
+	if err != nil {
+		log.Fatalf("Failed to parse trusted proxy header: %v", err)
+	}
+	// pag is polled by the browser while waiting so it gets more headroom
+	sspAPI.RateLimits = ssp.RateLimits{
+		Nut:      ssp.NewTokenBucketLimiter(1, 10),
+		PNG:      ssp.NewTokenBucketLimiter(1, 10),
+		Pag:      ssp.NewTokenBucketLimiter(2, 20),
+		Cli:      ssp.NewTokenBucketLimiter(5, 20),
+		Identity: ssp.NewTokenBucketLimiter(2, 10),
+	}
 
 	// Add existing identity to test Pidk
 	idSeed := &ssp.SqrlIdentity{
@@ -63,11 +113,54 @@ func main() {
 		API: sspAPI,
 	}
 
-	http.HandleFunc("/nut.sqrl", sspAPI.Nut)
-	http.HandleFunc("/png.sqrl", sspAPI.PNG)
-	http.HandleFunc("/pag.sqrl", sspAPI.Pag)
-	http.HandleFunc("/cli.sqrl", sspAPI.Cli)
-	http.HandleFunc("/", hph.Handle)
+	// the SQRL endpoints under rootPath, the demo pages everywhere else
+	sqrlHandler := sspAPI.Handler(ssp.SecurityHeaders)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sqrl") {
+			sqrlHandler.ServeHTTP(w, r)
+			return
+		}
+		hph.Handle(w, r)
+	})
+
+	if adminAddr != "" {
+		token := os.Getenv("SQRL_ADMIN_TOKEN")
+		if token == "" {
+			log.Fatalf("SQRL_ADMIN_TOKEN must be set to serve the admin API")
+		}
+		adminHandler := admin.NewHandler(ssp.WrapAuthStore(authStore), hoard, admin.BearerToken(token))
+		adminHandler.Lister = authStore
+		adminHandler.Rekeys = authStore
+		if redisAddr == "" {
+			adminHandler.Purger = mapHoard
+		}
+		go func() {
+			log.Printf("Admin API listening on %v", adminAddr)
+			adminServer := &http.Server{
+				Addr:         adminAddr,
+				Handler:      adminHandler,
+				ReadTimeout:  15 * time.Second,
+				WriteTimeout: 15 * time.Second,
+			}
+			log.Printf("Failed admin server: %v", adminServer.ListenAndServe())
+		}()
+	}
+
+	// metrics aren't for the public so they get their own listener
+	if metricsAddr != "" {
+		go func() {
+			log.Printf("Metrics listening on %v", metricsAddr)
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle("/metrics", metrics)
+			metricsServer := &http.Server{
+				Addr:         metricsAddr,
+				Handler:      metricsMux,
+				ReadTimeout:  15 * time.Second,
+				WriteTimeout: 15 * time.Second,
+			}
+			log.Printf("Failed metrics server: %v", metricsServer.ListenAndServe())
+		}()
+	}
 
 	listenOn := fmt.Sprintf(":%d", port)
 
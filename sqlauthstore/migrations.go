@@ -0,0 +1,150 @@
+package sqlauthstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migration is a versioned schema change. Migrations are applied in order
+// and each is recorded in the schema table in the same transaction as its
+// statements, so a failed migration leaves no trace.
+type migration struct {
+	version    int
+	statements []string
+	// optional; the statements only run on these dialects. The version
+	// is recorded on every dialect so they stay in step.
+	dialects []Dialect
+}
+
+func (m migration) appliesTo(dialect Dialect) bool {
+	if len(m.dialects) == 0 {
+		return true
+	}
+	for _, d := range m.dialects {
+		if d == dialect {
+			return true
+		}
+	}
+	return false
+}
+
+const schemaTable = "sqrl_schema_migrations"
+
+// migrations must only ever be appended to; never edit one that has been
+// released since existing databases won't re-run it
+var migrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE sqrl_identities (
+				idk VARCHAR(64) NOT NULL,
+				suk VARCHAR(64) NOT NULL DEFAULT '',
+				vuk VARCHAR(64) NOT NULL DEFAULT '',
+				pidk VARCHAR(64) NOT NULL DEFAULT '',
+				sqrl_only BOOLEAN NOT NULL DEFAULT FALSE,
+				hardlock BOOLEAN NOT NULL DEFAULT FALSE,
+				disabled BOOLEAN NOT NULL DEFAULT FALSE,
+				rekeyed VARCHAR(64) NOT NULL DEFAULT '',
+				sin TEXT NOT NULL DEFAULT '',
+				ins VARCHAR(64) NOT NULL DEFAULT '',
+				PRIMARY KEY (idk)
+			)`,
+			`CREATE UNIQUE INDEX sqrl_identities_idk ON sqrl_identities (idk)`,
+			`CREATE INDEX sqrl_identities_rekeyed ON sqrl_identities (rekeyed)`,
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			`CREATE TABLE sqrl_rekeys (
+				previous_idk VARCHAR(64) NOT NULL,
+				idk VARCHAR(64) NOT NULL,
+				remote_ip VARCHAR(64) NOT NULL DEFAULT '',
+				rekeyed_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (previous_idk, idk)
+			)`,
+			`CREATE INDEX sqrl_rekeys_idk ON sqrl_rekeys (idk)`,
+		},
+	},
+	{
+		// the primary key already indexes idk
+		version: 3,
+		statements: []string{
+			`DROP INDEX IF EXISTS sqrl_identities_idk`,
+		},
+	},
+	{
+		// idks are stored as "<namespace>:<idk>" by ssp.NamespaceAuthStore
+		// so they can be longer than 64. SQLite doesn't enforce VARCHAR
+		// lengths.
+		version: 4,
+		statements: []string{
+			`ALTER TABLE sqrl_identities
+				ALTER COLUMN idk TYPE TEXT,
+				ALTER COLUMN pidk TYPE TEXT,
+				ALTER COLUMN rekeyed TYPE TEXT`,
+			`ALTER TABLE sqrl_rekeys
+				ALTER COLUMN previous_idk TYPE TEXT,
+				ALTER COLUMN idk TYPE TEXT`,
+		},
+		dialects: []Dialect{Postgres},
+	},
+}
+
+// Migrate brings the schema up to date. It's safe to call on every start.
+func (s *AuthStore) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		version INTEGER NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (version)
+	)`, schemaTable))
+	if err != nil {
+		return fmt.Errorf("failed creating schema table: %v", err)
+	}
+
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.applyMigration(ctx, m); err != nil {
+			return fmt.Errorf("failed applying migration %d: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 if none
+func (s *AuthStore) SchemaVersion(ctx context.Context) (int, error) {
+	var version sql.NullInt64
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(version) FROM %s", schemaTable)).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed reading schema version: %v", err)
+	}
+	return int(version.Int64), nil
+}
+
+func (s *AuthStore) applyMigration(ctx context.Context, m migration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if m.appliesTo(s.dialect) {
+		for _, statement := range m.statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(fmt.Sprintf("INSERT INTO %s (version) VALUES (?)", schemaTable)), m.version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
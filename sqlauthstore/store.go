@@ -0,0 +1,245 @@
+// Package sqlauthstore implements an ssp.ContextAuthStore on top of database/sql.
+// It works with PostgreSQL and SQLite; the caller opens the *sql.DB with the
+// driver of their choice and tells the store which Dialect it speaks.
+//
+//	db, err := sql.Open("postgres", dsn)
+//	store := sqlauthstore.New(db, sqlauthstore.Postgres)
+//	err = store.Migrate(ctx)
+//
+// Identities are keyed by Idk with a unique index, and the Rekeyed link is
+// indexed so superseded identities can be found from their replacement.
+// AuthStore implements ssp.TxAuthStore so all identity changes of a
+// /cli.sqrl request are made in a single database transaction, and
+// ssp.RekeyStore to keep an audit trail of rekeys in sqrl_rekeys.
+package sqlauthstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+// Dialect selects the SQL flavour of the underlying database
+type Dialect int
+
+const (
+	// Postgres uses $1 style placeholders
+	Postgres Dialect = iota
+	// SQLite uses ? style placeholders
+	SQLite
+)
+
+// rebind converts ? placeholders to the dialect's style
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+const identityColumns = "idk, suk, vuk, pidk, sqrl_only, hardlock, disabled, rekeyed, sin, ins"
+
+// querier is the subset of *sql.DB and *sql.Tx used for identities
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// AuthStore implements ssp.ContextAuthStore using a SQL database
+type AuthStore struct {
+	identities
+	db *sql.DB
+}
+
+// identities implements the identity queries against a database or transaction
+type identities struct {
+	q       querier
+	dialect Dialect
+}
+
+// New creates an AuthStore; call Migrate before first use
+func New(db *sql.DB, dialect Dialect) *AuthStore {
+	return &AuthStore{
+		identities: identities{q: db, dialect: dialect},
+		db:         db,
+	}
+}
+
+// Tx is an ssp.AuthStoreTx backed by a database transaction
+type Tx struct {
+	identities
+	tx *sql.Tx
+}
+
+// BeginTx implements ssp.TxAuthStore
+func (s *AuthStore) BeginTx(ctx context.Context) (ssp.AuthStoreTx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed beginning transaction: %v", err)
+	}
+	return &Tx{
+		identities: identities{q: tx, dialect: s.dialect},
+		tx:         tx,
+	}, nil
+}
+
+// Commit implements ssp.AuthStoreTx
+func (t *Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback implements ssp.AuthStoreTx
+func (t *Tx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// FindIdentity implements ssp.ContextAuthStore
+func (s *identities) FindIdentity(ctx context.Context, idk string) (*ssp.SqrlIdentity, error) {
+	row := s.q.QueryRowContext(ctx, s.dialect.rebind(
+		"SELECT "+identityColumns+" FROM sqrl_identities WHERE idk = ?"), idk)
+	identity, err := scanIdentity(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ssp.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed finding identity: %v", err)
+	}
+	return identity, nil
+}
+
+// FindRekeyedTo returns the identities that have been rekeyed to idk
+func (s *identities) FindRekeyedTo(ctx context.Context, idk string) ([]*ssp.SqrlIdentity, error) {
+	if idk == "" {
+		return nil, nil
+	}
+	rows, err := s.q.QueryContext(ctx, s.dialect.rebind(
+		"SELECT "+identityColumns+" FROM sqrl_identities WHERE rekeyed = ? ORDER BY idk"), idk)
+	if err != nil {
+		return nil, fmt.Errorf("failed finding rekeyed identities: %v", err)
+	}
+	defer rows.Close()
+	var identities []*ssp.SqrlIdentity
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading identity: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// ListIdentities implements ssp.IdentityLister
+func (s *identities) ListIdentities(ctx context.Context, after string, limit int) ([]*ssp.SqrlIdentity, error) {
+	query := "SELECT " + identityColumns + " FROM sqrl_identities WHERE idk > ? ORDER BY idk"
+	args := []interface{}{after}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := s.q.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing identities: %v", err)
+	}
+	defer rows.Close()
+	var identities []*ssp.SqrlIdentity
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading identity: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// SaveIdentity implements ssp.ContextAuthStore. It inserts or updates by Idk.
+func (s *identities) SaveIdentity(ctx context.Context, identity *ssp.SqrlIdentity) error {
+	if identity == nil || identity.Idk == "" {
+		return fmt.Errorf("identity requires an idk")
+	}
+	_, err := s.q.ExecContext(ctx, s.dialect.rebind(
+		"INSERT INTO sqrl_identities ("+identityColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT (idk) DO UPDATE SET suk = excluded.suk, vuk = excluded.vuk, pidk = excluded.pidk, "+
+			"sqrl_only = excluded.sqrl_only, hardlock = excluded.hardlock, disabled = excluded.disabled, "+
+			"rekeyed = excluded.rekeyed, sin = excluded.sin, ins = excluded.ins"),
+		identity.Idk, identity.Suk, identity.Vuk, identity.Pidk,
+		identity.SQRLOnly, identity.Hardlock, identity.Disabled,
+		identity.Rekeyed, identity.Sin, identity.Ins)
+	if err != nil {
+		return fmt.Errorf("failed saving identity: %v", err)
+	}
+	return nil
+}
+
+// DeleteIdentity implements ssp.ContextAuthStore
+func (s *identities) DeleteIdentity(ctx context.Context, idk string) error {
+	_, err := s.q.ExecContext(ctx, s.dialect.rebind(
+		"DELETE FROM sqrl_identities WHERE idk = ?"), idk)
+	if err != nil {
+		return fmt.Errorf("failed deleting identity: %v", err)
+	}
+	return nil
+}
+
+// SaveRekey implements ssp.RekeyStore
+func (s *identities) SaveRekey(ctx context.Context, rekey *ssp.Rekey) error {
+	_, err := s.q.ExecContext(ctx, s.dialect.rebind(
+		"INSERT INTO sqrl_rekeys (previous_idk, idk, remote_ip, rekeyed_at) VALUES (?, ?, ?, ?)"),
+		rekey.PreviousIdk, rekey.Idk, rekey.RemoteIP, rekey.Time.UTC())
+	if err != nil {
+		return fmt.Errorf("failed saving rekey: %v", err)
+	}
+	return nil
+}
+
+// FindRekeys implements ssp.RekeyStore
+func (s *identities) FindRekeys(ctx context.Context, idk string) ([]*ssp.Rekey, error) {
+	rows, err := s.q.QueryContext(ctx, s.dialect.rebind(
+		"SELECT previous_idk, idk, remote_ip, rekeyed_at FROM sqrl_rekeys "+
+			"WHERE previous_idk = ? OR idk = ? ORDER BY rekeyed_at"), idk, idk)
+	if err != nil {
+		return nil, fmt.Errorf("failed finding rekeys: %v", err)
+	}
+	defer rows.Close()
+	var rekeys []*ssp.Rekey
+	for rows.Next() {
+		rekey := &ssp.Rekey{}
+		if err := rows.Scan(&rekey.PreviousIdk, &rekey.Idk, &rekey.RemoteIP, &rekey.Time); err != nil {
+			return nil, fmt.Errorf("failed reading rekey: %v", err)
+		}
+		rekeys = append(rekeys, rekey)
+	}
+	return rekeys, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanIdentity(row scanner) (*ssp.SqrlIdentity, error) {
+	identity := &ssp.SqrlIdentity{Btn: -1}
+	err := row.Scan(&identity.Idk, &identity.Suk, &identity.Vuk, &identity.Pidk,
+		&identity.SQRLOnly, &identity.Hardlock, &identity.Disabled,
+		&identity.Rekeyed, &identity.Sin, &identity.Ins)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
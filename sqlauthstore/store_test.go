@@ -0,0 +1,314 @@
+package sqlauthstore
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/dxcSithLord/server-go-ssp/ssptest"
+	_ "modernc.org/sqlite"
+)
+
+func newTestStore(t *testing.T) *AuthStore {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("Failed opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store := New(db, SQLite)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("Failed migrating: %v", err)
+	}
+	return store
+}
+
+func TestMigrateIdempotent(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("Second migrate failed: %v", err)
+	}
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("Failed reading version: %v", err)
+	}
+	if version != migrations[len(migrations)-1].version {
+		t.Errorf("Expected schema version %d, got %d", migrations[len(migrations)-1].version, version)
+	}
+}
+
+func TestMigrateDropsIdkIndex(t *testing.T) {
+	store := newTestStore(t)
+	var count int
+	err := store.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'sqrl_identities_idk'`).Scan(&count)
+	if err != nil {
+		t.Fatalf("Failed reading indexes: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected the duplicate idk index dropped")
+	}
+}
+
+func TestMigrationDialects(t *testing.T) {
+	all := migration{version: 1}
+	postgres := migration{version: 2, dialects: []Dialect{Postgres}}
+	if !all.appliesTo(SQLite) || !all.appliesTo(Postgres) {
+		t.Error("Expected a migration without dialects to apply everywhere")
+	}
+	if postgres.appliesTo(SQLite) || !postgres.appliesTo(Postgres) {
+		t.Error("Expected a Postgres migration to apply to Postgres only")
+	}
+}
+
+func TestNamespacedIdk(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	namespaced := ssp.NamespaceAuthStore(store, "a-site-with-a-fairly-long-namespace.example.com")
+
+	idk := "Jjl2OhUyP93M14-AQ3stYMaoZ2vq1BHfmAhxWp_E9rw"
+	identity := &ssp.SqrlIdentity{Idk: idk, Pidk: "previous-" + idk, Rekeyed: "next-" + idk}
+	if err := namespaced.SaveIdentity(ctx, identity); err != nil {
+		t.Fatalf("Failed saving: %v", err)
+	}
+	found, err := namespaced.FindIdentity(ctx, idk)
+	if err != nil {
+		t.Fatalf("Failed finding: %v", err)
+	}
+	if found.Idk != idk || found.Pidk != identity.Pidk || found.Rekeyed != identity.Rekeyed {
+		t.Errorf("Expected %+v, got %+v", identity, found)
+	}
+}
+
+func TestSaveAndFindIdentity(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	identity := &ssp.SqrlIdentity{
+		Idk:      "idk",
+		Suk:      "suk",
+		Vuk:      "vuk",
+		Pidk:     "pidk",
+		SQRLOnly: true,
+		Hardlock: true,
+		Sin:      "sin",
+		Ins:      "ins",
+	}
+	if err := store.SaveIdentity(ctx, identity); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	found, err := store.FindIdentity(ctx, "idk")
+	if err != nil {
+		t.Fatalf("Failed find: %v", err)
+	}
+	identity.Btn = -1
+	if *found != *identity {
+		t.Errorf("Round trip mismatch:\n got %+v\nwant %+v", found, identity)
+	}
+
+	// saving again updates in place
+	identity.Disabled = true
+	identity.Rekeyed = "newidk"
+	if err := store.SaveIdentity(ctx, identity); err != nil {
+		t.Fatalf("Failed update: %v", err)
+	}
+	found, err = store.FindIdentity(ctx, "idk")
+	if err != nil {
+		t.Fatalf("Failed find: %v", err)
+	}
+	if !found.Disabled || found.Rekeyed != "newidk" {
+		t.Errorf("Update not saved: %+v", found)
+	}
+}
+
+func TestFindIdentityNotFound(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if _, err := store.FindIdentity(ctx, "missing"); err != ssp.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDeleteIdentity(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.SaveIdentity(ctx, &ssp.SqrlIdentity{Idk: "idk"}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if err := store.DeleteIdentity(ctx, "idk"); err != nil {
+		t.Fatalf("Failed delete: %v", err)
+	}
+	if _, err := store.FindIdentity(ctx, "idk"); err != ssp.ErrNotFound {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestSaveIdentityRequiresIdk(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.SaveIdentity(ctx, &ssp.SqrlIdentity{}); err == nil {
+		t.Error("Expected error saving identity without idk")
+	}
+	if err := store.SaveIdentity(ctx, nil); err == nil {
+		t.Error("Expected error saving nil identity")
+	}
+}
+
+func TestFindRekeyedTo(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	for _, identity := range []*ssp.SqrlIdentity{
+		{Idk: "old1", Rekeyed: "new"},
+		{Idk: "old2", Rekeyed: "new"},
+		{Idk: "new"},
+	} {
+		if err := store.SaveIdentity(ctx, identity); err != nil {
+			t.Fatalf("Failed save: %v", err)
+		}
+	}
+	previous, err := store.FindRekeyedTo(ctx, "new")
+	if err != nil {
+		t.Fatalf("Failed lookup: %v", err)
+	}
+	if len(previous) != 2 || previous[0].Idk != "old1" || previous[1].Idk != "old2" {
+		t.Errorf("Wrong rekeyed identities: %+v", previous)
+	}
+}
+
+func TestListIdentities(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	for _, idk := range []string{"c", "a", "b"} {
+		if err := store.SaveIdentity(ctx, &ssp.SqrlIdentity{Idk: idk}); err != nil {
+			t.Fatalf("Failed save: %v", err)
+		}
+	}
+	page, err := store.ListIdentities(ctx, "", 2)
+	if err != nil {
+		t.Fatalf("Failed list: %v", err)
+	}
+	if len(page) != 2 || page[0].Idk != "a" || page[1].Idk != "b" {
+		t.Errorf("Wrong first page: %+v", page)
+	}
+	page, err = store.ListIdentities(ctx, "b", 0)
+	if err != nil {
+		t.Fatalf("Failed list: %v", err)
+	}
+	if len(page) != 1 || page[0].Idk != "c" {
+		t.Errorf("Wrong last page: %+v", page)
+	}
+}
+
+func TestPostgresRebind(t *testing.T) {
+	query := Postgres.rebind("SELECT a FROM b WHERE c = ? AND d = ?")
+	if query != "SELECT a FROM b WHERE c = $1 AND d = $2" {
+		t.Errorf("Wrong rebind: %s", query)
+	}
+	query = SQLite.rebind("SELECT a FROM b WHERE c = ?")
+	if query != "SELECT a FROM b WHERE c = ?" {
+		t.Errorf("SQLite should not rebind: %s", query)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Failed begin: %v", err)
+	}
+	if err := tx.SaveIdentity(ctx, &ssp.SqrlIdentity{Idk: "idk"}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if _, err := tx.FindIdentity(ctx, "idk"); err != nil {
+		t.Errorf("Write not visible in transaction: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed rollback: %v", err)
+	}
+	if _, err := store.FindIdentity(ctx, "idk"); err != ssp.ErrNotFound {
+		t.Errorf("Expected ErrNotFound after rollback, got %v", err)
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Failed begin: %v", err)
+	}
+	if err := tx.SaveIdentity(ctx, &ssp.SqrlIdentity{Idk: "idk"}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed commit: %v", err)
+	}
+	if _, err := store.FindIdentity(ctx, "idk"); err != nil {
+		t.Errorf("Committed identity not found: %v", err)
+	}
+}
+
+func TestRekeyHistory(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	start := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("Failed begin: %v", err)
+	}
+	rekeys, ok := tx.(ssp.RekeyStore)
+	if !ok {
+		t.Fatal("Expected Tx to implement ssp.RekeyStore")
+	}
+	if err := rekeys.SaveRekey(ctx, &ssp.Rekey{PreviousIdk: "a", Idk: "b", RemoteIP: "192.0.2.1", Time: start}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed rollback: %v", err)
+	}
+	if history, _ := store.FindRekeys(ctx, "a"); len(history) != 0 {
+		t.Errorf("Expected rekey rolled back, got %+v", history)
+	}
+
+	for i, rekey := range []*ssp.Rekey{
+		{PreviousIdk: "a", Idk: "b", RemoteIP: "192.0.2.1", Time: start},
+		{PreviousIdk: "b", Idk: "c", Time: start.Add(time.Second)},
+	} {
+		if err := store.SaveRekey(ctx, rekey); err != nil {
+			t.Fatalf("Failed save %d: %v", i, err)
+		}
+	}
+	history, err := store.FindRekeys(ctx, "b")
+	if err != nil {
+		t.Fatalf("Failed lookup: %v", err)
+	}
+	if len(history) != 2 || history[0].PreviousIdk != "a" || history[1].Idk != "c" {
+		t.Fatalf("Wrong history: %+v", history)
+	}
+	if history[0].RemoteIP != "192.0.2.1" || !history[0].Time.Equal(start) {
+		t.Errorf("Wrong audit details: %+v", history[0])
+	}
+	if err := store.SaveRekey(ctx, &ssp.Rekey{PreviousIdk: "a", Idk: "b", Time: start}); err == nil {
+		t.Error("Expected duplicate rekey to fail")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	api := ssp.NewSqrlSspAPIContext(nil, ssp.WrapHoard(ssp.NewMapHoard()), nil, newTestStore(t))
+	api.Authenticator = ssptest.NewAuthenticator()
+	ssptest.RunTests(t, &ssptest.Target{Handler: api.Handler()})
+}
+
+func TestAuthStoreSuite(t *testing.T) {
+	suite := &ssptest.AuthStoreSuite{New: func(t *testing.T) ssp.ContextAuthStore {
+		return newTestStore(t)
+	}}
+	suite.Run(t)
+}
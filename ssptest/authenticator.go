@@ -0,0 +1,59 @@
+package ssptest
+
+import (
+	"sync"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+// Authenticator is an ssp.Authenticator accepting every identity, for
+// running a server under test
+type Authenticator struct {
+	// optional; returned by AskResponse
+	Ask *ssp.Ask
+
+	mutex *sync.Mutex
+	users map[string]bool
+}
+
+// NewAuthenticator creates an Authenticator with no users
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{mutex: &sync.Mutex{}, users: make(map[string]bool)}
+}
+
+// AuthenticateIdentity implements ssp.Authenticator
+func (a *Authenticator) AuthenticateIdentity(identity *ssp.SqrlIdentity) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.users[identity.Idk] = true
+	return "https://example.com/welcome?idk=" + identity.Idk
+}
+
+// SwapIdentities implements ssp.Authenticator
+func (a *Authenticator) SwapIdentities(previous, identity *ssp.SqrlIdentity) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.users, previous.Idk)
+	a.users[identity.Idk] = true
+	return nil
+}
+
+// RemoveIdentity implements ssp.Authenticator
+func (a *Authenticator) RemoveIdentity(identity *ssp.SqrlIdentity) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.users, identity.Idk)
+	return nil
+}
+
+// AskResponse implements ssp.Authenticator
+func (a *Authenticator) AskResponse(identity *ssp.SqrlIdentity) *ssp.Ask {
+	return a.Ask
+}
+
+// User is true if idk has logged in and hasn't been swapped or removed
+func (a *Authenticator) User(idk string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.users[idk]
+}
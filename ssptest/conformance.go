@@ -0,0 +1,543 @@
+package ssptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/dxcSithLord/server-go-ssp/client"
+)
+
+// Addresses the browser and phone use with a Handler Target
+const (
+	BrowserAddr = "192.0.2.10:40000"
+	OtherAddr   = "198.51.100.20:40000"
+)
+
+// Target is the SSP server the conformance scenarios run against
+type Target struct {
+	// Handler serves the SQRL endpoints; requests are passed to it directly
+	// with BrowserAddr or OtherAddr as their RemoteAddr
+	Handler http.Handler
+	// BaseURL is where the endpoints are, such as
+	// "https://staging.example.com/sqrl". With a Handler only the path is
+	// used; it defaults to "http://ssp.test".
+	BaseURL string
+	// optional; used to reach BaseURL when there's no Handler
+	HTTPClient *http.Client
+}
+
+// Scenario is one scripted exchange with the server
+type Scenario struct {
+	Name string
+	// Clause is the part of the SQRL specification being checked
+	Clause string
+	// TwoAddresses is set when the scenario needs the phone on a different
+	// IP address than the browser, which is only possible with a Handler
+	TwoAddresses bool
+	Run          func(ctx context.Context, h *Harness) error
+}
+
+// Result is the outcome of a Scenario
+type Result struct {
+	Scenario Scenario
+	// Err is why the scenario failed; nil if it passed or was skipped
+	Err     error
+	Skipped bool
+}
+
+// Passed is true if the scenario ran without error
+func (r *Result) Passed() bool {
+	return !r.Skipped && r.Err == nil
+}
+
+func (r *Result) String() string {
+	switch {
+	case r.Skipped:
+		return fmt.Sprintf("SKIP %v (%v)", r.Scenario.Name, r.Scenario.Clause)
+	case r.Err != nil:
+		return fmt.Sprintf("FAIL %v (%v): %v", r.Scenario.Name, r.Scenario.Clause, r.Err)
+	}
+	return fmt.Sprintf("PASS %v (%v)", r.Scenario.Name, r.Scenario.Clause)
+}
+
+// Run runs scenarios against target, or the whole Catalogue if there are
+// none. Each scenario uses its own random identities so they can run
+// against a server with other traffic.
+func Run(ctx context.Context, target *Target, scenarios ...Scenario) []*Result {
+	if len(scenarios) == 0 {
+		scenarios = Catalogue()
+	}
+	results := make([]*Result, 0, len(scenarios))
+	for _, scenario := range scenarios {
+		result := &Result{Scenario: scenario}
+		if scenario.TwoAddresses && target.Handler == nil {
+			result.Skipped = true
+		} else {
+			h, err := newHarness(target)
+			if err == nil {
+				err = scenario.Run(ctx, h)
+			}
+			result.Err = err
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// RunTests runs the Catalogue against target as subtests of t
+func RunTests(t *testing.T, target *Target) {
+	for _, result := range Run(context.Background(), target) {
+		t.Run(result.Scenario.Name, func(t *testing.T) {
+			if result.Skipped {
+				t.Skipf("%v needs a Handler target", result.Scenario.Name)
+			}
+			if result.Err != nil {
+				t.Errorf("%v: %v", result.Scenario.Clause, result.Err)
+			}
+		})
+	}
+}
+
+// Harness is what a Scenario runs with
+type Harness struct {
+	target *Target
+	base   string
+	// Site is the name site keys are derived from
+	Site string
+}
+
+func newHarness(target *Target) (*Harness, error) {
+	base := strings.TrimSuffix(target.BaseURL, "/")
+	if base == "" {
+		base = "http://ssp.test"
+	}
+	sqrlURL := strings.Replace(base, "http", ssp.SqrlScheme, 1)
+	if strings.HasPrefix(base, "https") {
+		sqrlURL = strings.Replace(base, "https", ssp.SqrlScheme, 1)
+	}
+	site, err := SiteName(sqrlURL + "/cli.sqrl")
+	if err != nil {
+		return nil, err
+	}
+	return &Harness{target: target, base: base, Site: site}, nil
+}
+
+// NewIdentity creates a random identity for the site, replacing previous
+// if it isn't nil
+func (h *Harness) NewIdentity(previous *Identity) (*Identity, *client.Client, error) {
+	identity, err := RandomIdentity()
+	if err != nil {
+		return nil, nil, err
+	}
+	siteIdentity, err := identity.SiteIdentity(h.Site, previous)
+	if err != nil {
+		return nil, nil, err
+	}
+	return identity, &client.Client{Identity: siteIdentity}, nil
+}
+
+// Begin gets a nut as the browser would and returns the Session of c
+// sending from addr, BrowserAddr or OtherAddr
+func (h *Harness) Begin(ctx context.Context, c *client.Client, addr string) (*client.Session, error) {
+	c.HTTPClient = h.httpClient(BrowserAddr)
+	session, err := c.Begin(ctx, h.base)
+	c.HTTPClient = h.httpClient(addr)
+	if err != nil {
+		return nil, fmt.Errorf("getting a nut: %v", err)
+	}
+	return session, nil
+}
+
+func (h *Harness) httpClient(addr string) *http.Client {
+	if h.target.Handler == nil {
+		return h.target.HTTPClient
+	}
+	return &http.Client{Transport: &handlerTransport{handler: h.target.Handler, remoteAddr: addr}}
+}
+
+// Expect sends cmd and checks the TIF of the response is exactly tif
+func (h *Harness) Expect(ctx context.Context, session *client.Session, cmd string, tif uint32) (*ssp.CliResponse, error) {
+	response, err := session.Send(ctx, cmd, -1)
+	var commandErr *client.CommandError
+	if err != nil && !errors.As(err, &commandErr) {
+		return nil, fmt.Errorf("%v: %v", cmd, err)
+	}
+	return response, CheckTIF(cmd, response.TIF, tif)
+}
+
+// CheckTIF compares a TIF with the expected one, describing both with
+// TIFDesc. Bits TIFDesc doesn't describe are always an error.
+func CheckTIF(step string, tif, expected uint32) error {
+	var known uint32
+	for bit := range ssp.TIFDesc {
+		known |= bit
+	}
+	if tif&^known != 0 {
+		return fmt.Errorf("%v: undefined tif bits 0x%x", step, tif&^known)
+	}
+	if tif != expected {
+		return fmt.Errorf("%v: expected tif 0x%x (%v), got 0x%x (%v)", step,
+			expected, client.DescribeTIF(expected), tif, client.DescribeTIF(tif))
+	}
+	return nil
+}
+
+// login runs a whole login for c and checks it succeeds
+func (h *Harness) login(ctx context.Context, c *client.Client) error {
+	session, err := h.Begin(ctx, c, BrowserAddr)
+	if err != nil {
+		return err
+	}
+	if _, err := session.Login(ctx); err != nil {
+		return fmt.Errorf("login: %v", err)
+	}
+	return nil
+}
+
+// handlerTransport passes requests to a Handler from remoteAddr
+type handlerTransport struct {
+	handler    http.Handler
+	remoteAddr string
+}
+
+func (ht *handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.RemoteAddr = ht.remoteAddr
+	r.RequestURI = r.URL.RequestURI()
+	w := httptest.NewRecorder()
+	ht.handler.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// Shorthands for the TIF bits the catalogue expects
+const (
+	idMatch     = ssp.TIFIDMatch
+	previous    = ssp.TIFPreviousIDMatch
+	ipMatch     = ssp.TIFIPMatched
+	disabled    = ssp.TIFSQRLDisabled
+	unsupported = ssp.TIFFunctionNotSupported
+	failed      = ssp.TIFCommandFailed
+	clientFail  = ssp.TIFClientFailure
+	superseded  = ssp.TIFIdentitySuperseded
+)
+
+// Catalogue is the scenarios Run runs by default
+func Catalogue() []Scenario {
+	return []Scenario{
+		{
+			Name:   "new identity",
+			Clause: "SQRL on the wire: query and ident of an unknown idk",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "query", ipMatch); err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "ident", idMatch|ipMatch); err != nil {
+					return err
+				}
+				redirect, err := session.Redirect(ctx)
+				if err != nil {
+					return fmt.Errorf("pag: %v", err)
+				}
+				if redirect == "" {
+					return fmt.Errorf("pag: no redirect")
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "known identity",
+			Clause: "SQRL on the wire: tif 0x01 for a known idk",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				if err := h.login(ctx, c); err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "query", idMatch|ipMatch); err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "ident", idMatch|ipMatch)
+				return err
+			},
+		},
+		{
+			Name:   "replayed nut",
+			Clause: "SQRL operating details: nuts are single use",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				qry, server := session.Qry, session.Server
+				if _, err := h.Expect(ctx, session, "query", ipMatch); err != nil {
+					return err
+				}
+				session.Qry, session.Server = qry, server
+				_, err = h.Expect(ctx, session, "query", failed|clientFail)
+				return err
+			},
+		},
+		{
+			Name:   "wrong server echo",
+			Clause: "SQRL on the wire: server must echo the previous response",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "query", ipMatch); err != nil {
+					return err
+				}
+				session.Server = ssp.Sqrl64.EncodeToString([]byte("ver=1\r\nnut=forged\r\ntif=5\r\nqry=/cli.sqrl\r\n"))
+				_, err = h.Expect(ctx, session, "ident", failed)
+				return err
+			},
+		},
+		{
+			Name:         "IP mismatch",
+			Clause:       "SQRL on the wire: tif 0x04 and the same-device IP check",
+			TwoAddresses: true,
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, OtherAddr)
+				if err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "query", failed)
+				return err
+			},
+		},
+		{
+			Name:         "IP mismatch with noiptest",
+			Clause:       "SQRL on the wire: opt noiptest",
+			TwoAddresses: true,
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				c.Opt = []string{"noiptest"}
+				session, err := h.Begin(ctx, c, OtherAddr)
+				if err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "query", 0); err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "ident", idMatch)
+				return err
+			},
+		},
+		{
+			Name:   "disable, enable and remove",
+			Clause: "SQRL on the wire: disable, enable and remove with urs",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				if err := h.login(ctx, c); err != nil {
+					return err
+				}
+				steps := []struct {
+					cmd        string
+					query, tif uint32
+				}{
+					{"disable", idMatch | ipMatch, idMatch | ipMatch | disabled},
+					{"ident", idMatch | ipMatch | disabled, idMatch | ipMatch | disabled | failed},
+					{"enable", idMatch | ipMatch | disabled, idMatch | ipMatch},
+					{"ident", idMatch | ipMatch, idMatch | ipMatch},
+					{"remove", idMatch | ipMatch, ipMatch},
+				}
+				for _, step := range steps {
+					session, err := h.Begin(ctx, c, BrowserAddr)
+					if err != nil {
+						return err
+					}
+					if _, err := h.Expect(ctx, session, "query", step.query); err != nil {
+						return fmt.Errorf("before %v: %v", step.cmd, err)
+					}
+					if _, err := h.Expect(ctx, session, step.cmd, step.tif); err != nil {
+						return err
+					}
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "query", ipMatch)
+				return err
+			},
+		},
+		{
+			Name:   "enable without a valid urs",
+			Clause: "SQRL on the wire: urs must verify against the vuk",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				if err := h.login(ctx, c); err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "disable", idMatch|ipMatch|disabled); err != nil {
+					return err
+				}
+				// an unlock key from another identity
+				other, _, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				if c.Identity.Unlock, err = other.Ursk(c.Identity.Suk); err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "enable", idMatch|ipMatch|disabled|failed|clientFail)
+				return err
+			},
+		},
+		{
+			Name:   "rekey with pidk",
+			Clause: "SQRL on the wire: tif 0x02 and identity replacement",
+			Run: func(ctx context.Context, h *Harness) error {
+				first, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				if err := h.login(ctx, c); err != nil {
+					return err
+				}
+				_, c, err = h.NewIdentity(first)
+				if err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				response, err := h.Expect(ctx, session, "query", previous|ipMatch)
+				if err != nil {
+					return err
+				}
+				if response.Suk == "" {
+					return fmt.Errorf("query: no suk returned on a previous identity match")
+				}
+				if _, err := h.Expect(ctx, session, "ident", idMatch|ipMatch); err != nil {
+					return err
+				}
+				c.Identity.Previous = nil
+				session, err = h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "query", idMatch|ipMatch)
+				return err
+			},
+		},
+		{
+			Name:   "superseded identity",
+			Clause: "SQRL on the wire: tif 0x200",
+			Run: func(ctx context.Context, h *Harness) error {
+				first, old, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				if err := h.login(ctx, old); err != nil {
+					return err
+				}
+				_, c, err := h.NewIdentity(first)
+				if err != nil {
+					return err
+				}
+				if err := h.login(ctx, c); err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, old, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "query", ipMatch|superseded); err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "ident", ipMatch|superseded|failed)
+				return err
+			},
+		},
+		{
+			Name:   "unknown command",
+			Clause: "SQRL on the wire: tif 0x10 is set with 0x40",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				_, err = h.Expect(ctx, session, "frobnicate", ipMatch|unsupported|failed)
+				return err
+			},
+		},
+		{
+			Name:   "cps",
+			Clause: "SQRL on the wire: opt cps returns the url",
+			Run: func(ctx context.Context, h *Harness) error {
+				_, c, err := h.NewIdentity(nil)
+				if err != nil {
+					return err
+				}
+				c.Opt = []string{"cps"}
+				session, err := h.Begin(ctx, c, BrowserAddr)
+				if err != nil {
+					return err
+				}
+				if _, err := h.Expect(ctx, session, "query", ipMatch); err != nil {
+					return err
+				}
+				response, err := h.Expect(ctx, session, "ident", idMatch|ipMatch)
+				if err != nil {
+					return err
+				}
+				if response.URL == "" {
+					return fmt.Errorf("ident: no url with cps")
+				}
+				return nil
+			},
+		},
+	}
+}
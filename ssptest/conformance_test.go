@@ -0,0 +1,52 @@
+package ssptest
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+func newConformanceAPI(t *testing.T) *ssp.SqrlSspAPI {
+	tree, err := ssp.NewRandomTree(18)
+	if err != nil {
+		t.Fatalf("Failed to create tree: %v", err)
+	}
+	return ssp.NewSqrlSspAPI(tree, ssp.NewMapHoard(), NewAuthenticator(), ssp.NewMapAuthStore())
+}
+
+func TestConformanceHandler(t *testing.T) {
+	api := newConformanceAPI(t)
+	api.RootPath = "/sqrl"
+	RunTests(t, &Target{Handler: api.Handler(), BaseURL: "https://sqrl.example.com/sqrl"})
+}
+
+func TestConformanceURL(t *testing.T) {
+	server := httptest.NewServer(newConformanceAPI(t).Handler())
+	defer server.Close()
+	results := Run(context.Background(), &Target{BaseURL: server.URL, HTTPClient: server.Client()})
+	if len(results) != len(Catalogue()) {
+		t.Fatalf("Expected a result per scenario, got %d", len(results))
+	}
+	for _, result := range results {
+		if result.Scenario.TwoAddresses != result.Skipped {
+			t.Errorf("Expected only scenarios needing two addresses skipped: %v", result)
+		}
+		if !result.Skipped && !result.Passed() {
+			t.Errorf("%v", result)
+		}
+	}
+}
+
+func TestCheckTIF(t *testing.T) {
+	if err := CheckTIF("query", ssp.TIFIDMatch|ssp.TIFIPMatched, ssp.TIFIDMatch|ssp.TIFIPMatched); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := CheckTIF("query", ssp.TIFIPMatched, ssp.TIFIDMatch|ssp.TIFIPMatched); err == nil {
+		t.Errorf("Expected a missing bit reported")
+	}
+	if err := CheckTIF("query", 0x1000, 0x1000); err == nil {
+		t.Errorf("Expected an undefined bit reported")
+	}
+}
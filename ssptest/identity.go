@@ -0,0 +1,205 @@
+// Package ssptest derives SQRL identities the way the SQRL cryptography
+// document describes, so tests can cover the whole lifecycle (ident,
+// rekey, enable and remove) with real keys instead of copied constants.
+//
+// Rescue codes and the EnScrypt password step aren't implemented; an
+// Identity starts from its identity unlock key.
+package ssptest
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/dxcSithLord/server-go-ssp/client"
+)
+
+// KeySize is the size of the unlock, master and lock keys
+const KeySize = 32
+
+// Identity is a SQRL identity: the identity unlock key (IUK) a user keeps
+// offline and the keys derived from it
+type Identity struct {
+	// IUK is the identity unlock key
+	IUK []byte
+	// IMK is the identity master key, EnHash(IUK), from which site keys
+	// are derived
+	IMK []byte
+	// ILK is the identity lock key, the X25519 public key of IUK
+	ILK []byte
+}
+
+// NewIdentity derives an Identity from a 32 byte IUK
+func NewIdentity(iuk []byte) (*Identity, error) {
+	if len(iuk) != KeySize {
+		return nil, fmt.Errorf("IUK is %d bytes", len(iuk))
+	}
+	private, err := ecdh.X25519().NewPrivateKey(iuk)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		IUK: append([]byte(nil), iuk...),
+		IMK: EnHash(iuk),
+		ILK: private.PublicKey().Bytes(),
+	}, nil
+}
+
+// RandomIdentity creates an Identity with a random IUK
+func RandomIdentity() (*Identity, error) {
+	iuk := make([]byte, KeySize)
+	if _, err := rand.Read(iuk); err != nil {
+		return nil, err
+	}
+	return NewIdentity(iuk)
+}
+
+// EnHash is SHA-256 applied 16 times in a chain, XORing the outputs
+func EnHash(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	result := sum
+	for i := 1; i < 16; i++ {
+		sum = sha256.Sum256(sum[:])
+		for j := range result {
+			result[j] ^= sum[j]
+		}
+	}
+	return result[:]
+}
+
+// SiteKey is the private key for site, seeded with HMAC-SHA256(IMK, site).
+// site is the lowercase host, with any path extension, as SiteName returns.
+func (id *Identity) SiteKey(site string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, id.IMK)
+	mac.Write([]byte(site))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// Idk is the identity key sent to site
+func (id *Identity) Idk(site string) string {
+	return ssp.Sqrl64.EncodeToString(id.SiteKey(site).Public().(ed25519.PublicKey))
+}
+
+// Ids signs req for site
+func (id *Identity) Ids(site string, req *ssp.CliRequest) string {
+	return sign(id.SiteKey(site), req)
+}
+
+// Lock creates the server unlock key (suk) and verify unlock key (vuk) a
+// client sends with a new identity. They're derived from a random lock
+// key that's thrown away, so only the IUK can produce the matching urs.
+func (id *Identity) Lock() (suk, vuk string, err error) {
+	rlk := make([]byte, KeySize)
+	if _, err := rand.Read(rlk); err != nil {
+		return "", "", err
+	}
+	return id.LockWith(rlk)
+}
+
+// LockWith is Lock with the random lock key given, for repeatable tests
+func (id *Identity) LockWith(rlk []byte) (suk, vuk string, err error) {
+	x25519 := ecdh.X25519()
+	random, err := x25519.NewPrivateKey(rlk)
+	if err != nil {
+		return "", "", err
+	}
+	ilk, err := x25519.NewPublicKey(id.ILK)
+	if err != nil {
+		return "", "", err
+	}
+	shared, err := random.ECDH(ilk)
+	if err != nil {
+		return "", "", err
+	}
+	vukKey := ed25519.NewKeyFromSeed(shared).Public().(ed25519.PublicKey)
+	return ssp.Sqrl64.EncodeToString(random.PublicKey().Bytes()), ssp.Sqrl64.EncodeToString(vukKey), nil
+}
+
+// Ursk is the unlock request signing key for a suk the server returned.
+// Its public key is the vuk sent along with that suk.
+func (id *Identity) Ursk(suk string) (ed25519.PrivateKey, error) {
+	sukBytes, err := ssp.Sqrl64.DecodeString(suk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid suk: %v", err)
+	}
+	x25519 := ecdh.X25519()
+	serverUnlock, err := x25519.NewPublicKey(sukBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid suk: %v", err)
+	}
+	unlock, err := x25519.NewPrivateKey(id.IUK)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := unlock.ECDH(serverUnlock)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(shared), nil
+}
+
+// Urs signs req with the Ursk for suk, as enable and remove need
+func (id *Identity) Urs(suk string, req *ssp.CliRequest) (string, error) {
+	ursk, err := id.Ursk(suk)
+	if err != nil {
+		return "", err
+	}
+	return sign(ursk, req), nil
+}
+
+// SiteIdentity creates the client.Identity for site, with a new lock.
+// previous is the identity being replaced, if any, whose site key is sent
+// as the pidk.
+func (id *Identity) SiteIdentity(site string, previous *Identity) (*client.Identity, error) {
+	suk, _, err := id.Lock()
+	if err != nil {
+		return nil, err
+	}
+	ursk, err := id.Ursk(suk)
+	if err != nil {
+		return nil, err
+	}
+	identity := &client.Identity{Key: id.SiteKey(site), Unlock: ursk, Suk: suk}
+	if previous != nil {
+		identity.Previous = previous.SiteKey(site)
+	}
+	return identity, nil
+}
+
+// SiteName is the name site keys are derived from for a sqrl:// URL: the
+// lowercase host without user info or port, followed by the first x
+// characters of the path when the URL has an x parameter
+func SiteName(sqrlURL string) (string, error) {
+	parsed, err := url.Parse(sqrlURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid SQRL URL: %v", err)
+	}
+	if parsed.Scheme != ssp.SqrlScheme || parsed.Host == "" {
+		return "", fmt.Errorf("invalid SQRL URL: %v", sqrlURL)
+	}
+	host := parsed.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	site := strings.ToLower(host)
+	if x := parsed.Query().Get("x"); x != "" {
+		extension, err := strconv.Atoi(x)
+		if err != nil || extension < 0 || extension > len(parsed.EscapedPath()) {
+			return "", fmt.Errorf("invalid x=%v for path %v", x, parsed.EscapedPath())
+		}
+		site += parsed.EscapedPath()[:extension]
+	}
+	return site, nil
+}
+
+func sign(key ed25519.PrivateKey, req *ssp.CliRequest) string {
+	return ssp.Sqrl64.EncodeToString(ed25519.Sign(key, req.SigningString()))
+}
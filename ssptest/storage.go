@@ -0,0 +1,527 @@
+package ssptest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+)
+
+// HoardSuite tests that a ContextHoard keeps the contract the SSP relies
+// on. Hoards also implementing ssp.NutPurger or ssp.HoardNotifier have
+// those tested too; a Hoard wrapped with ssp.WrapHoard can be returned in
+// a struct embedding the wrapped hoard and the optional interfaces.
+type HoardSuite struct {
+	// New returns an empty hoard; it's called for each test
+	New func(t *testing.T) ssp.ContextHoard
+	// optional; moves the hoard's clock on by d, for example
+	// miniredis.FastForward. Defaults to sleeping.
+	Advance func(d time.Duration)
+}
+
+// Run runs the suite as subtests of t
+func (s *HoardSuite) Run(t *testing.T) {
+	t.Run("NotFound", s.testNotFound)
+	t.Run("RoundTrip", s.testRoundTrip)
+	t.Run("Overwrite", s.testOverwrite)
+	t.Run("Expiration", s.testExpiration)
+	t.Run("ConcurrentGetAndDelete", s.testConcurrentGetAndDelete)
+	t.Run("NilAndEmpty", s.testNilAndEmpty)
+	t.Run("NutPurger", s.testNutPurger)
+	t.Run("HoardNotifier", s.testHoardNotifier)
+}
+
+// SampleHoardCache is a HoardCache with every field set, as saved after a
+// query
+func SampleHoardCache(idk string) *ssp.HoardCache {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &ssp.HoardCache{
+		State:       ssp.NutAssociated,
+		RemoteIP:    "192.0.2.1",
+		OriginalNut: "original",
+		PagNut:      "pag",
+		Sin:         "0",
+		LastRequest: &ssp.CliRequest{
+			Client: &ssp.ClientBody{
+				Version: ssp.Versions{1},
+				Cmd:     "query",
+				Opt:     map[string]bool{"suk": true, "cps": true},
+				Idk:     idk,
+				Suk:     "suk",
+				Vuk:     "vuk",
+				Btn:     -1,
+			},
+			ClientEncoded: "client",
+			Server:        "server",
+			Ids:           "ids",
+			Pids:          "pids",
+			Urs:           "urs",
+			Version:       1,
+			IPAddress:     "192.0.2.1",
+		},
+		Identity:     &ssp.SqrlIdentity{Idk: idk, Suk: "suk", Vuk: "vuk", SQRLOnly: true, Rekeyed: "next"},
+		LastResponse: []byte("ver=1\r\nnut=next\r\ntif=5\r\nqry=/cli.sqrl?nut=next\r\n"),
+		Transitions: []ssp.NutTransition{
+			{From: "", To: ssp.NutIssued, Time: at},
+			{From: ssp.NutIssued, To: ssp.NutAssociated, Time: at.Add(time.Second)},
+		},
+	}
+}
+
+func expectNotFound(t *testing.T, op string, value *ssp.HoardCache, err error) {
+	t.Helper()
+	if !errors.Is(err, ssp.ErrNotFound) {
+		t.Errorf("%v: expected ErrNotFound, got %v", op, err)
+	}
+	if value != nil {
+		t.Errorf("%v: expected no value, got %+v", op, value)
+	}
+}
+
+func (s *HoardSuite) testNotFound(t *testing.T) {
+	hoard := s.New(t)
+	ctx := context.Background()
+	value, err := hoard.Get(ctx, "unknown")
+	expectNotFound(t, "Get", value, err)
+	value, err = hoard.GetAndDelete(ctx, "unknown")
+	expectNotFound(t, "GetAndDelete", value, err)
+	value, err = hoard.Get(ctx, "")
+	expectNotFound(t, "Get of an empty nut", value, err)
+}
+
+func (s *HoardSuite) testRoundTrip(t *testing.T) {
+	hoard := s.New(t)
+	ctx := context.Background()
+	if err := hoard.Save(ctx, "nut", SampleHoardCache("idk"), time.Minute); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	// Get leaves the nut
+	for i := 0; i < 2; i++ {
+		value, err := hoard.Get(ctx, "nut")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if !reflect.DeepEqual(value, SampleHoardCache("idk")) {
+			t.Fatalf("Round trip mismatch:\n got %#v\nwant %#v", value, SampleHoardCache("idk"))
+		}
+	}
+	value, err := hoard.GetAndDelete(ctx, "nut")
+	if err != nil {
+		t.Fatalf("GetAndDelete failed: %v", err)
+	}
+	if !reflect.DeepEqual(value, SampleHoardCache("idk")) {
+		t.Errorf("Round trip mismatch:\n got %#v\nwant %#v", value, SampleHoardCache("idk"))
+	}
+	value, err = hoard.GetAndDelete(ctx, "nut")
+	expectNotFound(t, "second GetAndDelete", value, err)
+	value, err = hoard.Get(ctx, "nut")
+	expectNotFound(t, "Get after GetAndDelete", value, err)
+}
+
+func (s *HoardSuite) testOverwrite(t *testing.T) {
+	hoard := s.New(t)
+	ctx := context.Background()
+	if err := hoard.Save(ctx, "nut", SampleHoardCache("first"), time.Minute); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := hoard.Save(ctx, "nut", SampleHoardCache("second"), time.Minute); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	value, err := hoard.Get(ctx, "nut")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if value.LastRequest.Client.Idk != "second" {
+		t.Errorf("Expected the last save, got %v", value.LastRequest.Client.Idk)
+	}
+}
+
+func (s *HoardSuite) testExpiration(t *testing.T) {
+	hoard := s.New(t)
+	ctx := context.Background()
+	if err := hoard.Save(ctx, "short", SampleHoardCache("idk"), 50*time.Millisecond); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := hoard.Save(ctx, "short2", SampleHoardCache("idk"), 50*time.Millisecond); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := hoard.Save(ctx, "long", SampleHoardCache("idk"), time.Hour); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if _, err := hoard.Get(ctx, "short"); err != nil {
+		t.Fatalf("Expected the nut before it expires, got %v", err)
+	}
+	if s.Advance != nil {
+		s.Advance(200 * time.Millisecond)
+	} else {
+		time.Sleep(200 * time.Millisecond)
+	}
+	value, err := hoard.Get(ctx, "short")
+	expectNotFound(t, "Get after expiration", value, err)
+	value, err = hoard.GetAndDelete(ctx, "short2")
+	expectNotFound(t, "GetAndDelete after expiration", value, err)
+	if _, err := hoard.Get(ctx, "long"); err != nil {
+		t.Errorf("Expected the unexpired nut, got %v", err)
+	}
+}
+
+func (s *HoardSuite) testConcurrentGetAndDelete(t *testing.T) {
+	hoard := s.New(t)
+	ctx := context.Background()
+	if err := hoard.Save(ctx, "nut", SampleHoardCache("idk"), time.Minute); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	const callers = 20
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := hoard.GetAndDelete(ctx, "nut")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	redeemed := 0
+	for err := range errs {
+		if err == nil {
+			redeemed++
+		} else if !errors.Is(err, ssp.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for the losers, got %v", err)
+		}
+	}
+	if redeemed != 1 {
+		t.Errorf("Expected the nut redeemed exactly once, got %d", redeemed)
+	}
+}
+
+func (s *HoardSuite) testNilAndEmpty(t *testing.T) {
+	hoard := s.New(t)
+	ctx := context.Background()
+	if err := hoard.Save(ctx, "", SampleHoardCache("idk"), time.Minute); err == nil {
+		t.Errorf("Expected an empty nut refused")
+	}
+	if err := hoard.Save(ctx, "nut", nil, time.Minute); err == nil {
+		t.Errorf("Expected a nil value refused")
+	}
+	value, err := hoard.Get(ctx, "nut")
+	expectNotFound(t, "Get after refused save", value, err)
+}
+
+func (s *HoardSuite) testNutPurger(t *testing.T) {
+	hoard := s.New(t)
+	purger, ok := hoard.(ssp.NutPurger)
+	if !ok {
+		t.Skip("not a NutPurger")
+	}
+	ctx := context.Background()
+	byRequest := SampleHoardCache("purged")
+	byRequest.Identity = nil
+	byIdentity := SampleHoardCache("other")
+	byIdentity.Identity.Idk = "purged"
+	values := map[ssp.Nut]*ssp.HoardCache{
+		"request":  byRequest,
+		"identity": byIdentity,
+		"kept":     SampleHoardCache("kept"),
+	}
+	for nut, value := range values {
+		if err := hoard.Save(ctx, nut, value, time.Minute); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+	purged, err := purger.PurgeNuts(ctx, "purged")
+	if err != nil {
+		t.Fatalf("PurgeNuts failed: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("Expected 2 nuts purged, got %d", purged)
+	}
+	for _, nut := range []ssp.Nut{"request", "identity"} {
+		value, err := hoard.Get(ctx, nut)
+		expectNotFound(t, "Get of a purged nut", value, err)
+	}
+	if _, err := hoard.Get(ctx, "kept"); err != nil {
+		t.Errorf("Expected another identity's nut kept, got %v", err)
+	}
+	if purged, err := purger.PurgeNuts(ctx, ""); err != nil || purged != 0 {
+		t.Errorf("Expected nothing purged for an empty idk, got %d %v", purged, err)
+	}
+}
+
+func (s *HoardSuite) testHoardNotifier(t *testing.T) {
+	hoard := s.New(t)
+	notifier, ok := hoard.(ssp.HoardNotifier)
+	if !ok {
+		t.Skip("not a HoardNotifier")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	saved, unsubscribe, err := notifier.Subscribe(ctx, "nut")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := hoard.Save(ctx, "nut", SampleHoardCache("idk"), time.Minute); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	select {
+	case <-saved:
+	case <-ctx.Done():
+		t.Fatalf("No notification of the save")
+	}
+	unsubscribe()
+	// saving after unsubscribing mustn't block or panic
+	if err := hoard.Save(ctx, "nut", SampleHoardCache("idk"), time.Minute); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+}
+
+// AuthStoreSuite tests that a ContextAuthStore keeps the contract the SSP
+// relies on. Stores also implementing ssp.RekeyStore or
+// ssp.IdentityLister have those tested too.
+type AuthStoreSuite struct {
+	// New returns an empty store; it's called for each test
+	New func(t *testing.T) ssp.ContextAuthStore
+}
+
+// Run runs the suite as subtests of t
+func (s *AuthStoreSuite) Run(t *testing.T) {
+	t.Run("NotFound", s.testNotFound)
+	t.Run("RoundTrip", s.testRoundTrip)
+	t.Run("Update", s.testUpdate)
+	t.Run("Delete", s.testDelete)
+	t.Run("NilAndEmpty", s.testNilAndEmpty)
+	t.Run("RekeyLink", s.testRekeyLink)
+	t.Run("RekeyStore", s.testRekeyStore)
+	t.Run("IdentityLister", s.testIdentityLister)
+}
+
+// SampleIdentity is a SqrlIdentity with every stored field set
+func SampleIdentity(idk string) *ssp.SqrlIdentity {
+	return &ssp.SqrlIdentity{
+		Idk:      idk,
+		Suk:      "suk-" + idk,
+		Vuk:      "vuk-" + idk,
+		Pidk:     "pidk-" + idk,
+		SQRLOnly: true,
+		Hardlock: true,
+		Disabled: true,
+		Sin:      "7",
+		Ins:      "ins-" + idk,
+		Btn:      -1,
+	}
+}
+
+// sameIdentity compares the stored fields; Btn is per request
+func sameIdentity(a, b *ssp.SqrlIdentity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, y := *a, *b
+	x.Btn, y.Btn = 0, 0
+	return x == y
+}
+
+func (s *AuthStoreSuite) testNotFound(t *testing.T) {
+	store := s.New(t)
+	ctx := context.Background()
+	for _, idk := range []string{"unknown", ""} {
+		identity, err := store.FindIdentity(ctx, idk)
+		if !errors.Is(err, ssp.ErrNotFound) || identity != nil {
+			t.Errorf("FindIdentity(%q): expected ErrNotFound, got %v %v", idk, identity, err)
+		}
+	}
+}
+
+func (s *AuthStoreSuite) testRoundTrip(t *testing.T) {
+	store := s.New(t)
+	ctx := context.Background()
+	for _, identity := range []*ssp.SqrlIdentity{SampleIdentity("full"), {Idk: "minimal", Btn: -1}} {
+		if err := store.SaveIdentity(ctx, identity); err != nil {
+			t.Fatalf("SaveIdentity failed: %v", err)
+		}
+	}
+	for _, expected := range []*ssp.SqrlIdentity{SampleIdentity("full"), {Idk: "minimal"}} {
+		found, err := store.FindIdentity(ctx, expected.Idk)
+		if err != nil {
+			t.Fatalf("FindIdentity failed: %v", err)
+		}
+		if !sameIdentity(found, expected) {
+			t.Errorf("Round trip mismatch:\n got %+v\nwant %+v", found, expected)
+		}
+	}
+}
+
+func (s *AuthStoreSuite) testUpdate(t *testing.T) {
+	store := s.New(t)
+	ctx := context.Background()
+	if err := store.SaveIdentity(ctx, SampleIdentity("idk")); err != nil {
+		t.Fatalf("SaveIdentity failed: %v", err)
+	}
+	updated := SampleIdentity("idk")
+	updated.Disabled = false
+	updated.Hardlock = false
+	updated.Suk = "new suk"
+	if err := store.SaveIdentity(ctx, updated); err != nil {
+		t.Fatalf("SaveIdentity failed: %v", err)
+	}
+	found, err := store.FindIdentity(ctx, "idk")
+	if err != nil {
+		t.Fatalf("FindIdentity failed: %v", err)
+	}
+	if !sameIdentity(found, updated) {
+		t.Errorf("Expected the update saved:\n got %+v\nwant %+v", found, updated)
+	}
+}
+
+func (s *AuthStoreSuite) testDelete(t *testing.T) {
+	store := s.New(t)
+	ctx := context.Background()
+	for _, idk := range []string{"deleted", "kept"} {
+		if err := store.SaveIdentity(ctx, SampleIdentity(idk)); err != nil {
+			t.Fatalf("SaveIdentity failed: %v", err)
+		}
+	}
+	if err := store.DeleteIdentity(ctx, "deleted"); err != nil {
+		t.Fatalf("DeleteIdentity failed: %v", err)
+	}
+	if _, err := store.FindIdentity(ctx, "deleted"); !errors.Is(err, ssp.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	if _, err := store.FindIdentity(ctx, "kept"); err != nil {
+		t.Errorf("Expected the other identity kept, got %v", err)
+	}
+	if err := store.DeleteIdentity(ctx, "unknown"); err != nil {
+		t.Errorf("Expected deleting an unknown identity to succeed, got %v", err)
+	}
+}
+
+func (s *AuthStoreSuite) testNilAndEmpty(t *testing.T) {
+	store := s.New(t)
+	ctx := context.Background()
+	if err := store.SaveIdentity(ctx, nil); err == nil {
+		t.Errorf("Expected a nil identity refused")
+	}
+	if err := store.SaveIdentity(ctx, &ssp.SqrlIdentity{Suk: "suk"}); err == nil {
+		t.Errorf("Expected an identity without an idk refused")
+	}
+	if _, err := store.FindIdentity(ctx, ""); !errors.Is(err, ssp.ErrNotFound) {
+		t.Errorf("Expected nothing saved under an empty idk, got %v", err)
+	}
+}
+
+func (s *AuthStoreSuite) testRekeyLink(t *testing.T) {
+	store := s.New(t)
+	ctx := context.Background()
+	first := SampleIdentity("first")
+	first.Rekeyed = "second"
+	second := SampleIdentity("second")
+	second.Rekeyed = "third"
+	for _, identity := range []*ssp.SqrlIdentity{first, second, SampleIdentity("third")} {
+		if err := store.SaveIdentity(ctx, identity); err != nil {
+			t.Fatalf("SaveIdentity failed: %v", err)
+		}
+	}
+	found, err := store.FindIdentity(ctx, "first")
+	if err != nil {
+		t.Fatalf("FindIdentity failed: %v", err)
+	}
+	if found.Rekeyed != "second" {
+		t.Errorf("Expected the rekey link kept, got %q", found.Rekeyed)
+	}
+	current, err := ssp.ResolveCurrentIdentity(ctx, store, "first")
+	if err != nil {
+		t.Fatalf("ResolveCurrentIdentity failed: %v", err)
+	}
+	if current.Idk != "third" {
+		t.Errorf("Expected the chain to end at third, got %v", current.Idk)
+	}
+}
+
+func (s *AuthStoreSuite) testRekeyStore(t *testing.T) {
+	store := s.New(t)
+	rekeys, ok := store.(ssp.RekeyStore)
+	if !ok {
+		t.Skip("not a RekeyStore")
+	}
+	ctx := context.Background()
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	saved := []*ssp.Rekey{
+		{PreviousIdk: "first", Idk: "second", RemoteIP: "192.0.2.1", Time: at},
+		{PreviousIdk: "second", Idk: "third", RemoteIP: "192.0.2.2", Time: at.Add(time.Hour)},
+	}
+	for _, rekey := range saved {
+		if err := rekeys.SaveRekey(ctx, rekey); err != nil {
+			t.Fatalf("SaveRekey failed: %v", err)
+		}
+	}
+	found, err := rekeys.FindRekeys(ctx, "second")
+	if err != nil {
+		t.Fatalf("FindRekeys failed: %v", err)
+	}
+	if len(found) != len(saved) {
+		t.Fatalf("Expected both rekeys of second, got %d", len(found))
+	}
+	for i, rekey := range found {
+		expected := saved[i]
+		if rekey.PreviousIdk != expected.PreviousIdk || rekey.Idk != expected.Idk ||
+			rekey.RemoteIP != expected.RemoteIP || !rekey.Time.Equal(expected.Time) {
+			t.Errorf("Rekey %d mismatch, oldest first:\n got %+v\nwant %+v", i, rekey, expected)
+		}
+	}
+	if found, err := rekeys.FindRekeys(ctx, "first"); err != nil || len(found) != 1 {
+		t.Errorf("Expected one rekey of first, got %v %v", found, err)
+	}
+	if found, err := rekeys.FindRekeys(ctx, "unknown"); err != nil || len(found) != 0 {
+		t.Errorf("Expected no rekeys, got %v %v", found, err)
+	}
+}
+
+func (s *AuthStoreSuite) testIdentityLister(t *testing.T) {
+	store := s.New(t)
+	lister, ok := store.(ssp.IdentityLister)
+	if !ok {
+		t.Skip("not an IdentityLister")
+	}
+	ctx := context.Background()
+	for _, idk := range []string{"c", "a", "b"} {
+		if err := store.SaveIdentity(ctx, SampleIdentity(idk)); err != nil {
+			t.Fatalf("SaveIdentity failed: %v", err)
+		}
+	}
+	idks := func(identities []*ssp.SqrlIdentity) []string {
+		result := []string{}
+		for _, identity := range identities {
+			result = append(result, identity.Idk)
+		}
+		return result
+	}
+	cases := []struct {
+		after    string
+		limit    int
+		expected []string
+	}{
+		{"", 0, []string{"a", "b", "c"}},
+		{"", 2, []string{"a", "b"}},
+		{"b", 0, []string{"c"}},
+		{"c", 10, []string{}},
+	}
+	for _, c := range cases {
+		identities, err := lister.ListIdentities(ctx, c.after, c.limit)
+		if err != nil {
+			t.Fatalf("ListIdentities failed: %v", err)
+		}
+		if got := idks(identities); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("ListIdentities(%q, %d): expected %v, got %v", c.after, c.limit, c.expected, got)
+		}
+	}
+	identities, err := lister.ListIdentities(ctx, "", 1)
+	if err != nil || len(identities) != 1 || !sameIdentity(identities[0], SampleIdentity("a")) {
+		t.Errorf("Expected listed identities complete, got %v %v", identities, err)
+	}
+}
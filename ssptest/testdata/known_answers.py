@@ -0,0 +1,100 @@
+#!/usr/bin/env python3
+# Derives the known answers in identity_test.go TestKnownAnswers without
+# the Go code: the SQRL cryptography document's EnHash, site keys and
+# lock on top of the RFC 7748 (X25519) and RFC 8032 (Ed25519) reference
+# math, which is checked against those RFCs' own test vectors first.
+# Only the Python standard library is needed.
+import hashlib, hmac, base64
+
+p = 2**255 - 19
+def inv(x): return pow(x, p - 2, p)
+
+# RFC 7748 X25519
+def decode_scalar(k):
+    k = bytearray(k); k[0] &= 248; k[31] &= 127; k[31] |= 64
+    return int.from_bytes(k, 'little')
+def x25519(k, u):
+    k = decode_scalar(k)
+    u = int.from_bytes(u, 'little') & ((1 << 255) - 1)
+    x1, x2, z2, x3, z3, swap = u, 1, 0, u, 1, 0
+    a24 = 121665
+    for t in reversed(range(255)):
+        kt = (k >> t) & 1
+        swap ^= kt
+        if swap: x2, x3, z2, z3 = x3, x2, z3, z2
+        swap = kt
+        A = (x2 + z2) % p; AA = A*A % p; B = (x2 - z2) % p; BB = B*B % p
+        E = (AA - BB) % p; C = (x3 + z3) % p; D = (x3 - z3) % p
+        DA = D*A % p; CB = C*B % p
+        x3 = (DA + CB)**2 % p; z3 = x1 * (DA - CB)**2 % p
+        x2 = AA*BB % p; z2 = E * (AA + a24*E) % p
+    if swap: x2, x3, z2, z3 = x3, x2, z3, z2
+    return (x2 * inv(z2) % p).to_bytes(32, 'little')
+def x25519_base(k): return x25519(k, (9).to_bytes(32, 'little'))
+
+# RFC 8032 Ed25519 (public key derivation and signing)
+d = -121665 * inv(121666) % p
+q = 2**252 + 27742317777372353535851937790883648493
+def recover_x(y, sign):
+    x2 = (y*y - 1) * inv(d*y*y + 1)
+    x = pow(x2, (p + 3) // 8, p)
+    if (x*x - x2) % p != 0: x = x * pow(2, (p - 1) // 4, p) % p
+    if (x & 1) != sign: x = p - x
+    return x
+gy = 4 * inv(5) % p
+G = (recover_x(gy, 0), gy, 1, recover_x(gy, 0) * gy % p)
+def add(P, Q):
+    A = (P[1]-P[0]) * (Q[1]-Q[0]) % p; B = (P[1]+P[0]) * (Q[1]+Q[0]) % p
+    C = 2 * P[3] * Q[3] * d % p; D = 2 * P[2] * Q[2] % p
+    E, F, Gg, H = B-A, D-C, D+C, B+A
+    return (E*F % p, Gg*H % p, F*Gg % p, E*H % p)
+def mul(s, P):
+    Q = (0, 1, 1, 0)
+    while s > 0:
+        if s & 1: Q = add(Q, P)
+        P = add(P, P); s >>= 1
+    return Q
+def compress(P):
+    zi = inv(P[2]); x = P[0]*zi % p; y = P[1]*zi % p
+    return int.to_bytes(y | ((x & 1) << 255), 32, 'little')
+def secret_expand(seed):
+    h = hashlib.sha512(seed).digest()
+    a = int.from_bytes(h[:32], 'little'); a &= (1 << 254) - 8; a |= (1 << 254)
+    return a, h[32:]
+def ed_public(seed):
+    a, _ = secret_expand(seed)
+    return compress(mul(a, G))
+
+def enhash(b):
+    s = hashlib.sha256(b).digest(); r = bytearray(s)
+    for _ in range(15):
+        s = hashlib.sha256(s).digest()
+        r = bytearray(x ^ y for x, y in zip(r, s))
+    return bytes(r)
+def b64(b): return base64.urlsafe_b64encode(b).rstrip(b'=').decode()
+
+# self checks against the RFCs
+assert x25519(bytes.fromhex('a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4'),
+              bytes.fromhex('e6db6867583030db3594c1a424b15f7c726624ec26b3353b10a903a6d0ab1c4c')).hex() == \
+    'c3da55379de9c6908e94ea4df28d084f32eccf03491c71f754b4075577a28552'
+assert x25519_base(bytes.fromhex('77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a')).hex() == \
+    '8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a'
+assert ed_public(bytes.fromhex('9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60')).hex() == \
+    'd75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a'
+
+iuk = bytes([1]) * 32
+imk = enhash(iuk)
+ilk = x25519_base(iuk)
+print('enhash(zero32)', enhash(bytes(32)).hex())
+print('imk', imk.hex())
+print('ilk', ilk.hex())
+for site in ['example.com', 'sqrl.grc.com/demo']:
+    seed = hmac.new(imk, site.encode(), hashlib.sha256).digest()
+    print('idk', site, b64(ed_public(seed)))
+rlk = bytes([3]) * 32
+suk = x25519_base(rlk)
+vuk = ed_public(x25519(rlk, ilk))
+print('suk', b64(suk))
+print('vuk', b64(vuk))
+ursk_seed = x25519(iuk, suk)
+print('ursk pub', b64(ed_public(ursk_seed)))
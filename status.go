@@ -0,0 +1,209 @@
+package ssp
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// LoginStatus is a message sent by the Status WebSocket. State is one of
+// "issued", "associated" (a SQRL client sent a query), "authenticated",
+// "redirect" (URL is set), "expired" or "error".
+type LoginStatus struct {
+	State string `json:"state"`
+	// the last query was answered with an Ask the user hasn't answered yet
+	AskPending bool   `json:"askPending,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// statusWriteTimeout bounds how long a single message may take to send
+const statusWriteTimeout = 10 * time.Second
+
+// statusNut is where the login progress of pagnut is saved when
+// StatusUpdates is set. '.' isn't in the nut alphabet so it can't collide
+// with a nut, and the endpoints refuse nuts outside it.
+func statusNut(pagnut Nut) Nut {
+	return pagnut + ".status"
+}
+
+// saveStatus records the progress made by a /cli.sqrl request for the
+// Status WebSocket
+func (api *SqrlSspAPI) saveStatus(ctx context.Context, req *CliRequest, response *CliResponse, respBytes []byte) {
+	if !api.StatusUpdates || response.HoardCache == nil || response.TIF&TIFCommandFailed != 0 {
+		return
+	}
+	state := NutAssociated
+	if req.IsAuthCommand() {
+		state = NutAuthenticated
+	}
+	err := api.nutHoard().Save(ctx, statusNut(response.HoardCache.PagNut), &HoardCache{
+		State:        NutStatus,
+		Progress:     state,
+		OriginalNut:  response.HoardCache.OriginalNut,
+		PagNut:       response.HoardCache.PagNut,
+		LastResponse: respBytes,
+	}, api.NutExpiration)
+	if err != nil {
+		// the login itself isn't affected
+		api.log().Error("status_save", err)
+	}
+}
+
+// Status implements an optional WebSocket endpoint, conventionally
+// /status.sqrl, taking the same nut and pag parameters as /pag.sqrl. It
+// sends a LoginStatus every time the login moves on and closes after the
+// "redirect", "expired" or "error" message. The pag nut is used up by the
+// redirect just like a /pag.sqrl request. The "associated" state is only
+// seen with StatusUpdates set.
+func (api *SqrlSspAPI) Status(w http.ResponseWriter, r *http.Request) {
+	w, observe := api.observeEndpoint(w, "status")
+	defer observe()
+	if !api.allowRemoteIP(w, r, api.RateLimits.Pag, "status") {
+		return
+	}
+	nut := Nut(r.URL.Query().Get("nut"))
+	if nut == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Missing required nut parameter"))
+		return
+	}
+	pagnut := Nut(r.URL.Query().Get("pag"))
+	if pagnut == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Missing required pag parameter"))
+		return
+	}
+	if !validNut(nut) || !validNut(pagnut) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Invalid nut"))
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: api.StatusOrigins})
+	if err != nil {
+		// Accept has already answered the request
+		api.log().Info("Status WebSocket refused", "error", err)
+		return
+	}
+	defer conn.CloseNow()
+	// the socket outlives the server's WriteTimeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// nothing is read from the browser; this handles pings and closes.
+	// The read isn't given the deadline as that would close the socket.
+	ctx, cancel := context.WithTimeout(conn.CloseRead(r.Context()), api.NutExpiration)
+	defer cancel()
+
+	// subscribed before looking so a save in between isn't missed
+	changed, unsubscribe, err := api.watchNuts(ctx, pagnut, statusNut(pagnut))
+	if err != nil {
+		api.log().Error("status_subscribe", err)
+		api.closeStatus(conn, &LoginStatus{State: "error", Error: "Failed nut lookup"})
+		return
+	}
+	defer unsubscribe()
+
+	var last *LoginStatus
+	for {
+		status, err := api.loginStatus(ctx, nut, pagnut)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			api.log().Error("status_lookup", err)
+			api.closeStatus(conn, &LoginStatus{State: "error", Error: "Failed nut lookup"})
+			return
+		}
+		if status == nil && last == nil {
+			// unknown or already used nut
+			status = &LoginStatus{State: "expired"}
+		}
+		if status != nil && (last == nil || *status != *last) {
+			if status.State == "redirect" && (last == nil || last.State != "authenticated") {
+				// the pag nut can be saved before the status
+				if !api.sendStatus(ctx, conn, &LoginStatus{State: "authenticated"}) {
+					return
+				}
+			}
+			switch status.State {
+			case "redirect", "expired", "error":
+				api.closeStatus(conn, status)
+				return
+			}
+			if !api.sendStatus(ctx, conn, status) {
+				return
+			}
+			last = status
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if r.Context().Err() == nil && ctx.Err() == context.DeadlineExceeded {
+		api.closeStatus(conn, &LoginStatus{State: "expired"})
+	}
+}
+
+// loginStatus looks up how far the login of nut has got. It returns nil
+// if nothing is known about it.
+func (api *SqrlSspAPI) loginStatus(ctx context.Context, nut, pagnut Nut) (*LoginStatus, error) {
+	hoard := api.nutHoard()
+	hoardCache, err := hoard.GetAndDelete(ctx, pagnut)
+	if err == nil {
+		redirect, status := api.pagRedirect(ctx, hoardCache, nut)
+		if status != http.StatusOK {
+			return &LoginStatus{State: "error", Error: http.StatusText(status)}, nil
+		}
+		return &LoginStatus{State: "redirect", URL: redirect}, nil
+	}
+	if err != ErrNotFound {
+		return nil, err
+	}
+
+	hoardCache, err = hoard.Get(ctx, statusNut(pagnut))
+	if err == nil && hoardCache.State == NutStatus && hoardCache.OriginalNut == nut {
+		status := &LoginStatus{State: string(hoardCache.Progress)}
+		if response, err := ParseCliResponse(hoardCache.LastResponse); err == nil {
+			status.AskPending = hoardCache.Progress == NutAssociated && response.Ask != nil
+		}
+		return status, nil
+	}
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	hoardCache, err = hoard.Get(ctx, nut)
+	if err == nil && hoardCache.PagNut == pagnut {
+		return &LoginStatus{State: "issued"}, nil
+	}
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// sendStatus writes status to the WebSocket, returning false if it's gone
+func (api *SqrlSspAPI) sendStatus(ctx context.Context, conn *websocket.Conn, status *LoginStatus) bool {
+	ctx, cancel := context.WithTimeout(ctx, statusWriteTimeout)
+	defer cancel()
+	if err := wsjson.Write(ctx, conn, status); err != nil {
+		api.log().Info("Status WebSocket closed", "error", err)
+		return false
+	}
+	return true
+}
+
+// closeStatus sends the final status and closes the WebSocket
+func (api *SqrlSspAPI) closeStatus(conn *websocket.Conn, status *LoginStatus) {
+	if api.sendStatus(context.Background(), conn, status) {
+		_ = conn.Close(websocket.StatusNormalClosure, status.State)
+	}
+}
@@ -0,0 +1,145 @@
+package ssp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func dialStatus(t *testing.T, ctx context.Context, server *httptest.Server, client *testSqrlClient) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/status.sqrl?nut=" + string(client.nut) + "&pag=" + string(client.pag)
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	return conn
+}
+
+func readStatus(t *testing.T, ctx context.Context, conn *websocket.Conn) LoginStatus {
+	var status LoginStatus
+	if err := wsjson.Read(ctx, conn, &status); err != nil {
+		t.Fatalf("Failed reading status: %v", err)
+	}
+	return status
+}
+
+func TestStatus(t *testing.T) {
+	api := newTestAPI(t)
+	api.StatusUpdates = true
+	api.Authenticator = &MockAuthenticator{AskFunc: func(identity *SqrlIdentity) *Ask {
+		return &Ask{Message: "Log in?", Button1: "Yes"}
+	}}
+	server := httptest.NewServer(http.HandlerFunc(api.Status))
+	defer server.Close()
+	client := newTestSqrlClient(t, api)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := dialStatus(t, ctx, server, client)
+	defer conn.CloseNow()
+
+	if status := readStatus(t, ctx, conn); status != (LoginStatus{State: "issued"}) {
+		t.Errorf("Expected issued, got %+v", status)
+	}
+	client.send("query")
+	if status := readStatus(t, ctx, conn); status != (LoginStatus{State: "associated", AskPending: true}) {
+		t.Errorf("Expected associated with an ask, got %+v", status)
+	}
+	client.send("ident")
+	if status := readStatus(t, ctx, conn); status != (LoginStatus{State: "authenticated"}) {
+		t.Errorf("Expected authenticated, got %+v", status)
+	}
+	if status := readStatus(t, ctx, conn); status != (LoginStatus{State: "redirect", URL: "https://example.com/dashboard"}) {
+		t.Errorf("Expected redirect, got %+v", status)
+	}
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+		t.Errorf("Expected a normal close, got %v", err)
+	}
+	// the redirect used up the pag nut
+	if _, err := api.hoard.Get(ctx, client.pag); err != ErrNotFound {
+		t.Errorf("Expected pag nut gone, got %v", err)
+	}
+}
+
+func TestStatusWithoutUpdates(t *testing.T) {
+	tree, _ := NewRandomTree(8)
+	api := NewSqrlSspAPIContext(tree, &pollingHoard{WrapHoard(NewMapHoard())}, nil, WrapAuthStore(NewMapAuthStore()))
+	api.Authenticator = &MockAuthenticator{}
+	server := httptest.NewServer(http.HandlerFunc(api.Status))
+	defer server.Close()
+	client := newTestSqrlClient(t, api)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := dialStatus(t, ctx, server, client)
+	defer conn.CloseNow()
+
+	if status := readStatus(t, ctx, conn); status.State != "issued" {
+		t.Errorf("Expected issued, got %+v", status)
+	}
+	login(client)
+	for _, state := range []string{"authenticated", "redirect"} {
+		if status := readStatus(t, ctx, conn); status.State != state {
+			t.Errorf("Expected %v, got %+v", state, status)
+		}
+	}
+}
+
+func TestStatusExpired(t *testing.T) {
+	api := newTestAPI(t)
+	server := httptest.NewServer(http.HandlerFunc(api.Status))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// unknown nut
+	conn := dialStatus(t, ctx, server, &testSqrlClient{nut: "unknown", pag: "unknown"})
+	if status := readStatus(t, ctx, conn); status.State != "expired" {
+		t.Errorf("Expected expired, got %+v", status)
+	}
+	conn.CloseNow()
+
+	// nut lifetime runs out while waiting
+	api.NutExpiration = 100 * time.Millisecond
+	client := newTestSqrlClient(t, api)
+	conn = dialStatus(t, ctx, server, client)
+	defer conn.CloseNow()
+	for _, state := range []string{"issued", "expired"} {
+		if status := readStatus(t, ctx, conn); status.State != state {
+			t.Errorf("Expected %v, got %+v", state, status)
+		}
+	}
+}
+
+func TestStatusRequest(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+
+	w := httptest.NewRecorder()
+	api.Status(w, httptest.NewRequest("GET", "/status.sqrl?nut="+string(client.nut), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without pag, got %d", w.Code)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(api.Status))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/status.sqrl?nut=" + string(client.nut) + "&pag=" + string(client.pag)
+	header := http.Header{"Origin": []string{"https://elsewhere.example"}}
+	_, resp, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{HTTPHeader: header})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected cross-origin request refused, got %v", err)
+	}
+
+	api.StatusOrigins = []string{"elsewhere.example"}
+	conn, _, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatalf("Expected allowed origin to connect, got %v", err)
+	}
+	conn.CloseNow()
+}
@@ -0,0 +1,52 @@
+package ssp_test
+
+import (
+	"testing"
+
+	ssp "github.com/dxcSithLord/server-go-ssp"
+	"github.com/dxcSithLord/server-go-ssp/ssptest"
+)
+
+// mapHoard is a wrapped MapHoard keeping its optional interfaces
+type mapHoard struct {
+	ssp.ContextHoard
+	ssp.NutPurger
+	ssp.HoardNotifier
+}
+
+// mapAuthStore is a wrapped MapAuthStore keeping its optional interfaces
+type mapAuthStore struct {
+	ssp.ContextAuthStore
+	ssp.IdentityLister
+	ssp.RekeyStore
+}
+
+func TestMapHoardSuite(t *testing.T) {
+	suite := &ssptest.HoardSuite{New: func(t *testing.T) ssp.ContextHoard {
+		hoard := ssp.NewMapHoard()
+		return &mapHoard{ssp.WrapHoard(hoard), hoard, hoard}
+	}}
+	suite.Run(t)
+}
+
+func TestNamespacedHoardSuite(t *testing.T) {
+	suite := &ssptest.HoardSuite{New: func(t *testing.T) ssp.ContextHoard {
+		return ssp.NamespaceHoard(ssp.WrapHoard(ssp.NewMapHoard()), "tenant")
+	}}
+	suite.Run(t)
+}
+
+func TestMapAuthStoreSuite(t *testing.T) {
+	suite := &ssptest.AuthStoreSuite{New: func(t *testing.T) ssp.ContextAuthStore {
+		store := ssp.NewMapAuthStore()
+		return &mapAuthStore{ssp.WrapAuthStore(store), store, store}
+	}}
+	suite.Run(t)
+}
+
+func TestNamespacedAuthStoreSuite(t *testing.T) {
+	suite := &ssptest.AuthStoreSuite{New: func(t *testing.T) ssp.ContextAuthStore {
+		return ssp.NamespaceAuthStore(ssp.WrapAuthStore(ssp.NewMapAuthStore()), "tenant")
+	}}
+	suite.Run(t)
+}
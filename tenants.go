@@ -0,0 +1,132 @@
+package ssp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tenants serves several relying parties from one http.Handler. Each
+// tenant is a SqrlSspAPI with its own Authenticator (and so its own Ask
+// policy), AuthStore, NutExpiration and Tree, registered for a host or a
+// path prefix.
+//
+// The Hoard of each tenant is namespaced when it's added, so a nut issued
+// by one tenant can't be used with another even if they share a Hoard.
+// Tenants sharing an AuthStore should be given NamespaceAuthStore.
+type Tenants struct {
+	// optional; proxies trusted to set the forwarded host used to find the
+	// tenant and the header they write (see SqrlSspAPI.TrustedProxies)
+	TrustedProxies     []netip.Prefix
+	TrustedProxyHeader ProxyHeader
+
+	mutex *sync.RWMutex
+	hosts map[string]*SqrlSspAPI
+	// by RootPath, longest first
+	paths    []*SqrlSspAPI
+	handlers map[*SqrlSspAPI]http.Handler
+}
+
+// NewTenants creates an empty Tenants
+func NewTenants() *Tenants {
+	return &Tenants{
+		mutex:    &sync.RWMutex{},
+		hosts:    make(map[string]*SqrlSspAPI),
+		handlers: make(map[*SqrlSspAPI]http.Handler),
+	}
+}
+
+// AddHost serves api for requests to host, with or without a port. The
+// endpoints are under api.RootPath as it is when it's added.
+func (t *Tenants) AddHost(host string, api *SqrlSspAPI) error {
+	host = strings.ToLower(host)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.hosts[host] != nil {
+		return fmt.Errorf("Host %v already has a tenant", host)
+	}
+	if err := t.add(api, "host:"+host); err != nil {
+		return err
+	}
+	t.hosts[host] = api
+	t.handlers[api] = api.Handler()
+	return nil
+}
+
+// AddPath serves api for requests under prefix on any host that doesn't
+// have its own tenant. api.RootPath is set to prefix so the SQRL URLs
+// point back at it.
+func (t *Tenants) AddPath(prefix string, api *SqrlSspAPI) error {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		return fmt.Errorf("Path tenants need a prefix")
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, other := range t.paths {
+		if other.RootPath == prefix {
+			return fmt.Errorf("Path %v already has a tenant", prefix)
+		}
+	}
+	if err := t.add(api, "path:"+prefix); err != nil {
+		return err
+	}
+	api.RootPath = prefix
+	t.handlers[api] = api.Handler()
+	t.paths = append(t.paths, api)
+	sort.SliceStable(t.paths, func(i, j int) bool {
+		return len(t.paths[i].RootPath) > len(t.paths[j].RootPath)
+	})
+	return nil
+}
+
+func (t *Tenants) add(api *SqrlSspAPI, namespace string) error {
+	if api == nil || api.hoard == nil {
+		return fmt.Errorf("Tenant %v needs a SqrlSspAPI with a Hoard", namespace)
+	}
+	if t.handlers[api] != nil {
+		return fmt.Errorf("Tenant %v is already added", namespace)
+	}
+	api.hoard = NamespaceHoard(api.hoard, namespace)
+	return nil
+}
+
+// Tenant returns the SqrlSspAPI serving r. Host tenants are matched
+// before path tenants.
+func (t *Tenants) Tenant(r *http.Request) (*SqrlSspAPI, bool) {
+	host := strings.ToLower((&SqrlSspAPI{TrustedProxies: t.TrustedProxies, TrustedProxyHeader: t.TrustedProxyHeader}).Host(r))
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if api := t.hosts[host]; api != nil {
+		return api, true
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		if api := t.hosts[hostname]; api != nil {
+			return api, true
+		}
+	}
+	for _, api := range t.paths {
+		if strings.HasPrefix(r.URL.Path, api.RootPath+"/") {
+			return api, true
+		}
+	}
+	return nil, false
+}
+
+// ServeHTTP implements http.Handler, passing the request to the Handler
+// of its tenant
+func (t *Tenants) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api, ok := t.Tenant(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	t.mutex.RLock()
+	handler := t.handlers[api]
+	t.mutex.RUnlock()
+	handler.ServeHTTP(w, r)
+}
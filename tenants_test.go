@@ -0,0 +1,206 @@
+package ssp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTenantAPI(hoard ContextHoard, store ContextAuthStore, redirect string) *SqrlSspAPI {
+	tree, _ := NewRandomTree(8)
+	api := NewSqrlSspAPIContext(tree, hoard, nil, store)
+	api.Authenticator = &MockAuthenticator{AuthenticateFunc: func(identity *SqrlIdentity) string {
+		return redirect
+	}}
+	return api
+}
+
+func TestTenantsDispatch(t *testing.T) {
+	hoard := WrapHoard(NewMapHoard())
+	first := newTenantAPI(hoard, WrapAuthStore(NewMapAuthStore()), "https://first.example/")
+	second := newTenantAPI(hoard, WrapAuthStore(NewMapAuthStore()), "https://second.example/")
+	third := newTenantAPI(hoard, WrapAuthStore(NewMapAuthStore()), "https://shared.example/third")
+	tenants := NewTenants()
+	if err := tenants.AddHost("First.example", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.AddHost("second.example", second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.AddPath("/third/", third); err != nil {
+		t.Fatal(err)
+	}
+	if third.RootPath != "/third" {
+		t.Errorf("Expected RootPath set, got %q", third.RootPath)
+	}
+	if err := tenants.AddHost("other.example", first); err == nil {
+		t.Error("Expected adding a tenant twice to fail")
+	}
+	if err := tenants.AddPath("/third", newTenantAPI(hoard, nil, "")); err == nil {
+		t.Error("Expected a duplicate path to fail")
+	}
+
+	cases := []struct {
+		target string
+		tenant *SqrlSspAPI
+		code   int
+	}{
+		{"http://first.example/nut.sqrl", first, http.StatusOK},
+		{"http://first.example:8443/nut.sqrl", first, http.StatusOK},
+		{"http://second.example/nut.sqrl", second, http.StatusOK},
+		{"http://shared.example/third/nut.sqrl", third, http.StatusOK},
+		{"http://first.example/third/nut.sqrl", first, http.StatusNotFound},
+		{"http://shared.example/nut.sqrl", nil, http.StatusNotFound},
+		{"http://second.example/unknown.sqrl", second, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.target, nil)
+		if tenant, _ := tenants.Tenant(r); tenant != c.tenant {
+			t.Errorf("%v: unexpected tenant", c.target)
+		}
+		w := httptest.NewRecorder()
+		tenants.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%v: expected %d, got %d", c.target, c.code, w.Code)
+		}
+	}
+
+	// the nut is only known to the tenant that issued it
+	w := httptest.NewRecorder()
+	tenants.ServeHTTP(w, httptest.NewRequest("GET", "http://first.example/nut.sqrl", nil))
+	values, _ := url.ParseQuery(w.Body.String())
+	ctx := context.Background()
+	if _, err := first.hoard.Get(ctx, Nut(values.Get("nut"))); err != nil {
+		t.Errorf("Expected nut in its tenant, got %v", err)
+	}
+	if _, err := second.hoard.Get(ctx, Nut(values.Get("nut"))); err != ErrNotFound {
+		t.Errorf("Expected nut unknown to other tenants, got %v", err)
+	}
+}
+
+func TestTenantsNutsNotShared(t *testing.T) {
+	hoard := WrapHoard(NewMapHoard())
+	store := WrapAuthStore(NewMapAuthStore())
+	first := newTenantAPI(hoard, NamespaceAuthStore(store, "first"), "https://first.example/")
+	second := newTenantAPI(hoard, NamespaceAuthStore(store, "second"), "https://second.example/")
+	tenants := NewTenants()
+	_ = tenants.AddHost("first.example", first)
+	_ = tenants.AddHost("second.example", second)
+
+	// a nut issued by the first tenant used with the second
+	client := newTestSqrlClient(t, first)
+	client.api = second
+	if resp := client.send("query"); resp.TIF&TIFCommandFailed == 0 {
+		t.Errorf("Expected the other tenant's nut to fail, got TIF 0x%x", resp.TIF)
+	}
+
+	// a pag nut redeemed with the second tenant
+	client = newTestSqrlClient(t, first)
+	original := client.nut
+	login(client)
+	w := httptest.NewRecorder()
+	second.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut="+string(original)+"&pag="+string(client.pag), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 from the other tenant, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	first.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut="+string(original)+"&pag="+string(client.pag), nil))
+	if w.Body.String() != "https://first.example/" {
+		t.Errorf("Expected the first tenant's redirect, got %d %q", w.Code, w.Body.String())
+	}
+
+	// the same key is a separate identity with each tenant
+	ctx := context.Background()
+	if _, err := second.authStore.FindIdentity(ctx, client.idk()); err != ErrNotFound {
+		t.Errorf("Expected identity unknown to the other tenant, got %v", err)
+	}
+	identity, err := first.authStore.FindIdentity(ctx, client.idk())
+	if err != nil || identity.Idk != client.idk() {
+		t.Errorf("Expected identity with its own idk, got %+v %v", identity, err)
+	}
+	if _, err := store.FindIdentity(ctx, "first:"+client.idk()); err != nil {
+		t.Errorf("Expected namespaced identity in the shared store, got %v", err)
+	}
+}
+
+func TestTenantsHostWithPort(t *testing.T) {
+	hoard := WrapHoard(NewMapHoard())
+	plain := newTenantAPI(hoard, WrapAuthStore(NewMapAuthStore()), "https://example.com/")
+	port := newTenantAPI(hoard, WrapAuthStore(NewMapAuthStore()), "https://example.com:8443/")
+	tenants := NewTenants()
+	if err := tenants.AddHost("example.com", plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.AddHost("example.com:8443", port); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	tenants.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:8443/nut.sqrl", nil))
+	values, _ := url.ParseQuery(w.Body.String())
+	nut := values.Get("nut")
+	ctx := context.Background()
+	if _, err := port.hoard.Get(ctx, Nut(nut)); err != nil {
+		t.Fatalf("Expected nut in its tenant, got %v", err)
+	}
+	// "host:example.com:" + "8443:<nut>" mustn't be the other tenant's key
+	if _, err := plain.hoard.Get(ctx, Nut("8443:"+nut)); err != ErrNotFound {
+		t.Errorf("Expected nut unknown to the other tenant, got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	tenants.ServeHTTP(w, httptest.NewRequest("POST", "http://example.com/cli.sqrl?nut="+url.QueryEscape("8443:"+nut), nil))
+	resp, err := ParseCliResponse(w.Body.Bytes())
+	if err != nil || resp.TIF&TIFClientFailure == 0 {
+		t.Errorf("Expected the other tenant's nut refused, got %+v %v", resp, err)
+	}
+	if _, err := port.hoard.Get(ctx, Nut(nut)); err != nil {
+		t.Errorf("Expected nut left in its tenant, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	tenants.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/png.sqrl?nut="+url.QueryEscape("8443:"+nut), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a QR code refused for an invalid nut, got %d", w.Code)
+	}
+}
+
+func TestNamespacePrefix(t *testing.T) {
+	if namespacePrefix("site") != "site:" {
+		t.Errorf("Expected a plain namespace unchanged, got %q", namespacePrefix("site"))
+	}
+	seen := make(map[string]string)
+	for _, namespace := range []string{"a", "a:b", "a%3Ab", "a:", "[::1]:443"} {
+		prefix := namespacePrefix(namespace)
+		for other, otherPrefix := range seen {
+			if strings.HasPrefix(prefix, otherPrefix) || strings.HasPrefix(otherPrefix, prefix) {
+				t.Errorf("%q and %q have overlapping prefixes %q and %q", namespace, other, prefix, otherPrefix)
+			}
+		}
+		seen[namespace] = prefix
+	}
+}
+
+func TestNamespaceAuthStoreRekeys(t *testing.T) {
+	store := NewMapAuthStore()
+	api := newTenantAPI(WrapHoard(NewMapHoard()), NamespaceAuthStore(WrapAuthStore(store), "site"), "")
+	client := newTestSqrlClient(t, api)
+	login(client)
+	previous := client.idk()
+	rekeyTo(t, client)
+
+	current, err := api.ResolveCurrentIdentity(context.Background(), previous)
+	if err != nil || current.Idk != client.idk() {
+		t.Fatalf("Expected rekey resolved in the namespace, got %+v %v", current, err)
+	}
+	history, err := api.RekeyHistory(context.Background(), client.idk())
+	if err != nil || len(history) != 1 || history[0].PreviousIdk != previous {
+		t.Errorf("Expected namespaced rekey history, got %+v %v", history, err)
+	}
+	rekeys, _ := store.FindRekeys(context.Background(), "site:"+previous)
+	if len(rekeys) != 1 || rekeys[0].Idk != "site:"+client.idk() {
+		t.Errorf("Expected namespaced rekey in the shared store, got %+v", rekeys)
+	}
+}
@@ -0,0 +1,179 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Span names used by Cli. The "cli" span covers the whole request and
+// the others are its children, one per step.
+const (
+	SpanCli                   = "cli"
+	SpanParse                 = "parse"
+	SpanGetAndDelete          = "getAndDelete"
+	SpanRequestValidations    = "requestValidations"
+	SpanTreeNut               = "tree.Nut"
+	SpanFindIdentity          = "FindIdentity"
+	SpanCheckPreviousIdentity = "checkPreviousIdentity"
+	SpanKnownIdentity         = "knownIdentity"
+	SpanFinishCliResponse     = "finishCliResponse"
+	SpanWriteResponse         = "writeResponse"
+)
+
+// Span attribute keys
+const (
+	AttrCmd = "sqrl.cmd"
+	// the idk truncated to 8 characters
+	AttrIdk = "sqrl.idk"
+	AttrTIF = "sqrl.tif"
+)
+
+// Tracer starts spans. The returned context carries the span so spans
+// started from it are children. The oteltracer package adapts an
+// OpenTelemetry tracer.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation
+type Span interface {
+	// value is a string, bool, int or int64
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// startSpan starts a span with SqrlSspAPI.Tracer if set
+func (api *SqrlSspAPI) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if api.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return api.Tracer.Start(ctx, name)
+}
+
+// endSpan records err, if any, and ends span
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// startStep starts a span for a step of Cli
+func (api *SqrlSspAPI) startStep(ctx context.Context, name string, req *CliRequest) (context.Context, Span) {
+	ctx, span := api.startSpan(ctx, name)
+	setRequestAttributes(span, req)
+	return ctx, span
+}
+
+// endStep records the TIF so far and ends span
+func endStep(span Span, response *CliResponse, err error) {
+	span.SetAttribute(AttrTIF, int64(response.TIF))
+	endSpan(span, err)
+}
+
+// ignoreNotFound returns nil for ErrNotFound since it's not a failure
+func ignoreNotFound(err error) error {
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// setRequestAttributes adds the command and truncated idk of req
+func setRequestAttributes(span Span, req *CliRequest) {
+	if req == nil || req.Client == nil {
+		return
+	}
+	span.SetAttribute(AttrCmd, sanitizeControlChars(req.Client.Cmd))
+	span.SetAttribute(AttrIdk, truncateKey(req.Client.Idk, 8))
+}
+
+// RecordedSpan is a span captured by a TraceRecorder
+type RecordedSpan struct {
+	Name       string
+	Parent     *RecordedSpan
+	Attributes map[string]interface{}
+	Errors     []error
+	Started    time.Time
+	Ended      time.Time
+
+	recorder *TraceRecorder
+}
+
+// SetAttribute implements Span
+func (rs *RecordedSpan) SetAttribute(key string, value interface{}) {
+	rs.recorder.mutex.Lock()
+	defer rs.recorder.mutex.Unlock()
+	rs.Attributes[key] = value
+}
+
+// RecordError implements Span
+func (rs *RecordedSpan) RecordError(err error) {
+	rs.recorder.mutex.Lock()
+	defer rs.recorder.mutex.Unlock()
+	rs.Errors = append(rs.Errors, err)
+}
+
+// End implements Span
+func (rs *RecordedSpan) End() {
+	rs.recorder.mutex.Lock()
+	defer rs.recorder.mutex.Unlock()
+	rs.Ended = time.Now()
+}
+
+// String returns the name and attributes for debugging
+func (rs *RecordedSpan) String() string {
+	return fmt.Sprintf("%s%v", rs.Name, rs.Attributes)
+}
+
+type recordedSpanKey struct{}
+
+// TraceRecorder is a Tracer keeping spans in memory, for tests
+type TraceRecorder struct {
+	mutex *sync.Mutex
+	spans []*RecordedSpan
+}
+
+// NewTraceRecorder creates an empty TraceRecorder
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{mutex: &sync.Mutex{}}
+}
+
+// Start implements Tracer
+func (tr *TraceRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*RecordedSpan)
+	span := &RecordedSpan{
+		Name:       name,
+		Parent:     parent,
+		Attributes: make(map[string]interface{}),
+		Started:    time.Now(),
+		recorder:   tr,
+	}
+	tr.mutex.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mutex.Unlock()
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+// Spans returns the spans started so far in start order
+func (tr *TraceRecorder) Spans() []*RecordedSpan {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return append([]*RecordedSpan(nil), tr.spans...)
+}
+
+// Reset forgets all spans
+func (tr *TraceRecorder) Reset() {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.spans = nil
+}
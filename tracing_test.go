@@ -0,0 +1,103 @@
+package ssp
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func spanNames(spans []*RecordedSpan) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
+
+func TestCliSpans(t *testing.T) {
+	api := newTestAPI(t)
+	recorder := NewTraceRecorder()
+	api.Tracer = recorder
+	client := newTestSqrlClient(t, api)
+
+	client.send("query")
+	recorder.Reset()
+	client.send("ident")
+
+	spans := recorder.Spans()
+	expected := []string{SpanCli, SpanParse, SpanGetAndDelete, SpanRequestValidations, SpanTreeNut,
+		SpanFindIdentity, SpanCheckPreviousIdentity, SpanFinishCliResponse, SpanWriteResponse}
+	names := spanNames(spans)
+	if len(names) != len(expected) {
+		t.Fatalf("Expected spans %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected span %d to be %s, got %s", i, expected[i], names[i])
+		}
+	}
+
+	root := spans[0]
+	for _, span := range spans[1:] {
+		if span.Parent != root {
+			t.Errorf("Expected %s to be a child of cli", span.Name)
+		}
+		if span.Ended.IsZero() {
+			t.Errorf("Span %s not ended", span.Name)
+		}
+	}
+	if root.Ended.IsZero() {
+		t.Error("Root span not ended")
+	}
+	if root.Attributes[AttrCmd] != "ident" {
+		t.Errorf("Expected cmd attribute, got %v", root.Attributes[AttrCmd])
+	}
+	if root.Attributes[AttrIdk] != truncateKey(client.idk(), 8) {
+		t.Errorf("Expected truncated idk attribute, got %v", root.Attributes[AttrIdk])
+	}
+	if root.Attributes[AttrTIF] != int64(TIFIPMatched|TIFIDMatch) {
+		t.Errorf("Expected TIF attribute, got %v", root.Attributes[AttrTIF])
+	}
+	if spans[7].Attributes[AttrCmd] != "ident" {
+		t.Errorf("Expected cmd on step span, got %v", spans[7])
+	}
+}
+
+func TestCliSpansKnownIdentity(t *testing.T) {
+	api := newTestAPI(t)
+	recorder := NewTraceRecorder()
+	api.Tracer = recorder
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+
+	recorder.Reset()
+	client.send("disable")
+	found := false
+	for _, span := range recorder.Spans() {
+		if span.Name == SpanKnownIdentity {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected knownIdentity span, got %v", spanNames(recorder.Spans()))
+	}
+}
+
+func TestCliSpansRecordErrors(t *testing.T) {
+	api := newTestAPI(t)
+	recorder := NewTraceRecorder()
+	api.Tracer = recorder
+
+	w := httptest.NewRecorder()
+	api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl?nut=abc", nil))
+	spans := recorder.Spans()
+	if len(spans) != 2 || spans[1].Name != SpanParse {
+		t.Fatalf("Expected cli and parse spans, got %v", spanNames(spans))
+	}
+	if len(spans[1].Errors) != 1 {
+		t.Errorf("Expected parse error to be recorded")
+	}
+	if spans[0].Attributes[AttrTIF] != int64(TIFClientFailure|TIFCommandFailed) {
+		t.Errorf("Expected failure TIF on root span, got %v", spans[0].Attributes[AttrTIF])
+	}
+}
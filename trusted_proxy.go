@@ -0,0 +1,205 @@
+package ssp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses CIDRs (or single IP addresses) for
+// SqrlSspAPI.TrustedProxies
+func ParseTrustedProxies(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ProxyHeader is the forwarding header SqrlSspAPI.TrustedProxies write.
+// Only that header is read; a client can send the other one through a
+// proxy that doesn't overwrite it.
+type ProxyHeader int
+
+const (
+	// XForwardedFor reads the client from X-Forwarded-For and the host
+	// from X-Forwarded-Host or X-Forwarded-Server
+	XForwardedFor ProxyHeader = iota
+	// Forwarded reads the client and host from the RFC 7239 Forwarded header
+	Forwarded
+)
+
+// ParseProxyHeader parses a header name for SqrlSspAPI.TrustedProxyHeader
+func ParseProxyHeader(name string) (ProxyHeader, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "x-forwarded-for":
+		return XForwardedFor, nil
+	case "forwarded":
+		return Forwarded, nil
+	}
+	return 0, fmt.Errorf("unknown proxy header %q", name)
+}
+
+// forwardedHop is one element of a Forwarded or X-Forwarded-For header.
+// For is the client address the proxy that added it saw, Host is the Host
+// header it received.
+type forwardedHop struct {
+	For  string
+	Host string
+}
+
+func (api *SqrlSspAPI) trusted(addr netip.Addr) bool {
+	for _, prefix := range api.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClient walks the forwarding headers from right to left for as
+// long as each hop is a trusted proxy. It returns the client address and
+// the index of the leftmost hop added by a trusted proxy (-1 if the
+// headers were not used).
+func (api *SqrlSspAPI) resolveClient(r *http.Request, hops []forwardedHop) (string, int) {
+	peer, ok := parseHopAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr, -1
+	}
+	client := peer
+	written := -1
+	if !api.trusted(client) {
+		return client.String(), written
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		// hop i was added by a trusted proxy
+		written = i
+		addr, ok := parseHopAddr(hops[i].For)
+		if !ok {
+			// unknown or obfuscated; the last trusted proxy is as far as we can see
+			break
+		}
+		client = addr
+		if !api.trusted(addr) {
+			break
+		}
+	}
+	return client.String(), written
+}
+
+// forwardedHops returns the elements of the TrustedProxyHeader
+func (api *SqrlSspAPI) forwardedHops(r *http.Request) []forwardedHop {
+	var hops []forwardedHop
+	if api.TrustedProxyHeader == Forwarded {
+		for _, value := range r.Header.Values("Forwarded") {
+			for _, element := range splitQuoted(value, ',') {
+				var hop forwardedHop
+				for _, pair := range splitQuoted(element, ';') {
+					name, value, found := strings.Cut(pair, "=")
+					if !found {
+						continue
+					}
+					value = unquote(strings.TrimSpace(value))
+					switch strings.ToLower(strings.TrimSpace(name)) {
+					case "for":
+						hop.For = value
+					case "host":
+						hop.Host = value
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			hops = append(hops, forwardedHop{For: strings.TrimSpace(entry)})
+		}
+	}
+	return hops
+}
+
+// parseHopAddr parses an IP address with an optional port, brackets or
+// quotes. IPv4-mapped IPv6 addresses are unmapped so the same client always
+// resolves to the same string.
+func parseHopAddr(s string) (netip.Addr, bool) {
+	s = unquote(strings.TrimSpace(s))
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// lastEntry returns the rightmost entry of a comma separated header, the
+// one added by the proxy closest to this server
+func lastEntry(r *http.Request, header string) string {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return ""
+	}
+	entries := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(entries[len(entries)-1])
+}
+
+// splitQuoted splits s on sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuotes:
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// unquote removes the quotes and escapes from an RFC 7230 quoted-string
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
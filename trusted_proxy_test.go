@@ -0,0 +1,142 @@
+package ssp
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func testTrustedProxies(t *testing.T, cidrs ...string) []netip.Prefix {
+	t.Helper()
+	prefixes, err := ParseTrustedProxies(cidrs)
+	if err != nil {
+		t.Fatalf("Failed parsing trusted proxies: %v", err)
+	}
+	return prefixes
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes := testTrustedProxies(t, "10.0.0.0/8", " 192.0.2.1 ", "", "::ffff:172.16.0.0/108", "2001:db8::/32")
+	if len(prefixes) != 4 {
+		t.Fatalf("Expected 4 prefixes, got %v", prefixes)
+	}
+	if prefixes[1].String() != "192.0.2.1/32" {
+		t.Errorf("Expected single IP as /32, got %v", prefixes[1])
+	}
+	if prefixes[2].String() != "172.16.0.0/12" {
+		t.Errorf("Expected mapped prefix to be unmapped, got %v", prefixes[2])
+	}
+	if _, err := ParseTrustedProxies([]string{"not an ip"}); err == nil {
+		t.Error("Expected error for invalid proxy")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	proxies := testTrustedProxies(t, "10.0.0.0/8", "2001:db8::/32")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+		header     ProxyHeader
+	}{
+		{"port stripped", "203.0.113.7:4242", nil, "203.0.113.7", XForwardedFor},
+		{"ipv6 port stripped", "[2001:db9::1]:4242", nil, "2001:db9::1", XForwardedFor},
+		{"no port", "203.0.113.7", nil, "203.0.113.7", XForwardedFor},
+		{"mapped ipv4", "[::ffff:203.0.113.7]:4242", nil, "203.0.113.7", XForwardedFor},
+		{"untrusted peer ignores xff", "203.0.113.7:1", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7", XForwardedFor},
+		{"untrusted peer ignores forwarded", "203.0.113.7:1", map[string]string{"Forwarded": "for=198.51.100.1"}, "203.0.113.7", XForwardedFor},
+		{"trusted peer", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1", XForwardedFor},
+		{"spoofed left entry", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, "198.51.100.1", XForwardedFor},
+		{"chain of trusted proxies", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1", XForwardedFor},
+		{"all trusted", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3", XForwardedFor},
+		{"xff with port", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "198.51.100.1:5555"}, "198.51.100.1", XForwardedFor},
+		{"garbage xff", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "nonsense"}, "10.0.0.1", XForwardedFor},
+		{"no headers", "10.0.0.1:1", nil, "10.0.0.1", XForwardedFor},
+		{"forwarded", "10.0.0.1:1", map[string]string{"Forwarded": "for=198.51.100.1;proto=https"}, "198.51.100.1", Forwarded},
+		{"forwarded ipv6", "10.0.0.1:1", map[string]string{"Forwarded": `for="[2001:db9::2]:80"`}, "2001:db9::2", Forwarded},
+		{"forwarded chain", "10.0.0.1:1", map[string]string{"Forwarded": `for=1.2.3.4, For=198.51.100.1;host="a,b", for="[2001:db8::5]"`}, "198.51.100.1", Forwarded},
+		{"forwarded unknown", "10.0.0.1:1", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1", Forwarded},
+		{"forwarded ignores xff", "10.0.0.1:1", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "198.51.100.2"}, "198.51.100.1", Forwarded},
+		// an X-Forwarded-For proxy passes on a Forwarded header the client sent
+		{"xff proxy ignores client forwarded", "10.0.0.1:1", map[string]string{"Forwarded": "for=192.0.2.66", "X-Forwarded-For": "198.51.100.2"}, "198.51.100.2", XForwardedFor},
+		{"xff proxy ignores lone forwarded", "10.0.0.1:1", map[string]string{"Forwarded": "for=192.0.2.66"}, "10.0.0.1", XForwardedFor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &SqrlSspAPI{TrustedProxies: proxies, TrustedProxyHeader: tt.header}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if ip := api.RemoteIP(r); ip != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, ip)
+			}
+		})
+	}
+}
+
+func TestHostUntrustedPeer(t *testing.T) {
+	api := &SqrlSspAPI{TrustedProxies: testTrustedProxies(t, "10.0.0.0/8")}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "original.example.com"
+	r.RemoteAddr = "203.0.113.7:1"
+	r.Header.Set("X-Forwarded-Host", "evil.example.com")
+	r.Header.Set("Forwarded", "host=evil.example.com")
+	if host := api.Host(r); host != "original.example.com" {
+		t.Errorf("Expected forwarding headers to be ignored, got %s", host)
+	}
+}
+
+func TestHostForwarded(t *testing.T) {
+	api := &SqrlSspAPI{TrustedProxies: testTrustedProxies(t, "10.0.0.0/8"), TrustedProxyHeader: Forwarded}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "internal"
+	r.RemoteAddr = "10.0.0.1:1"
+	r.Header.Set("Forwarded", `for=1.2.3.4;host=evil.example.com, for=198.51.100.1;host=sqrl.example.com, for=10.0.0.2;host=internal`)
+	r.Header.Set("X-Forwarded-Host", "other.example.com")
+	if host := api.Host(r); host != "sqrl.example.com" {
+		t.Errorf("Expected sqrl.example.com, got %s", host)
+	}
+}
+
+func TestHostXForwardedForProxy(t *testing.T) {
+	api := &SqrlSspAPI{TrustedProxies: testTrustedProxies(t, "10.0.0.0/8")}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "sqrl.example.com"
+	r.RemoteAddr = "10.0.0.1:1"
+	r.Header.Set("Forwarded", "for=192.0.2.66;host=evil.example.com")
+	if host := api.Host(r); host != "sqrl.example.com" {
+		t.Errorf("Expected the client's Forwarded header to be ignored, got %s", host)
+	}
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for name, expected := range map[string]ProxyHeader{"X-Forwarded-For": XForwardedFor, " forwarded": Forwarded} {
+		if header, err := ParseProxyHeader(name); err != nil || header != expected {
+			t.Errorf("Expected %q to parse as %v, got %v %v", name, expected, header, err)
+		}
+	}
+	if _, err := ParseProxyHeader("X-Real-IP"); err == nil {
+		t.Error("Expected error for an unknown header")
+	}
+}
+
+func TestCliIPMatchAcrossConnections(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	client.remoteAddr = "198.51.100.1:1111"
+	client.newNut()
+
+	// the same client on a new connection has a different source port
+	client.remoteAddr = "198.51.100.1:2222"
+	resp := client.send("query")
+	if resp.TIF&TIFIPMatched == 0 {
+		t.Errorf("Expected IP match, got 0x%x", resp.TIF)
+	}
+}
@@ -0,0 +1,282 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AuthStoreTx is a ContextAuthStore bound to a transaction. Changes are
+// only visible outside the transaction once Commit succeeds.
+type AuthStoreTx interface {
+	ContextAuthStore
+	Commit() error
+	Rollback() error
+}
+
+// TxAuthStore is optionally implemented by a ContextAuthStore that supports
+// transactions. When available, all identity changes made while handling a
+// single /cli.sqrl request are made in one transaction.
+type TxAuthStore interface {
+	BeginTx(ctx context.Context) (AuthStoreTx, error)
+}
+
+// unitOfWork groups the AuthStore and Hoard changes of a /cli.sqrl request
+// so they're either all applied or none are. Stores implementing TxAuthStore
+// get a real transaction. Other stores have their writes buffered until
+// commit and undone on a best-effort basis if a later write fails.
+//
+// Authenticator callbacks are not part of the unit of work; if a commit
+// fails after SwapIdentities or RemoveIdentity has been called the
+// Authenticator is not told.
+type unitOfWork struct {
+	store ContextAuthStore
+	hoard ContextHoard
+	tx    AuthStoreTx
+	log   safeLog
+	// nil if the store keeps no rekey audit trail
+	rekeys RekeyStore
+
+	// buffered identity writes, in order, for non-transactional stores
+	writes []identityWrite
+	// buffered rekey records for non-transactional stores
+	rekeySaves []*Rekey
+	// pending hoard saves applied on commit
+	hoardSaves []hoardSave
+	// events published once committed
+	events []*Event
+	done   bool
+}
+
+type identityWrite struct {
+	idk      string
+	identity *SqrlIdentity // nil for delete
+}
+
+type hoardSave struct {
+	nut        Nut
+	value      *HoardCache
+	expiration time.Duration
+}
+
+func (api *SqrlSspAPI) beginUnitOfWork(ctx context.Context) (*unitOfWork, error) {
+	uow := &unitOfWork{
+		store: api.identityStore(),
+		hoard: api.nutHoard(),
+		log:   api.log(),
+	}
+	uow.rekeys = rekeyStoreOf(api.authStore)
+	if txStore := txAuthStoreOf(api.authStore); txStore != nil {
+		start := time.Now()
+		tx, err := txStore.BeginTx(ctx)
+		if api.Metrics != nil {
+			api.Metrics.observeStorage("auth_store", "begin", start, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		uow.tx = tx
+		uow.rekeys = rekeyStoreOf(tx)
+		if api.Metrics != nil {
+			uow.tx = &instrumentedTx{instrumentedAuthStore{tx, api.Metrics}, tx}
+		}
+	}
+	return uow, nil
+}
+
+// FindIdentity implements ContextAuthStore and sees writes made in this
+// unit of work. Identities are copied so changes made by the caller
+// aren't visible to other requests until saved and committed.
+func (uow *unitOfWork) FindIdentity(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	if uow.tx != nil {
+		return uow.tx.FindIdentity(ctx, idk)
+	}
+	for i := len(uow.writes) - 1; i >= 0; i-- {
+		if uow.writes[i].idk == idk {
+			if uow.writes[i].identity == nil {
+				return nil, ErrNotFound
+			}
+			return copyIdentity(uow.writes[i].identity), nil
+		}
+	}
+	identity, err := uow.store.FindIdentity(ctx, idk)
+	if err != nil {
+		return nil, err
+	}
+	return copyIdentity(identity), nil
+}
+
+// SaveIdentity implements ContextAuthStore
+func (uow *unitOfWork) SaveIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	if uow.tx != nil {
+		return uow.tx.SaveIdentity(ctx, identity)
+	}
+	uow.writes = append(uow.writes, identityWrite{identity.Idk, copyIdentity(identity)})
+	return nil
+}
+
+// DeleteIdentity implements ContextAuthStore
+func (uow *unitOfWork) DeleteIdentity(ctx context.Context, idk string) error {
+	if uow.tx != nil {
+		return uow.tx.DeleteIdentity(ctx, idk)
+	}
+	uow.writes = append(uow.writes, identityWrite{idk, nil})
+	return nil
+}
+
+// SaveRekey records rekey in the audit trail if the store keeps one
+func (uow *unitOfWork) SaveRekey(ctx context.Context, rekey *Rekey) error {
+	if uow.rekeys == nil {
+		return nil
+	}
+	if uow.tx != nil {
+		return uow.rekeys.SaveRekey(ctx, rekey)
+	}
+	uow.rekeySaves = append(uow.rekeySaves, rekey)
+	return nil
+}
+
+// FindRekeys returns the audit trail for idk including rekeys saved in
+// this unit of work; it's empty if the store keeps no audit trail
+func (uow *unitOfWork) FindRekeys(ctx context.Context, idk string) ([]*Rekey, error) {
+	if uow.rekeys == nil {
+		return nil, nil
+	}
+	rekeys, err := uow.rekeys.FindRekeys(ctx, idk)
+	if err != nil || uow.tx != nil {
+		return rekeys, err
+	}
+	for _, rekey := range uow.rekeySaves {
+		if rekey.PreviousIdk == idk || rekey.Idk == idk {
+			rekeys = append(rekeys, rekey)
+		}
+	}
+	return rekeys, nil
+}
+
+// SaveHoard defers a Hoard save until commit
+func (uow *unitOfWork) SaveHoard(nut Nut, value *HoardCache, expiration time.Duration) {
+	uow.hoardSaves = append(uow.hoardSaves, hoardSave{nut, value, expiration})
+}
+
+// publish queues an event until the unit of work is committed
+func (uow *unitOfWork) publish(event *Event) {
+	uow.events = append(uow.events, event)
+}
+
+// Commit applies the Hoard saves and then commits the identity changes.
+// If either fails everything already applied is undone.
+func (uow *unitOfWork) Commit(ctx context.Context) error {
+	if uow.done {
+		return fmt.Errorf("unit of work already finished")
+	}
+	uow.done = true
+
+	for i, save := range uow.hoardSaves {
+		if err := uow.hoard.Save(ctx, save.nut, save.value, save.expiration); err != nil {
+			uow.undoHoardSaves(ctx, i)
+			uow.rollbackStore()
+			return fmt.Errorf("failed saving nut: %v", err)
+		}
+	}
+
+	var err error
+	if uow.tx != nil {
+		err = uow.tx.Commit()
+	} else {
+		err = uow.applyWrites(ctx)
+	}
+	if err != nil {
+		uow.undoHoardSaves(ctx, len(uow.hoardSaves))
+		return fmt.Errorf("failed committing identity changes: %v", err)
+	}
+	return nil
+}
+
+// Rollback discards all changes. It's a no-op after Commit.
+func (uow *unitOfWork) Rollback() {
+	if uow.done {
+		return
+	}
+	uow.done = true
+	uow.rollbackStore()
+}
+
+func (uow *unitOfWork) rollbackStore() {
+	if uow.tx != nil {
+		if err := uow.tx.Rollback(); err != nil {
+			uow.log.Error("rollback_identity", err)
+		}
+	}
+	uow.writes = nil
+	uow.rekeySaves = nil
+}
+
+// undoHoardSaves removes the first n hoard saves
+func (uow *unitOfWork) undoHoardSaves(ctx context.Context, n int) {
+	for _, save := range uow.hoardSaves[:n] {
+		if _, err := uow.hoard.GetAndDelete(context.WithoutCancel(ctx), save.nut); err != nil && err != ErrNotFound {
+			uow.log.Error("undo_hoard_save", err)
+		}
+	}
+}
+
+// applyWrites applies buffered writes to a non-transactional store. The
+// previous value of each identity is captured first so the writes already
+// applied can be reverted if a later one fails.
+func (uow *unitOfWork) applyWrites(ctx context.Context) error {
+	type original struct {
+		idk      string
+		identity *SqrlIdentity
+	}
+	applied := make([]original, 0, len(uow.writes))
+	var err error
+	for _, write := range uow.writes {
+		var previous *SqrlIdentity
+		previous, err = uow.store.FindIdentity(ctx, write.idk)
+		if err != nil && err != ErrNotFound {
+			break
+		}
+		if write.identity == nil {
+			err = uow.store.DeleteIdentity(ctx, write.idk)
+		} else {
+			err = uow.store.SaveIdentity(ctx, write.identity)
+		}
+		if err != nil {
+			break
+		}
+		applied = append(applied, original{write.idk, copyIdentity(previous)})
+	}
+	// the audit trail goes last so a failed record undoes the swap
+	for _, rekey := range uow.rekeySaves {
+		if err != nil {
+			break
+		}
+		err = uow.rekeys.SaveRekey(ctx, rekey)
+	}
+	if err == nil {
+		return nil
+	}
+
+	undoCtx := context.WithoutCancel(ctx)
+	for i := len(applied) - 1; i >= 0; i-- {
+		var undoErr error
+		if applied[i].identity == nil {
+			undoErr = uow.store.DeleteIdentity(undoCtx, applied[i].idk)
+		} else {
+			undoErr = uow.store.SaveIdentity(undoCtx, applied[i].identity)
+		}
+		if undoErr != nil {
+			uow.log.Error("undo_identity_write", undoErr)
+		}
+	}
+	return err
+}
+
+func copyIdentity(identity *SqrlIdentity) *SqrlIdentity {
+	if identity == nil {
+		return nil
+	}
+	c := *identity
+	return &c
+}
@@ -0,0 +1,165 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// flakyAuthStore fails SaveIdentity for a specific idk
+type flakyAuthStore struct {
+	ContextAuthStore
+	failIdk string
+}
+
+func (f *flakyAuthStore) SaveIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	if identity.Idk == f.failIdk {
+		return fmt.Errorf("database unavailable")
+	}
+	return f.ContextAuthStore.SaveIdentity(ctx, identity)
+}
+
+// flakyHoard fails saves of a specific nut
+type flakyHoard struct {
+	ContextHoard
+	failNut Nut
+}
+
+func (f *flakyHoard) Save(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	if nut == f.failNut {
+		return fmt.Errorf("hoard unavailable")
+	}
+	return f.ContextHoard.Save(ctx, nut, value, expiration)
+}
+
+func TestUnitOfWorkBuffersWrites(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	uow, err := api.beginUnitOfWork(ctx)
+	if err != nil {
+		t.Fatalf("Failed begin: %v", err)
+	}
+
+	if err := uow.SaveIdentity(ctx, &SqrlIdentity{Idk: "a"}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if _, err := uow.FindIdentity(ctx, "a"); err != nil {
+		t.Errorf("Pending write not visible in unit of work: %v", err)
+	}
+	if _, err := api.authStore.FindIdentity(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Pending write visible outside unit of work: %v", err)
+	}
+
+	if err := uow.Commit(ctx); err != nil {
+		t.Fatalf("Failed commit: %v", err)
+	}
+	if _, err := api.authStore.FindIdentity(ctx, "a"); err != nil {
+		t.Errorf("Committed write not visible: %v", err)
+	}
+}
+
+func TestUnitOfWorkFindReturnsCopy(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	if err := api.authStore.SaveIdentity(ctx, &SqrlIdentity{Idk: "a"}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	uow, _ := api.beginUnitOfWork(ctx)
+	identity, err := uow.FindIdentity(ctx, "a")
+	if err != nil {
+		t.Fatalf("Failed find: %v", err)
+	}
+	identity.Disabled = true
+	uow.Rollback()
+
+	stored, _ := api.authStore.FindIdentity(ctx, "a")
+	if stored.Disabled {
+		t.Error("Change to unsaved identity leaked into the store")
+	}
+}
+
+func TestUnitOfWorkRevertsPartialWrites(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	if err := api.authStore.SaveIdentity(ctx, &SqrlIdentity{Idk: "a", Suk: "original"}); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	api.authStore = &flakyAuthStore{ContextAuthStore: api.authStore, failIdk: "b"}
+
+	uow, _ := api.beginUnitOfWork(ctx)
+	_ = uow.SaveIdentity(ctx, &SqrlIdentity{Idk: "a", Suk: "changed"})
+	_ = uow.SaveIdentity(ctx, &SqrlIdentity{Idk: "b"})
+	uow.SaveHoard("pag", &HoardCache{}, time.Minute)
+	if err := uow.Commit(ctx); err == nil {
+		t.Fatal("Expected commit to fail")
+	}
+
+	stored, _ := api.authStore.FindIdentity(ctx, "a")
+	if stored.Suk != "original" {
+		t.Errorf("Expected partial write to be reverted, got suk %q", stored.Suk)
+	}
+	if _, err := api.hoard.Get(ctx, "pag"); err != ErrNotFound {
+		t.Errorf("Expected hoard save to be undone, got %v", err)
+	}
+}
+
+func TestUnitOfWorkHoardFailureSkipsWrites(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	api.hoard = &flakyHoard{ContextHoard: api.hoard, failNut: "pag"}
+
+	uow, _ := api.beginUnitOfWork(ctx)
+	_ = uow.SaveIdentity(ctx, &SqrlIdentity{Idk: "a"})
+	uow.SaveHoard("pag", &HoardCache{}, time.Minute)
+	if err := uow.Commit(ctx); err == nil {
+		t.Fatal("Expected commit to fail")
+	}
+	if _, err := api.authStore.FindIdentity(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Expected identity write to be skipped, got %v", err)
+	}
+	if err := uow.Commit(ctx); err == nil {
+		t.Error("Expected second commit to fail")
+	}
+}
+
+func TestCliRollsBackOnPagSaveFailure(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	api.hoard = &flakyHoard{ContextHoard: api.hoard, failNut: client.pag}
+
+	client.send("query")
+	resp := client.send("ident")
+	if resp.TIF&(TIFTransientError|TIFCommandFailed) != TIFTransientError|TIFCommandFailed {
+		t.Errorf("Expected transient error, got 0x%x", resp.TIF)
+	}
+	if _, err := api.authStore.FindIdentity(context.Background(), client.idk()); err != ErrNotFound {
+		t.Errorf("Expected new identity to be rolled back, got %v", err)
+	}
+}
+
+func TestCliRollsBackRekey(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+	client.send("query")
+	client.send("ident")
+
+	previousIdk := client.idk()
+	client.previous = client.key
+	client.key = newTestKey(t)
+	api.authStore = &flakyAuthStore{ContextAuthStore: api.authStore, failIdk: client.idk()}
+	client.newNut()
+	client.send("query")
+	resp := client.send("ident")
+	if resp.TIF&TIFCommandFailed == 0 {
+		t.Fatalf("Expected rekey to fail, got 0x%x", resp.TIF)
+	}
+
+	previous, err := api.authStore.FindIdentity(context.Background(), previousIdk)
+	if err != nil {
+		t.Fatalf("Previous identity missing: %v", err)
+	}
+	if previous.Rekeyed != "" {
+		t.Errorf("Expected half-applied rekey to be rolled back, got rekeyed=%q", previous.Rekeyed)
+	}
+}
@@ -0,0 +1,121 @@
+package ssp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxVersion is the highest version accepted. It also bounds how many
+// versions a "ver" value can list, counting repeats, so ranges like
+// "1-9999,1-9999,..." can't be used to allocate huge version sets.
+const maxVersion = 9999
+
+// Versions is a set of SQRL protocol versions. On the wire it's a comma
+// separated list of single versions and inclusive ranges, e.g. "1-2,4".
+type Versions []int
+
+// SupportedVersions are the protocol versions this server implements
+var SupportedVersions = Versions{1}
+
+// ParseVersions parses the "ver" format of a client or server body
+func ParseVersions(ver string) (Versions, error) {
+	if ver == "" {
+		return nil, fmt.Errorf("empty version")
+	}
+	var versions Versions
+	for rest, more := ver, true; more; {
+		var part string
+		part, rest, more = strings.Cut(rest, ",")
+		lowStr, highStr, isRange := strings.Cut(part, "-")
+		low, err := parseVersion(lowStr)
+		if err != nil {
+			return nil, err
+		}
+		high := low
+		if isRange {
+			high, err = parseVersion(highStr)
+			if err != nil {
+				return nil, err
+			}
+			if high < low {
+				return nil, fmt.Errorf("invalid version range %q", part)
+			}
+		}
+		if len(versions)+high-low+1 > maxVersion {
+			return nil, fmt.Errorf("more than %d versions", maxVersion)
+		}
+		for v := low; v <= high; v++ {
+			versions = append(versions, v)
+		}
+	}
+	return versions.normalize(), nil
+}
+
+func parseVersion(v string) (int, error) {
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q: %v", v, err)
+	}
+	if version < 1 || version > maxVersion {
+		return 0, fmt.Errorf("version %d out of range", version)
+	}
+	return version, nil
+}
+
+// normalize returns a sorted copy without duplicates
+func (v Versions) normalize() Versions {
+	sorted := make(Versions, 0, len(v))
+	sorted = append(sorted, v...)
+	sort.Ints(sorted)
+	unique := sorted[:0]
+	for i, version := range sorted {
+		if i == 0 || version != sorted[i-1] {
+			unique = append(unique, version)
+		}
+	}
+	return unique
+}
+
+// String encodes the versions in the "ver" format collapsing
+// consecutive versions into ranges
+func (v Versions) String() string {
+	sorted := v.normalize()
+	parts := make([]string, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// Contains reports whether version is in the set
+func (v Versions) Contains(version int) bool {
+	for _, candidate := range v {
+		if candidate == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the highest version in both sets. The bool is false
+// if the sets have no version in common.
+func (v Versions) Negotiate(other Versions) (int, bool) {
+	best, found := 0, false
+	for _, version := range v {
+		if version > best && other.Contains(version) {
+			best, found = version, true
+		}
+	}
+	return best, found
+}
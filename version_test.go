@@ -0,0 +1,113 @@
+package ssp
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVersions(t *testing.T) {
+	testCases := []struct {
+		ver      string
+		expected Versions
+	}{
+		{"1", Versions{1}},
+		{"1,2", Versions{1, 2}},
+		{"1-3", Versions{1, 2, 3}},
+		{"1-2,4", Versions{1, 2, 4}},
+		{"4,1-2,2", Versions{1, 2, 4}},
+	}
+	for _, tc := range testCases {
+		versions, err := ParseVersions(tc.ver)
+		if err != nil {
+			t.Errorf("ParseVersions(%q) failed: %v", tc.ver, err)
+			continue
+		}
+		if !reflect.DeepEqual(versions, tc.expected) {
+			t.Errorf("ParseVersions(%q) = %v, expected %v", tc.ver, versions, tc.expected)
+		}
+	}
+}
+
+func TestParseVersions_Invalid(t *testing.T) {
+	for _, ver := range []string{"", "a", "1-", "-1", "2-1", "0", "1,,2", "1-100000"} {
+		if _, err := ParseVersions(ver); err == nil {
+			t.Errorf("Expected error parsing %q", ver)
+		}
+	}
+}
+
+func TestParseVersions_Hostile(t *testing.T) {
+	// a megabyte of full ranges would otherwise expand to over a billion versions
+	ver := strings.Repeat("1-9999,", 1<<20/7) + "1"
+	if _, err := ParseVersions(ver); err == nil {
+		t.Errorf("Expected error parsing %d repeated ranges", 1<<20/7)
+	}
+	body := Sqrl64.EncodeToString([]byte("ver=" + ver + "\r\nnut=a\r\ntif=0\r\nqry=/cli.sqrl\r\n"))
+	if _, err := ParseCliResponse([]byte(body)); err == nil {
+		t.Errorf("Expected error parsing a response with repeated ranges")
+	}
+	if versions, err := ParseVersions("1-9999"); err != nil || len(versions) != maxVersion {
+		t.Errorf("Expected every version accepted, got %d %v", len(versions), err)
+	}
+}
+
+func TestVersions_String(t *testing.T) {
+	testCases := []struct {
+		versions Versions
+		expected string
+	}{
+		{Versions{1}, "1"},
+		{Versions{1, 2}, "1-2"},
+		{Versions{4, 2, 1}, "1-2,4"},
+		{Versions{1, 3, 5, 6, 7}, "1,3,5-7"},
+		{Versions{}, ""},
+	}
+	for _, tc := range testCases {
+		if s := tc.versions.String(); s != tc.expected {
+			t.Errorf("%v.String() = %q, expected %q", []int(tc.versions), s, tc.expected)
+		}
+	}
+}
+
+func TestVersions_Negotiate(t *testing.T) {
+	version, ok := Versions{1, 2, 3}.Negotiate(Versions{2, 3, 4})
+	if !ok || version != 3 {
+		t.Errorf("Expected 3, got %d %v", version, ok)
+	}
+	_, ok = Versions{1}.Negotiate(Versions{2, 3})
+	if ok {
+		t.Error("Expected no common version")
+	}
+}
+
+func TestCliNegotiatesVersionRange(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+
+	resp := client.send("query", func(cb *ClientBody) { cb.Version = Versions{1, 2} })
+	if resp.TIF&TIFFunctionNotSupported != 0 {
+		t.Errorf("Expected version range to be accepted, got 0x%x", resp.TIF)
+	}
+	if !reflect.DeepEqual(resp.Version, SupportedVersions) {
+		t.Errorf("Expected response versions %v, got %v", SupportedVersions, resp.Version)
+	}
+	hoardCache, err := api.hoard.Get(context.Background(), resp.Nut)
+	if err != nil {
+		t.Fatalf("Next nut not saved: %v", err)
+	}
+	if hoardCache.LastRequest.Version != 1 {
+		t.Errorf("Expected negotiated version 1, got %d", hoardCache.LastRequest.Version)
+	}
+}
+
+func TestCliUnsupportedVersion(t *testing.T) {
+	api := newTestAPI(t)
+	client := newTestSqrlClient(t, api)
+
+	resp := client.send("query", func(cb *ClientBody) { cb.Version = Versions{2, 3} })
+	if resp.TIF&TIFFunctionNotSupported == 0 {
+		t.Errorf("Expected function not supported, got 0x%x", resp.TIF)
+	}
+}
@@ -0,0 +1,229 @@
+package ssp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers set on webhook deliveries
+const (
+	WebhookSignatureHeader = "Sqrl-Signature"
+	WebhookTimestampHeader = "Sqrl-Timestamp"
+)
+
+// WebhookSink POSTs each event as JSON to URL. Requests carry a
+// Sqrl-Timestamp header (unix seconds) and a Sqrl-Signature header of
+// "sha256=" followed by the hex HMAC-SHA256 of the timestamp, a ".", and
+// the body, keyed with Secret; see VerifyWebhookSignature.
+//
+// Deliveries happen on a background goroutine in the order published.
+// Network errors, 429 and 5xx responses are retried with exponential
+// backoff. Events are dropped if the queue is full or retries run out.
+// Configure the fields before the first Publish. The zero value delivers
+// with a 10 second timeout and no retries; NewWebhookSink sets retries.
+type WebhookSink struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+	// attempts after the first; NewWebhookSink sets 3
+	MaxRetries int
+	// wait before the first retry, doubled each time; NewWebhookSink sets 1s
+	Backoff time.Duration
+	// optional; overrides the package logger (see SetLogger), usually set
+	// to the SqrlSspAPI.Logger
+	Logger *slog.Logger
+
+	queue   chan *Event
+	start   sync.Once
+	stop    chan struct{}
+	stopped chan struct{}
+	// held across the closed check and the enqueue so nothing is queued
+	// once Close has stopped the deliveries
+	mutex  sync.RWMutex
+	closed bool
+	// done ends deliveries in progress when Close gives up waiting
+	done   context.Context
+	cancel context.CancelFunc
+}
+
+// webhookQueueSize is how many events a WebhookSink holds for delivery
+const webhookQueueSize = 1000
+
+// NewWebhookSink creates a WebhookSink that retries failed deliveries
+func NewWebhookSink(url string, secret []byte) *WebhookSink {
+	return &WebhookSink{
+		URL:        url,
+		Secret:     secret,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		MaxRetries: 3,
+		Backoff:    time.Second,
+	}
+}
+
+// init creates the queue and starts delivering
+func (ws *WebhookSink) init() {
+	ws.queue = make(chan *Event, webhookQueueSize)
+	ws.stop = make(chan struct{})
+	ws.stopped = make(chan struct{})
+	ws.done, ws.cancel = context.WithCancel(context.Background())
+	if ws.Client == nil {
+		ws.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	go ws.deliverAll()
+}
+
+// log returns the WebhookSink.Logger or the package logger
+func (ws *WebhookSink) log() safeLog {
+	if ws.Logger != nil {
+		return safeLog{ws.Logger}
+	}
+	return safeLog{Logger()}
+}
+
+// Publish implements EventSink
+func (ws *WebhookSink) Publish(ctx context.Context, event *Event) {
+	ws.start.Do(ws.init)
+	ws.mutex.RLock()
+	defer ws.mutex.RUnlock()
+	if ws.closed {
+		ws.log().ErrorMsg("webhook", "dropping event published after close")
+		return
+	}
+	select {
+	case ws.queue <- event:
+	default:
+		ws.log().ErrorMsg("webhook", "queue full, dropping event")
+	}
+}
+
+// Close stops accepting events and waits for queued events to be
+// delivered or ctx to be done, when deliveries and retries still
+// pending are abandoned
+func (ws *WebhookSink) Close(ctx context.Context) error {
+	ws.start.Do(ws.init)
+	ws.mutex.Lock()
+	if !ws.closed {
+		ws.closed = true
+		close(ws.stop)
+	}
+	ws.mutex.Unlock()
+	select {
+	case <-ws.stopped:
+		return nil
+	case <-ctx.Done():
+		ws.cancel()
+		return ctx.Err()
+	}
+}
+
+func (ws *WebhookSink) deliverAll() {
+	defer close(ws.stopped)
+	defer ws.cancel()
+	for {
+		select {
+		case event := <-ws.queue:
+			ws.deliver(event)
+		case <-ws.stop:
+			// drain what's already queued
+			for ws.done.Err() == nil {
+				select {
+				case event := <-ws.queue:
+					ws.deliver(event)
+				default:
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+func (ws *WebhookSink) deliver(event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		ws.log().Error("webhook_encode", err)
+		return
+	}
+	backoff := ws.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := ws.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= ws.MaxRetries {
+			ws.log().Error("webhook_delivery", err)
+			return
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ws.done.Done():
+			timer.Stop()
+			ws.log().Error("webhook_delivery", err)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post sends one delivery attempt and reports whether a failure is worth
+// retrying
+func (ws *WebhookSink) post(body []byte) (bool, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ws.done, "POST", ws.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+webhookSignature(ws.Secret, timestamp, body))
+
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+}
+
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks a delivery from a WebhookSink. It returns
+// an error if the signature doesn't match or the timestamp is further
+// than maxAge from now.
+func VerifyWebhookSignature(secret []byte, r *http.Request, body []byte, maxAge time.Duration) error {
+	timestamp := r.Header.Get(WebhookTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp: %v", err)
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > maxAge || age < -maxAge {
+		return fmt.Errorf("webhook timestamp outside allowed window")
+	}
+	expected := "sha256=" + webhookSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(WebhookSignatureHeader))) {
+		return fmt.Errorf("invalid webhook signature")
+	}
+	return nil
+}
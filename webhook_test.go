@@ -0,0 +1,178 @@
+package ssp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookSinkDelivers(t *testing.T) {
+	secret := []byte("secret")
+	received := make(chan *Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhookSignature(secret, r, body, time.Minute); err != nil {
+			t.Errorf("Signature didn't verify: %v", err)
+		}
+		if err := VerifyWebhookSignature([]byte("wrong"), r, body, time.Minute); err == nil {
+			t.Error("Expected wrong secret to fail")
+		}
+		event := &Event{}
+		if err := json.Unmarshal(body, event); err != nil {
+			t.Errorf("Failed decoding event: %v", err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, secret)
+	sink.Publish(context.Background(), &Event{ID: "1", Type: EventIdentityRemoved, Idk: "idk"})
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	select {
+	case event := <-received:
+		if event.Type != EventIdentityRemoved || event.Idk != "idk" {
+			t.Errorf("Wrong event delivered: %+v", event)
+		}
+	default:
+		t.Fatal("Event not delivered")
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, []byte("secret"))
+	sink.Backoff = time.Millisecond
+	sink.Publish(context.Background(), &Event{Type: EventIdentityDisabled})
+	_ = sink.Close(context.Background())
+	if attempts.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestWebhookSinkNoRetryOnClientError(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, []byte("secret"))
+	sink.Backoff = time.Millisecond
+	sink.Publish(context.Background(), &Event{Type: EventIdentityDisabled})
+	_ = sink.Close(context.Background())
+	if attempts.Load() != 1 {
+		t.Errorf("Expected 1 attempt, got %d", attempts.Load())
+	}
+}
+
+func TestWebhookSinkZeroValue(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{URL: server.URL, Secret: []byte("secret")}
+	sink.Publish(context.Background(), &Event{Type: EventIdentityDisabled})
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("Expected the event delivered, got %d attempts", attempts.Load())
+	}
+}
+
+func TestWebhookSinkCloseAbandonsBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, []byte("secret"))
+	sink.Backoff = time.Hour
+	sink.Publish(context.Background(), &Event{Type: EventIdentityDisabled})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sink.Close(ctx); err == nil {
+		t.Error("Expected Close to give up waiting")
+	}
+	select {
+	case <-sink.stopped:
+	case <-time.After(time.Second):
+		t.Error("Expected delivery to stop once Close gave up")
+	}
+}
+
+func TestWebhookSinkLogger(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWebhookSink("http://127.0.0.1:0", []byte("secret"))
+	sink.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	_ = sink.Close(context.Background())
+	sink.Publish(context.Background(), &Event{Type: EventIdentityDisabled})
+	if !strings.Contains(buf.String(), "dropping event published after close") {
+		t.Errorf("Expected the drop logged to the sink's logger, got %q", buf.String())
+	}
+}
+
+func TestWebhookSinkPublishDuringClose(t *testing.T) {
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered.Add(1)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	sink := NewWebhookSink(server.URL, []byte("secret"))
+	sink.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	const publishers, events = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				sink.Publish(context.Background(), &Event{Type: EventIdentityDisabled})
+			}
+		}()
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	wg.Wait()
+
+	// every event is either delivered or logged as dropped
+	dropped := strings.Count(buf.String(), "dropping event")
+	if total := int(delivered.Load()) + dropped; total != publishers*events {
+		t.Errorf("Expected %d events accounted for, got %d delivered and %d dropped", publishers*events, delivered.Load(), dropped)
+	}
+}
+
+func TestVerifyWebhookSignatureExpired(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", nil)
+	body := []byte("{}")
+	timestamp := "1000"
+	r.Header.Set(WebhookTimestampHeader, timestamp)
+	r.Header.Set(WebhookSignatureHeader, "sha256="+webhookSignature([]byte("s"), timestamp, body))
+	if err := VerifyWebhookSignature([]byte("s"), r, body, time.Minute); err == nil {
+		t.Error("Expected old timestamp to fail")
+	}
+}